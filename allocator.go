@@ -0,0 +1,334 @@
+// UID and GID allocation
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// counter names
+const (
+	uidCounter = "uid"
+	gidCounter = "gid"
+	// per-tag GID pools use gid:<tag>
+	gidPoolCounterPrefix = "gid:"
+)
+
+// An idRange is an inclusive range of IDs, Max is ignored if unbounded
+type idRange struct {
+	Min       int
+	Max       int
+	Unbounded bool
+}
+
+func (r idRange) contains(id int) bool {
+	return id >= r.Min && (r.Unbounded || id <= r.Max)
+}
+
+func (r idRange) String() string {
+	if r.Unbounded {
+		return fmt.Sprintf("%d-", r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// parseIDRange parses ranges like "3000-3999" or single IDs like "65534"
+func parseIDRange(s string) (idRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || min < 0 {
+		return idRange{}, fmt.Errorf("Invalid ID range %q", s)
+	}
+	max := min
+	if len(parts) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || max < min {
+			return idRange{}, fmt.Errorf("Invalid ID range %q", s)
+		}
+	}
+	return idRange{Min: min, Max: max}, nil
+}
+
+func parseIDRanges(list []string) ([]idRange, error) {
+	ranges := []idRange{}
+	for _, s := range list {
+		r, err := parseIDRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// An idAllocator issues IDs of a pool from a counter,
+// the counter holds the last issued ID
+type idAllocator struct {
+	kind     string // uid or gid
+	counter  string
+	pool     idRange
+	reserved []idRange
+}
+
+// newUIDAllocator returns the allocator of user IDs
+func newUIDAllocator(cfg TUNAConfig) (*idAllocator, error) {
+	reserved, err := parseIDRanges(cfg.ReservedUIDs)
+	if err != nil {
+		return nil, err
+	}
+	return &idAllocator{
+		kind:     uidCounter,
+		counter:  uidCounter,
+		pool:     idRange{Min: cfg.MinimumUID, Unbounded: true},
+		reserved: reserved,
+	}, nil
+}
+
+// newGIDAllocator returns the allocator of group IDs under tag,
+// tags without a configured pool share the global GID counter,
+// which never issues IDs inside any tag pool
+func newGIDAllocator(cfg TUNAConfig, tag string) (*idAllocator, error) {
+	reserved, err := parseIDRanges(cfg.ReservedGIDs)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := parseGIDPools(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if pool, ok := pools[tag]; ok && tag != "" {
+		return &idAllocator{
+			kind:     gidCounter,
+			counter:  gidPoolCounterPrefix + tag,
+			pool:     pool,
+			reserved: reserved,
+		}, nil
+	}
+	for _, pool := range pools {
+		reserved = append(reserved, pool)
+	}
+	return &idAllocator{
+		kind:     gidCounter,
+		counter:  gidCounter,
+		pool:     idRange{Min: cfg.MinimumGID, Unbounded: true},
+		reserved: reserved,
+	}, nil
+}
+
+func parseGIDPools(cfg TUNAConfig) (map[string]idRange, error) {
+	pools := map[string]idRange{}
+	for tag, s := range cfg.GIDPools {
+		r, err := parseIDRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("GID pool of tag %s: %s", tag, err.Error())
+		}
+		pools[tag] = r
+	}
+	return pools, nil
+}
+
+// validateIDConfig checks the ID ranges of the config,
+// so that mistakes are found at startup instead of allocation
+func validateIDConfig(cfg TUNAConfig) error {
+	if _, err := newUIDAllocator(cfg); err != nil {
+		return err
+	}
+	pools, err := parseGIDPools(cfg)
+	if err != nil {
+		return err
+	}
+	tags := []string{}
+	for tag := range pools {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for i, a := range tags {
+		for _, b := range tags[i+1:] {
+			pa, pb := pools[a], pools[b]
+			if pa.Min <= pb.Max && pb.Min <= pa.Max {
+				return fmt.Errorf("GID pools of tag %s and %s overlap", a, b)
+			}
+		}
+	}
+	_, err = newGIDAllocator(cfg, "")
+	return err
+}
+
+// next issues a new ID, skipping reserved ranges and IDs
+// which are used by existing documents, including deleted ones
+func (a *idAllocator) next(m Store) (int, error) {
+	if err := m.ensureCounterMin(a.counter, a.pool.Min-1); err != nil {
+		return 0, err
+	}
+	for {
+		id, err := m.nextSeq(a.counter)
+		if err != nil {
+			return 0, err
+		}
+		if !a.pool.contains(id) {
+			return 0, fmt.Errorf("No %s left in pool %s", a.kind, a.pool)
+		}
+		if r := a.reservedRange(id); r != nil {
+			if r.Unbounded {
+				return 0, fmt.Errorf("No %s left in pool %s", a.kind, a.pool)
+			}
+			// jump over the whole range
+			if err := m.ensureCounterMin(a.counter, r.Max); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		used, err := a.used(m, id)
+		if err != nil {
+			return 0, err
+		}
+		if used {
+			logger.Warningf("%s %d is already in use, skipped", a.kind, id)
+			continue
+		}
+		return id, nil
+	}
+}
+
+func (a *idAllocator) reservedRange(id int) *idRange {
+	for i := range a.reserved {
+		if a.reserved[i].contains(id) {
+			return &a.reserved[i]
+		}
+	}
+	return nil
+}
+
+func (a *idAllocator) used(m Store, id int) (bool, error) {
+	if a.kind == uidCounter {
+		users, err := m.ListUsers(bson.M{"_id": id})
+		return len(users) > 0, err
+	}
+	groups, err := m.ListGroups(bson.M{"gid": id})
+	return len(groups) > 0, err
+}
+
+// issued reports whether an ID chosen by the caller, e.g. in LDAP Add,
+// may have been issued before. IDs of the pool up to the counter may
+// belong to purged documents, so they are never handed out again.
+func (a *idAllocator) issued(m Store, id int) (bool, error) {
+	if a.pool.contains(id) {
+		counters, err := m.ListCounters()
+		if err != nil {
+			return false, err
+		}
+		if id <= counters[a.counter] {
+			return true, nil
+		}
+	}
+	return a.used(m, id)
+}
+
+// observe raises the counter past an ID issued elsewhere, e.g. imported
+func (a *idAllocator) observe(m Store, id int) error {
+	if !a.pool.contains(id) {
+		return nil
+	}
+	return m.ensureCounterMin(a.counter, id)
+}
+
+// gidPoolTag returns the tag whose GID pool contains id, if any
+func gidPoolTag(cfg TUNAConfig, id int) (string, bool, error) {
+	pools, err := parseGIDPools(cfg)
+	if err != nil {
+		return "", false, err
+	}
+	for tag, pool := range pools {
+		if pool.contains(id) {
+			return tag, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// allocateUID issues a UID with the loaded config
+func allocateUID(m Store) (int, error) {
+	a, err := newUIDAllocator(dcfg.TUNA)
+	if err != nil {
+		return 0, err
+	}
+	return a.next(m)
+}
+
+// allocateGID issues a GID for a group under tag with the loaded config
+func allocateGID(m Store, tag string) (int, error) {
+	a, err := newGIDAllocator(dcfg.TUNA, tag)
+	if err != nil {
+		return 0, err
+	}
+	return a.next(m)
+}
+
+// A counterInfo describes a counter for administrators
+type counterInfo struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+	Pool  string `json:"pool"`
+}
+
+// listCounterInfo returns all counters and configured pools
+func listCounterInfo(m Store, cfg TUNAConfig) ([]counterInfo, error) {
+	counters, err := m.ListCounters()
+	if err != nil {
+		return nil, err
+	}
+	pools := map[string]string{
+		uidCounter: idRange{Min: cfg.MinimumUID, Unbounded: true}.String(),
+		gidCounter: idRange{Min: cfg.MinimumGID, Unbounded: true}.String(),
+	}
+	for tag, s := range cfg.GIDPools {
+		pools[gidPoolCounterPrefix+tag] = s
+	}
+	for name := range pools {
+		if _, ok := counters[name]; !ok {
+			counters[name] = 0
+		}
+	}
+
+	infos := []counterInfo{}
+	for name, value := range counters {
+		infos = append(infos, counterInfo{Name: name, Value: value, Pool: pools[name]})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// raiseCounter sets a counter to value, counters cannot be
+// lowered as IDs below may have been issued to purged accounts
+func raiseCounter(m Store, cfg TUNAConfig, name string, value int, actor auditActor) error {
+	infos, err := listCounterInfo(m, cfg)
+	if err != nil {
+		return err
+	}
+	var info *counterInfo
+	for i := range infos {
+		if infos[i].Name == name {
+			info = &infos[i]
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("No such counter: %s", name)
+	}
+	old := info.Value
+	if value < old {
+		return fmt.Errorf("Counter %s is %d, counters can only be raised", name, old)
+	} else if value == old {
+		return nil
+	}
+	if err := m.ensureCounterMin(name, value); err != nil {
+		return err
+	}
+	writeAudit(m, actor, "counter.set", auditTargetCounter, name, bson.M{"seq": old}, bson.M{"seq": value})
+	return nil
+}
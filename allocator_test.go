@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAllocator(t *testing.T) {
+	Convey("Test ID allocation", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		cfg := dcfg.TUNA
+		cfg.ReservedUIDs = []string{"2001-2002", "2005"}
+		cfg.ReservedGIDs = []string{"2001"}
+		cfg.GIDPools = map[string]string{"lab": "2003-2004"}
+		m := newMemoryStore()
+
+		next := func(a *idAllocator) int {
+			id, err := a.next(m)
+			So(err, ShouldBeNil)
+			return id
+		}
+
+		Convey("Reserved ranges should be skipped", func() {
+			a, err := newUIDAllocator(cfg)
+			So(err, ShouldBeNil)
+			ids := []int{next(a), next(a), next(a), next(a)}
+			So(ids, ShouldResemble, []int{2000, 2003, 2004, 2006})
+		})
+
+		Convey("A single ID 0 should only reserve 0", func() {
+			r, err := parseIDRange("0")
+			So(err, ShouldBeNil)
+			So(r.contains(0), ShouldBeTrue)
+			So(r.contains(2000), ShouldBeFalse)
+			So(r.String(), ShouldEqual, "0-0")
+
+			zero := cfg
+			zero.ReservedUIDs = []string{"0"}
+			zero.ReservedGIDs = []string{"0"}
+			zero.GIDPools = map[string]string{"root": "0"}
+			a, err := newUIDAllocator(zero)
+			So(err, ShouldBeNil)
+			So(next(a), ShouldEqual, 2000)
+			global, err := newGIDAllocator(zero, "")
+			So(err, ShouldBeNil)
+			So(next(global), ShouldEqual, 2000)
+		})
+
+		Convey("Used IDs should be skipped", func() {
+			So(m.InsertUser(User{UID: 2000, Username: "zhangsan", Deleted: &Tombstone{}}), ShouldBeNil)
+			a, _ := newUIDAllocator(cfg)
+			So(next(a), ShouldEqual, 2003)
+		})
+
+		Convey("Tags should allocate from their pools", func() {
+			lab, err := newGIDAllocator(cfg, "lab")
+			So(err, ShouldBeNil)
+			So(next(lab), ShouldEqual, 2003)
+			So(next(lab), ShouldEqual, 2004)
+			_, err = lab.next(m)
+			So(err, ShouldNotBeNil)
+
+			global, _ := newGIDAllocator(cfg, "other")
+			So([]int{next(global), next(global)}, ShouldResemble, []int{2000, 2002})
+			So(next(global), ShouldEqual, 2005)
+		})
+
+		Convey("Imported IDs should raise counters", func() {
+			a, _ := newUIDAllocator(cfg)
+			So(a.observe(m, 3000), ShouldBeNil)
+			So(a.observe(m, 100), ShouldBeNil)
+			So(next(a), ShouldEqual, 3001)
+		})
+
+		Convey("Counters can only be raised", func() {
+			actor := auditActor{Name: "root", Kind: actorCLI}
+			So(raiseCounter(m, cfg, "gid:lab", 2003, actor), ShouldBeNil)
+			So(raiseCounter(m, cfg, "gid:lab", 2002, actor), ShouldNotBeNil)
+			So(raiseCounter(m, cfg, "nonexist", 2002, actor), ShouldNotBeNil)
+			infos, err := listCounterInfo(m, cfg)
+			So(err, ShouldBeNil)
+			So(infos, ShouldResemble, []counterInfo{
+				{Name: "gid", Value: 0, Pool: "2000-"},
+				{Name: "gid:lab", Value: 2003, Pool: "2003-2004"},
+				{Name: "uid", Value: 0, Pool: "2000-"},
+			})
+		})
+
+		Convey("Invalid configs should be refused", func() {
+			So(validateIDConfig(cfg), ShouldBeNil)
+			bad := cfg
+			bad.ReservedUIDs = []string{"3000-2000"}
+			So(validateIDConfig(bad), ShouldNotBeNil)
+			bad = cfg
+			bad.GIDPools = map[string]string{"a": "100-200", "b": "200-300"}
+			So(validateIDConfig(bad), ShouldNotBeNil)
+		})
+	})
+}
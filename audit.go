@@ -0,0 +1,206 @@
+// audit trail of account mutations
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// kinds of audit actors
+const (
+	actorUser         = "user"          // logged in with JWT
+	actorRootPassword = "root_password" // logged in with temporary root password
+	actorCLI          = "cli"           // local root running tunaccount commands
+	actorLDAP         = "ldap"          // bound to the LDAP server
+	actorSystem       = "system"        // background jobs of the daemon
+)
+
+// audit target types
+const (
+	auditTargetUser     = "user"
+	auditTargetGroup    = "group"
+	auditTargetTag      = "tag"
+	auditTargetDatabase = "database"
+	auditTargetCounter  = "counter"
+)
+
+// fields whose values never go to the audit log
+var auditRedactedFields = map[string]bool{
+	"password": true,
+}
+
+// An auditActor is who performs a mutation
+type auditActor struct {
+	Name string
+	Kind string
+	IP   string
+}
+
+// cliActor returns the local user running the command
+func cliActor() auditActor {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return auditActor{Name: name, Kind: actorCLI}
+}
+
+// httpActor returns the user logged in the HTTP API
+func httpActor(c *gin.Context) auditActor {
+	actor := auditActor{Kind: actorUser, IP: c.ClientIP()}
+	if iuser, ok := c.Get("user"); ok {
+		if u, ok := iuser.(User); ok {
+			actor.Name = u.Username
+			if u.UID == 0 && u.Username == "root" {
+				actor.Kind = actorRootPassword
+			}
+		}
+	}
+	return actor
+}
+
+// writeAudit records a mutation of target from before to after,
+// either of them can be nil for creations and deletions.
+// Failures are logged since the mutation has already happened.
+func writeAudit(m Store, actor auditActor, action, targetType, target string, before, after interface{}) {
+	rec := AuditRecord{
+		ID:         bson.NewObjectId().Hex(),
+		Time:       time.Now().Truncate(time.Millisecond),
+		Actor:      actor.Name,
+		ActorKind:  actor.Kind,
+		SourceIP:   actor.IP,
+		Action:     action,
+		TargetType: targetType,
+		Target:     target,
+		Changes:    auditDiff(before, after),
+	}
+	if err := m.InsertAudit(rec); err != nil {
+		logger.Errorf("Failed to write audit log of %s %s: %s", action, target, err.Error())
+	}
+}
+
+// groupAuditName identifies a group in audit logs as name@tag
+func groupAuditName(g PosixGroup) string {
+	if g.Tag == "" {
+		return g.Name
+	}
+	return g.Name + "@" + g.Tag
+}
+
+// auditDiff compares the bson documents of two models
+func auditDiff(before, after interface{}) []AuditChange {
+	var b, a bson.M
+	if before != nil {
+		b = toDoc(before)
+	}
+	if after != nil {
+		a = toDoc(after)
+	}
+
+	fields := map[string]bool{}
+	for k := range b {
+		fields[k] = true
+	}
+	for k := range a {
+		fields[k] = true
+	}
+
+	changes := []AuditChange{}
+	for field := range fields {
+		bv, av := b[field], a[field]
+		if reflect.DeepEqual(bv, av) {
+			continue
+		}
+		if auditRedactedFields[field] {
+			bv, av = redactValue(bv), redactValue(av)
+		}
+		changes = append(changes, AuditChange{Field: field, Before: bv, After: av})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+func redactValue(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return v
+	}
+	return "(redacted)"
+}
+
+// auditQuery builds an audit log filter, empty conditions are ignored,
+// until is excluded from the range if untilExclusive is set
+func auditQuery(username, actor, action string, since, until time.Time, untilExclusive bool) bson.M {
+	q := bson.M{}
+	if username != "" {
+		q["target_type"] = auditTargetUser
+		q["target"] = username
+	}
+	if actor != "" {
+		q["actor"] = actor
+	}
+	if action != "" {
+		q["action"] = action
+	}
+	timeRange := bson.M{}
+	if !since.IsZero() {
+		timeRange["$gte"] = since
+	}
+	if !until.IsZero() && untilExclusive {
+		timeRange["$lt"] = until
+	} else if !until.IsZero() {
+		timeRange["$lte"] = until
+	}
+	if len(timeRange) > 0 {
+		q["time"] = timeRange
+	}
+	return q
+}
+
+// parseAuditTime accepts RFC3339 timestamps or dates
+func parseAuditTime(s string) (time.Time, error) {
+	t, _, err := parseAuditDate(s)
+	return t, err
+}
+
+// parseAuditUntil parses the end of an audit time range, a date covers
+// the whole day, so it ends at the following midnight, which is excluded
+func parseAuditUntil(s string) (until time.Time, exclusive bool, err error) {
+	t, dateOnly, err := parseAuditDate(s)
+	if err != nil || !dateOnly {
+		return t, false, err
+	}
+	return t.AddDate(0, 0, 1), true, nil
+}
+
+func parseAuditDate(s string) (t time.Time, dateOnly bool, err error) {
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, false, fmt.Errorf("Invalid time %s, use YYYY-MM-DD or RFC3339", s)
+	}
+	return t, true, nil
+}
+
+// lastAuditRecords keeps the latest limit records, 0 means no limit
+func lastAuditRecords(records []AuditRecord, limit int) []AuditRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAudit(t *testing.T) {
+	Convey("Test audit logs", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+
+		admin := auditActor{Name: "admin", Kind: actorUser, IP: "10.0.0.1"}
+		before := User{UID: 2001, Username: "zhangsan", LoginShell: "/bin/bash"}
+		after := before
+		after.LoginShell = "/bin/zsh"
+		after.Passwd("123456")
+
+		writeAudit(m, cliActor(), "user.add", auditTargetUser, "zhangsan", nil, before)
+		writeAudit(m, admin, "user.passwd", auditTargetUser, "zhangsan", before, after)
+		writeAudit(m, admin, "group.add", auditTargetGroup, "dev@testing", nil, PosixGroup{Name: "dev", Tag: "testing"})
+
+		Convey("Changes should be recorded with passwords redacted", func() {
+			records, err := m.ListAudit(auditQuery("", "", "user.passwd", time.Time{}, time.Time{}, false), 0)
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 1)
+			So(records[0].SourceIP, ShouldEqual, "10.0.0.1")
+			changes := records[0].Changes
+			So(len(changes), ShouldEqual, 3)
+			So(changes[:2], ShouldResemble, []AuditChange{
+				{Field: "login_shell", Before: "/bin/bash", After: "/bin/zsh"},
+				{Field: "password", Before: "", After: "(redacted)"},
+			})
+			So(changes[2].Field, ShouldEqual, "password_changed_at")
+		})
+
+		Convey("Records should be filtered by user and actor", func() {
+			records, _ := m.ListAudit(auditQuery("zhangsan", "", "", time.Time{}, time.Time{}, false), 0)
+			So(len(records), ShouldEqual, 2)
+			So(records[0].Action, ShouldEqual, "user.add")
+			So(records[0].ActorKind, ShouldEqual, actorCLI)
+
+			records, _ = m.ListAudit(auditQuery("", "admin", "", time.Time{}, time.Time{}, false), 0)
+			So(len(records), ShouldEqual, 2)
+
+			records, _ = m.ListAudit(auditQuery("", "", "", time.Time{}, time.Time{}, false), 1)
+			So(len(records), ShouldEqual, 1)
+			So(records[0].Action, ShouldEqual, "group.add")
+		})
+
+		Convey("Records should be filtered by time range", func() {
+			since := time.Now().Add(-time.Hour)
+			records, _ := m.ListAudit(auditQuery("", "", "", since, time.Time{}, false), 0)
+			So(len(records), ShouldEqual, 3)
+			records, _ = m.ListAudit(auditQuery("", "", "", time.Time{}, since, false), 0)
+			So(len(records), ShouldEqual, 0)
+		})
+
+		Convey("A date until should include the whole day", func() {
+			midday := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+			So(m.InsertAudit(AuditRecord{Time: midday, Action: "user.tag"}), ShouldBeNil)
+
+			until, exclusive, err := parseAuditUntil("2026-10-17")
+			So(err, ShouldBeNil)
+			So(exclusive, ShouldBeTrue)
+			So(until, ShouldResemble, time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local))
+			records, _ := m.ListAudit(auditQuery("", "", "user.tag", time.Time{}, until, exclusive), 0)
+			So(len(records), ShouldEqual, 1)
+
+			until, exclusive, err = parseAuditUntil(midday.Format(time.RFC3339))
+			So(err, ShouldBeNil)
+			So(exclusive, ShouldBeFalse)
+			So(until.Equal(midday), ShouldBeTrue)
+			records, _ = m.ListAudit(auditQuery("", "", "user.tag", time.Time{}, until, exclusive), 0)
+			So(len(records), ShouldEqual, 1)
+			records, _ = m.ListAudit(auditQuery("", "", "user.tag", time.Time{}, until.Add(-time.Second), exclusive), 0)
+			So(len(records), ShouldEqual, 0)
+		})
+
+		Convey("Audit times should be parsed", func() {
+			t, err := parseAuditTime("2020-01-02")
+			So(err, ShouldBeNil)
+			So(t.Day(), ShouldEqual, 2)
+			_, err = parseAuditTime("2020-01-02T03:04:05Z")
+			So(err, ShouldBeNil)
+			_, err = parseAuditTime("yesterday")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,573 @@
+// embedded single-file storage backend
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// bucket names follow mongodb collection names
+var boltBuckets = []string{
+	mgoUserColl, mgoPosixGroupColl, mgoFilterTagColl, mgoCounterColl, mgoMetaColl,
+	mgoAuditColl,
+}
+
+// A boltStore keeps documents bson encoded in a bbolt database file,
+// uniqueness rules are the same as mgoIndexes
+type boltStore struct {
+	file *boltFile
+	// held is set if the store keeps file open until Close
+	held bool
+}
+
+// how long opening a bbolt file waits for other processes to unlock it
+var boltLockTimeout = 5 * time.Second
+
+// A boltFile opens the database file only while stores use it.
+// bbolt locks the file while it is open, so keeping it open would
+// lock out the commands as long as the daemon is running.
+type boltFile struct {
+	path string
+	opts *bolt.Options
+
+	mu   sync.Mutex
+	db   *bolt.DB
+	refs int
+}
+
+func openBolt(c DatabaseConfig, readOnly bool) (*boltStore, error) {
+	f := &boltFile{
+		path: c.Path,
+		opts: &bolt.Options{
+			Timeout:  boltLockTimeout,
+			ReadOnly: readOnly,
+		},
+	}
+	s := &boltStore{file: f}
+	if readOnly {
+		// check that the file can be opened
+		_, err := f.acquire()
+		if err == nil {
+			f.release()
+		}
+		return s, err
+	}
+
+	err := f.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// acquire opens the database file if no one else has opened it
+func (f *boltFile) acquire() (*bolt.DB, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refs == 0 {
+		db, err := bolt.Open(f.path, 0600, f.opts)
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf(
+				"%s is locked by another process, which may be tunaccountd serving a request or another command",
+				f.path)
+		} else if err != nil {
+			return nil, err
+		}
+		f.db = db
+	}
+	f.refs++
+	return f.db, nil
+}
+
+// release closes the database file once no one uses it
+func (f *boltFile) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refs--; f.refs == 0 {
+		f.db.Close()
+		f.db = nil
+	}
+}
+
+func (f *boltFile) View(fn func(*bolt.Tx) error) error {
+	db, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer f.release()
+	return db.View(fn)
+}
+
+func (f *boltFile) Update(fn func(*bolt.Tx) error) error {
+	db, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer f.release()
+	return db.Update(fn)
+}
+
+// Copy returns a handle that keeps the database file open until Close,
+// so that a unit of work opens it only once. bbolt handles concurrency
+// of handles on its own.
+func (s *boltStore) Copy() Store {
+	c := &boltStore{file: s.file}
+	// if the file is locked, every operation tries again and reports it
+	if _, err := s.file.acquire(); err == nil {
+		c.held = true
+	}
+	return c
+}
+
+// Close lets the database file be closed if s is a copy
+func (s *boltStore) Close() {
+	if s.held {
+		s.held = false
+		s.file.release()
+	}
+}
+
+func (s *boltStore) FindUsers(filter bson.M, tag string) []User {
+	var results []User
+	err := s.EachUser(filter, func(u User) error {
+		if userVisible(&u, tag) {
+			results = append(results, u)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return results
+}
+
+func (s *boltStore) ListUsers(filter bson.M) ([]User, error) {
+	results := []User{}
+	err := s.EachUser(filter, func(u User) error {
+		results = append(results, u)
+		return nil
+	})
+	return results, err
+}
+
+func (s *boltStore) InsertUser(user User) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoUserColl))
+		key := boltItob(user.UID)
+		if b.Get(key) != nil {
+			return errDuplicateKey
+		}
+		return boltPutUnique(b, mgoUserColl, key, user)
+	})
+}
+
+func (s *boltStore) UpdateUser(user User) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoUserColl))
+		key := boltItob(user.UID)
+		if err := boltCheckRevision(b.Get(key), user.Revision); err != nil {
+			return err
+		}
+		user.Revision++
+		return boltPutUnique(b, mgoUserColl, key, user)
+	})
+}
+
+func (s *boltStore) DeleteUser(uid int) error {
+	return boltDelete(s.file, mgoUserColl, boltItob(uid))
+}
+
+func (s *boltStore) FindGroups(filter bson.M, tag string) []PosixGroup {
+	var results []PosixGroup
+	err := s.EachGroup(filter, func(g PosixGroup) error {
+		if groupVisible(&g, tag) {
+			results = append(results, g)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	sortBoltGroups(results)
+	return results
+}
+
+func (s *boltStore) ListGroups(filter bson.M) ([]PosixGroup, error) {
+	results := []PosixGroup{}
+	err := s.EachGroup(filter, func(g PosixGroup) error {
+		results = append(results, g)
+		return nil
+	})
+	sortBoltGroups(results)
+	return results, err
+}
+
+// sortBoltGroups orders groups by GID and tag, as keys are ordered
+// by tag and GID
+func sortBoltGroups(groups []PosixGroup) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].GID != groups[j].GID {
+			return groups[i].GID < groups[j].GID
+		}
+		return groups[i].Tag < groups[j].Tag
+	})
+}
+
+func (s *boltStore) InsertGroup(group PosixGroup) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoPosixGroupColl))
+		key := boltGroupKey(group.Tag, group.GID)
+		if b.Get(key) != nil {
+			return errDuplicateKey
+		}
+		return boltPutUnique(b, mgoPosixGroupColl, key, group)
+	})
+}
+
+func (s *boltStore) UpdateGroup(group PosixGroup) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoPosixGroupColl))
+		key := boltGroupKey(group.Tag, group.GID)
+		if err := boltCheckRevision(b.Get(key), group.Revision); err != nil {
+			return err
+		}
+		group.Revision++
+		return boltPutUnique(b, mgoPosixGroupColl, key, group)
+	})
+}
+
+func (s *boltStore) DeleteGroup(tag string, gid int) error {
+	return boltDelete(s.file, mgoPosixGroupColl, boltGroupKey(tag, gid))
+}
+
+func (s *boltStore) EnsureTag(tagName string) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoFilterTagColl))
+		if b.Get([]byte(tagName)) != nil {
+			return nil
+		}
+		if err := validateTagName(tagName); err != nil {
+			return err
+		}
+		data, err := bson.Marshal(FilterTag{Name: tagName})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(tagName), data)
+	})
+}
+
+func (s *boltStore) InsertTag(tag FilterTag) error {
+	if err := validateTagName(tag.Name); err != nil {
+		return err
+	}
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoFilterTagColl))
+		if b.Get([]byte(tag.Name)) != nil {
+			return errDuplicateKey
+		}
+		data, err := bson.Marshal(tag)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(tag.Name), data)
+	})
+}
+
+func (s *boltStore) UpdateTag(tag FilterTag) error {
+	data, err := bson.Marshal(tag)
+	if err != nil {
+		return err
+	}
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoFilterTagColl))
+		if b.Get([]byte(tag.Name)) == nil {
+			return errNotFound
+		}
+		return b.Put([]byte(tag.Name), data)
+	})
+}
+
+func (s *boltStore) DeleteTag(tagName string) error {
+	return boltDelete(s.file, mgoFilterTagColl, []byte(tagName))
+}
+
+func (s *boltStore) ListTags() ([]FilterTag, error) {
+	results := []FilterTag{}
+	err := s.file.View(func(tx *bolt.Tx) error {
+		return boltScan(tx, mgoFilterTagColl, bson.M{}, func(v []byte) error {
+			var tag FilterTag
+			if err := bson.Unmarshal(v, &tag); err != nil {
+				return err
+			}
+			results = append(results, tag)
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (s *boltStore) nextSeq(ID string) (int, error) {
+	var seq int
+	err := s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoCounterColl))
+		if v := b.Get([]byte(ID)); v != nil {
+			seq = boltBtoi(v)
+		}
+		seq++
+		return b.Put([]byte(ID), boltItob(seq))
+	})
+	return seq, err
+}
+
+func (s *boltStore) ensureCounterMin(ID string, val int) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoCounterColl))
+		v := b.Get([]byte(ID))
+		if v != nil && boltBtoi(v) >= val {
+			return nil
+		}
+		return b.Put([]byte(ID), boltItob(val))
+	})
+}
+
+func (s *boltStore) InsertAudit(rec AuditRecord) error {
+	data, err := bson.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.file.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(mgoAuditColl)).Put([]byte(rec.ID), data)
+	})
+}
+
+func (s *boltStore) ListAudit(filter bson.M, limit int) ([]AuditRecord, error) {
+	results := []AuditRecord{}
+	err := s.file.View(func(tx *bolt.Tx) error {
+		return boltScan(tx, mgoAuditColl, filter, func(v []byte) error {
+			var rec AuditRecord
+			if err := bson.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			results = append(results, rec)
+			return nil
+		})
+	})
+	return lastAuditRecords(results, limit), err
+}
+
+func (s *boltStore) SchemaVersion() (int, error) {
+	version := 0
+	err := s.file.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoMetaColl))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte("schema")); v != nil {
+			version = boltBtoi(v)
+		}
+		return nil
+	})
+	return version, err
+}
+
+func (s *boltStore) SetSchemaVersion(version int) error {
+	return s.file.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(mgoMetaColl)).Put([]byte("schema"), boltItob(version))
+	})
+}
+
+func (s *boltStore) ListCounters() (map[string]int, error) {
+	results := map[string]int{}
+	err := s.file.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(mgoCounterColl))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			results[string(k)] = boltBtoi(v)
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (s *boltStore) EachUser(filter bson.M, fn func(User) error) error {
+	return boltEach(s.file, mgoUserColl, filter, func(v []byte) error {
+		var u User
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		return fn(u)
+	})
+}
+
+func (s *boltStore) EachGroup(filter bson.M, fn func(PosixGroup) error) error {
+	return boltEach(s.file, mgoPosixGroupColl, filter, func(v []byte) error {
+		var g PosixGroup
+		if err := bson.Unmarshal(v, &g); err != nil {
+			return err
+		}
+		return fn(g)
+	})
+}
+
+// number of documents a transaction of boltEach scans
+const boltPageSize = 256
+
+// boltEach calls fn on raw documents of a bucket that match filter in
+// key order. Documents are read in pages by short transactions, and fn
+// runs outside of them, so that slow callers do not block writers.
+func boltEach(db *boltFile, bucket string, filter bson.M, fn func([]byte) error) error {
+	var last []byte
+	for {
+		var page [][]byte
+		more := false
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				// read-only database not initialized yet
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.First()
+			if last != nil {
+				if k, v = c.Seek(last); k != nil && bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+			for n := 0; k != nil; k, v = c.Next() {
+				if n == boltPageSize {
+					more = true
+					break
+				}
+				n++
+				last = append([]byte{}, k...)
+				doc := bson.M{}
+				if err := bson.Unmarshal(v, &doc); err != nil {
+					return err
+				}
+				if matchQuery(doc, filter) {
+					page = append(page, append([]byte{}, v...))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, v := range page {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// boltScan calls fn on raw documents of a bucket that match filter
+func boltScan(tx *bolt.Tx, bucket string, filter bson.M, fn func([]byte) error) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		// read-only database not initialized yet
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		doc := bson.M{}
+		if err := bson.Unmarshal(v, &doc); err != nil {
+			return err
+		}
+		if !matchQuery(doc, filter) {
+			return nil
+		}
+		return fn(v)
+	})
+}
+
+// boltPutUnique stores obj under key after checking it against
+// the unique indexes of coll
+func boltPutUnique(b *bolt.Bucket, coll string, key []byte, obj interface{}) error {
+	data, err := bson.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	err = b.ForEach(func(k, v []byte) error {
+		if string(k) == string(key) {
+			return nil
+		}
+		other := bson.M{}
+		if err := bson.Unmarshal(v, &other); err != nil {
+			return err
+		}
+		if violatesUnique(coll, doc, other) {
+			return errDuplicateKey
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// boltCheckRevision compares the revision of a stored document
+func boltCheckRevision(data []byte, rev int) error {
+	if data == nil {
+		return errNotFound
+	}
+	var doc struct {
+		Revision int `bson:"revision"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Revision != rev {
+		return errConflict
+	}
+	return nil
+}
+
+func boltDelete(db *boltFile, bucket string, key []byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b.Get(key) == nil {
+			return errNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+func boltGroupKey(tag string, gid int) []byte {
+	return append([]byte(tag+"\x00"), boltItob(gid)...)
+}
+
+// boltItob encodes an integer as sortable bytes
+func boltItob(v int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func boltBtoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
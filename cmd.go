@@ -8,24 +8,45 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
+	"reflect"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hackerzgz/getpass"
 	"github.com/urfave/cli"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// prepareConfig loads the config and the store of commands,
+// which refuse databases not on the latest schema
 func prepareConfig(cfgFile string) *DaemonConfig {
+	return loadConfigAndStore(cfgFile, false)
+}
+
+// loadConfigAndStore upgrades the schema if upgrade is set and the
+// store is writable, only the daemon and migrate do so
+func loadConfigAndStore(cfgFile string, upgrade bool) *DaemonConfig {
 	logger.Noticef("Using config file: %s", cfgFile)
 	cfg, err := loadDaemonConfig(cfgFile)
 	if err != nil {
 		logger.Panic(err.Error())
 	}
-	err = initMongo()
+	err = initStore()
 	if err != nil {
 		logger.Panicf(
-			fmt.Errorf("Error initializing mongodb: %s", err.Error()).Error())
+			fmt.Errorf("Error initializing database: %s", err.Error()).Error())
+	}
+	if upgrade && !cfg.ReadOnly {
+		err = upgradeSchema(_store, schemaMigrations)
+	} else if err = checkSchema(_store, schemaMigrations); err != nil &&
+		!cfg.ReadOnly && ensureEmptyStore(_store) == nil {
+		// a new database has nothing to migrate
+		err = upgradeSchema(_store, schemaMigrations)
+	}
+	if err != nil {
+		logger.Panic(err.Error())
 	}
 	return cfg
 }
@@ -52,24 +73,31 @@ func startDaemon(c *cli.Context) error {
 	initLogger(true, c.Bool("debug"), false)
 	logger.Notice("Debug mode: %v", c.Bool("debug"))
 
-	cfg := prepareConfig(c.GlobalString("config"))
+	cfg := loadConfigAndStore(c.GlobalString("config"), true)
 
 	httpListenAddr := fmt.Sprintf("%s:%d", cfg.HTTP.ListenAddr, cfg.HTTP.ListenPort)
-	runHTTPServer(httpListenAddr, cfg.HTTP.SecretKey, c.String("root-password"))
+	if !cfg.ReadOnly && cfg.TUNA.RetentionDays > 0 {
+		go runPurgeJob(cfg.TUNA.RetentionDays)
+	}
 
-	ldapListenAddr := fmt.Sprintf("%s:%d", cfg.LDAP.ListenAddr, cfg.LDAP.ListenPort)
-	logger.Noticef("Listen LDAP Addr: %s", ldapListenAddr)
+	runHTTPServer(httpListenAddr, cfg.HTTP.SecretKey, c.String("root-password"))
 
-	server := makeLDAPServer(ldapListenAddr)
+	servers, err := makeLDAPServers(cfg.LDAP)
+	if err != nil {
+		logger.Errorf("Failed to start LDAP server: %s", err.Error())
+		return err
+	}
 
 	// When CTRL+C, SIGINT and SIGTERM signal occurs
 	// Then stop server gracefully
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 	close(ch)
 
-	server.Stop()
+	for _, server := range servers {
+		server.Stop()
+	}
 	return nil
 }
 
@@ -87,7 +115,7 @@ func importFiles(c *cli.Context) error {
 		return err
 	}
 
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
 	for _, file := range c.Args() {
@@ -101,6 +129,249 @@ func importFiles(c *cli.Context) error {
 	return nil
 }
 
+func cmdMigrate(c *cli.Context) error {
+	initLogger(true, false, false)
+
+	from, to := c.String("from"), c.String("to")
+	if from == "" || to == "" {
+		fmt.Println("Both source and target config files are required")
+		cli.ShowCommandHelp(c, "migrate")
+		return errors.New("Invalid arguments")
+	}
+
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	for _, cfgFile := range []string{from, to} {
+		if _, err := os.Stat(cfgFile); err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+	}
+	srcCfg, err := parseDaemonConfig(from)
+	if err != nil {
+		return err
+	}
+	dstCfg, err := parseDaemonConfig(to)
+	if err != nil {
+		return err
+	}
+	if dstCfg.ReadOnly {
+		err := errors.New("Target database is configured read-only")
+		logger.Error(err.Error())
+		return err
+	}
+	if reflect.DeepEqual(srcCfg.DB, dstCfg.DB) {
+		err := errors.New("Source and target databases are the same")
+		logger.Error(err.Error())
+		return err
+	}
+
+	src, err := openStore(srcCfg.DB, srcCfg.ReadOnly)
+	if err != nil {
+		logger.Errorf("Error opening source database: %s", err.Error())
+		return err
+	}
+	defer src.Close()
+	dst, err := openStore(dstCfg.DB, false)
+	if err != nil {
+		logger.Errorf("Error opening target database: %s", err.Error())
+		return err
+	}
+	defer dst.Close()
+
+	if err := migrateStore(src, dst, dstCfg.TUNA); err != nil {
+		logger.Error(err.Error())
+		// migrateStore only writes to an empty target
+		logger.Error("The target database may be partially populated, empty it before retrying")
+		return err
+	}
+	if err := upgradeSchema(dst, schemaMigrations); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	writeAudit(dst, cliActor(), "database.migrate", auditTargetDatabase, from, nil, nil)
+	logger.Notice("Migration finished")
+	return nil
+}
+
+func cmdAudit(c *cli.Context) error {
+	initLogger(true, false, false)
+
+	since, err := parseAuditTime(c.String("since"))
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	until, untilExclusive, err := parseAuditUntil(c.String("until"))
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	filter := auditQuery(c.String("user"), c.String("actor"), c.String("action"), since, until, untilExclusive)
+	records, err := m.ListAudit(filter, c.Int("limit"))
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	for _, rec := range records {
+		actor := rec.ActorKind + ":" + rec.Actor
+		if rec.SourceIP != "" {
+			actor += "@" + rec.SourceIP
+		}
+		fmt.Printf(
+			"%s %s %s %s:%s\n",
+			rec.Time.Local().Format("2006-01-02 15:04:05"),
+			actor, rec.Action, rec.TargetType, rec.Target,
+		)
+		for _, change := range rec.Changes {
+			fmt.Printf("    %s: %v -> %v\n", change.Field, change.Before, change.After)
+		}
+	}
+	return nil
+}
+
+func cmdPurge(c *cli.Context) error {
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	cfg := prepareConfig(c.GlobalString("config"))
+	days := cfg.TUNA.RetentionDays
+	if c.IsSet("days") {
+		days = c.Int("days")
+	}
+	if days <= 0 && !c.IsSet("days") {
+		logger.Notice("Purging is disabled by retention_days")
+		return nil
+	}
+
+	m := getStore()
+	defer m.Close()
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	cnt, err := purgeTombstones(m, cutoff, cliActor())
+	if err != nil {
+		logger.Errorf("Failed to purge: %s", err.Error())
+		return err
+	}
+	logger.Noticef("Purged %d documents deleted before %s", cnt, cutoff.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+func cmdDoctor(c *cli.Context) error {
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	cfg := prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	issues, err := diagnose(m, cfg.TUNA)
+	if err != nil {
+		logger.Errorf("Failed to check database: %s", err.Error())
+		return err
+	}
+	fixable := 0
+	for _, issue := range issues {
+		mark := " "
+		if issue.fix != nil {
+			mark = "*"
+			fixable++
+		}
+		fmt.Printf("%s %s\n", mark, issue.String())
+	}
+	if len(issues) == 0 {
+		logger.Notice("No problems found")
+		return nil
+	}
+
+	if !c.Bool("fix") {
+		logger.Noticef("%d problems found, %d of them (*) can be fixed with --fix", len(issues), fixable)
+		return fmt.Errorf("%d problems found", len(issues))
+	}
+	fixed, err := repairIssues(m, issues, cliActor())
+	logger.Noticef("Fixed %d of %d problems", fixed, len(issues))
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	if fixed < len(issues) {
+		return fmt.Errorf("%d problems need manual repair", len(issues)-fixed)
+	}
+	return nil
+}
+
+func cmdCounterList(c *cli.Context) error {
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	cfg := prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	counters, err := listCounterInfo(m, cfg.TUNA)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	for _, counter := range counters {
+		fmt.Printf("%s: %d [pool: %s]\n", counter.Name, counter.Value, counter.Pool)
+	}
+	return nil
+}
+
+func cmdCounterSet(c *cli.Context) error {
+	if c.NArg() != 2 {
+		fmt.Println("Counter name and value are required")
+		cli.ShowCommandHelp(c, "set")
+		return errors.New("Invalid arguments")
+	}
+	value, err := strconv.Atoi(c.Args().Get(1))
+	if err != nil {
+		fmt.Println("Counter value must be an integer")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	cfg := prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	name := c.Args().Get(0)
+	if err := raiseCounter(m, cfg.TUNA, name, value, cliActor()); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	logger.Noticef("Counter %s set to %d", name, value)
+	return nil
+}
+
 // User Management commands
 
 func cmdUseradd(c *cli.Context) error {
@@ -119,12 +390,27 @@ func cmdUseradd(c *cli.Context) error {
 
 	cfg := prepareConfig(c.GlobalString("config"))
 
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
+	gid := cfg.TUNA.DefaultGID
+	if c.IsSet("gid") {
+		gid = c.Int("gid")
+	}
+	if err := checkPrimaryGroup(m, gid, nil); err != nil {
+		logger.Errorf("%s, create it with `tunaccount group new` first", err.Error())
+		return err
+	}
+
+	uid, err := allocateUID(m)
+	if err != nil {
+		logger.Errorf("Failed to allocate UID: %s", err.Error())
+		return err
+	}
+
 	user := User{
-		UID:        m.getNextSeq("uid"),
-		GID:        cfg.TUNA.DefaultGID,
+		UID:        uid,
+		GID:        gid,
 		Username:   c.Args().Get(0),
 		Name:       c.String("name"),
 		Email:      c.String("email"),
@@ -133,11 +419,12 @@ func cmdUseradd(c *cli.Context) error {
 		IsActive:   true,
 	}
 
-	err := m.UserColl().Insert(user)
+	err = m.InsertUser(user)
 	if err != nil {
 		logger.Errorf("Failed to add user: %s", err.Error())
 		return err
 	}
+	writeAudit(m, cliActor(), "user.add", auditTargetUser, user.Username, nil, user)
 
 	logger.Noticef("Successfully created account: %s", user.Username)
 	return nil
@@ -241,6 +528,151 @@ func cmdPasswd(c *cli.Context) error {
 	return nil
 }
 
+func cmdUserModify(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Username is required")
+		cli.ShowCommandHelp(c, "modify")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	var expires *time.Time
+	var inactive *int
+	var err error
+	if c.IsSet("expires") {
+		if expires, err = parseExpiry(c.String("expires")); err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+	}
+	if c.IsSet("inactive") {
+		if inactive, err = parseInactiveDays(c.String("inactive")); err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	username := c.Args().Get(0)
+	before, user, err := modifyUser(m, bson.M{"username": username, "deleted": nil}, func(u *User) error {
+		if c.IsSet("shell") {
+			u.LoginShell = c.String("shell")
+		}
+		if c.IsSet("name") {
+			u.Name = c.String("name")
+		}
+		if c.IsSet("email") {
+			u.Email = c.String("email")
+		}
+		if c.IsSet("phone") {
+			u.Phone = c.String("phone")
+		}
+		if c.IsSet("expires") {
+			u.ExpiresAt = expires
+		}
+		if c.IsSet("inactive") {
+			u.InactiveDays = inactive
+		}
+		return nil
+	})
+	if err == errNotFound {
+		err = fmt.Errorf("No such user: %s", username)
+	}
+	if err != nil {
+		logger.Errorf("Failed to modify user %s: %s", username, err.Error())
+		return err
+	}
+	writeAudit(m, cliActor(), "user.modify", auditTargetUser, username, before, user)
+	logger.Noticef("Modified user %s", username)
+	return nil
+}
+
+func cmdUserRename(c *cli.Context) error {
+	if c.NArg() != 2 {
+		fmt.Println("Old and new usernames are required")
+		cli.ShowCommandHelp(c, "rename")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	oldName, newName := c.Args().Get(0), c.Args().Get(1)
+	if err := renameUser(m, oldName, newName, cliActor()); err != nil {
+		logger.Errorf("Failed to rename user %s: %s", oldName, err.Error())
+		return err
+	}
+	logger.Noticef("Renamed user %s to %s", oldName, newName)
+	return nil
+}
+
+func cmdUserdel(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Username is required")
+		cli.ShowCommandHelp(c, "del")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	username := c.Args().Get(0)
+	if err := softDeleteUser(m, username, cliActor(), c.String("reason")); err != nil {
+		logger.Errorf("Failed to delete user %s: %s", username, err.Error())
+		return err
+	}
+	logger.Noticef("Deleted user %s, it can be restored within the retention period", username)
+	return nil
+}
+
+func cmdUserRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Username is required")
+		cli.ShowCommandHelp(c, "restore")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	username := c.Args().Get(0)
+	if err := restoreUser(m, username, cliActor()); err != nil {
+		logger.Errorf("Failed to restore user %s: %s", username, err.Error())
+		return err
+	}
+	logger.Noticef("Restored user %s", username)
+	return nil
+}
+
 // Group Management commands
 
 func cmdGroupList(c *cli.Context) error {
@@ -252,14 +684,14 @@ func cmdGroupList(c *cli.Context) error {
 		return err
 	}
 	prepareConfig(c.GlobalString("config"))
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
-	groups := []PosixGroup{}
-	m.PosixGroupColl().
-		Find(bson.M{"is_active": true, "tag": tag}).
-		Sort("gid").
-		All(&groups)
+	groups, err := m.ListGroups(bson.M{"is_active": true, "tag": tag, "deleted": nil})
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
 	for _, group := range groups {
 		fmt.Printf(
 			"%d:%s: %s\n", group.GID,
@@ -294,22 +726,29 @@ func cmdGroupAdd(c *cli.Context) error {
 
 	prepareConfig(c.GlobalString("config"))
 
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
 	groupname := c.Args().Get(0)
 
+	gid, err := allocateGID(m, tag)
+	if err != nil {
+		logger.Errorf("Failed to allocate GID: %s", err.Error())
+		return err
+	}
+
 	group := PosixGroup{
-		GID:      m.getNextSeq("gid"),
+		GID:      gid,
 		Name:     groupname,
 		IsActive: true,
 		Tag:      tag,
 	}
-	err := m.PosixGroupColl().Insert(group)
+	err = m.InsertGroup(group)
 	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
+	writeAudit(m, cliActor(), "group.add", auditTargetGroup, groupAuditName(group), nil, group)
 	logger.Noticef("added group %s", groupname)
 	return nil
 }
@@ -339,7 +778,7 @@ func cmdGroupAddUser(c *cli.Context) error {
 
 	prepareConfig(c.GlobalString("config"))
 
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
 	username := c.Args().Get(0)
@@ -349,31 +788,87 @@ func cmdGroupAddUser(c *cli.Context) error {
 		"name":      c.Args().Get(1),
 		"tag":       tag,
 		"is_active": true,
+		"deleted":   nil,
 	}
 
-	if cnt, err := m.PosixGroupColl().Find(selector).Count(); err != nil {
+	users := m.FindUsers(bson.M{"username": username}, "")
+	if len(users) < 1 {
+		err := fmt.Errorf("No such user: %s", username)
 		logger.Error(err.Error())
 		return err
-	} else if cnt != 1 {
-		err = fmt.Errorf("Not an exactly-one match for groups: %s [tag: %s]", groupname, tag)
+	}
+
+	before, group, err := modifyGroup(m, selector, func(g *PosixGroup) error {
+		if stringInSlice(username, g.Members) {
+			return errNoChange
+		}
+		g.Members = append(g.Members, username)
+		return nil
+	})
+	if err == errNoChange {
+		logger.Noticef("user %s is already in group %s", username, groupname)
+		return nil
+	} else if err == errNotFound {
+		err = fmt.Errorf("No such group: %s [tag: %s]", groupname, tag)
+	}
+	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
+	writeAudit(m, cliActor(), "group.adduser", auditTargetGroup, groupAuditName(group), before, group)
+	logger.Noticef("user %s added to group %s", username, groupname)
+	return nil
+}
 
-	users := m.FindUsers(bson.M{"username": username}, "")
-	if len(users) < 1 {
-		err := fmt.Errorf("No such user: %s", username)
+func cmdGroupDel(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Group name is required")
+		cli.ShowCommandHelp(c, "del")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
 		logger.Error(err.Error())
 		return err
 	}
 
-	err := m.PosixGroupColl().
-		Update(selector, bson.M{"$addToSet": bson.M{"members": username}})
-	if err != nil {
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	groupname, tag := c.Args().Get(0), c.String("tag")
+	if err := softDeleteGroup(m, groupname, tag, cliActor(), c.String("reason")); err != nil {
+		logger.Errorf("Failed to delete group %s: %s", groupname, err.Error())
+		return err
+	}
+	logger.Noticef("Deleted group %s", groupname)
+	return nil
+}
+
+func cmdGroupRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Group name is required")
+		cli.ShowCommandHelp(c, "restore")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
 		logger.Error(err.Error())
 		return err
 	}
-	logger.Noticef("user %s added to group %s", username, groupname)
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	groupname, tag := c.Args().Get(0), c.String("tag")
+	if err := restoreGroup(m, groupname, tag, cliActor()); err != nil {
+		logger.Errorf("Failed to restore group %s: %s", groupname, err.Error())
+		return err
+	}
+	logger.Noticef("Restored group %s", groupname)
 	return nil
 }
 
@@ -394,29 +889,100 @@ func cmdTagUser(c *cli.Context) error {
 
 	prepareConfig(c.GlobalString("config"))
 
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
 	tag := c.String("tag")
+	tags, err := m.ListTags()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	if t := findTag(tag, tags); t != nil && t.Deleted != nil {
+		err := fmt.Errorf("Tag %s is deleted, restore it first", tag)
+		logger.Error(err.Error())
+		return err
+	}
 	if err := m.EnsureTag(tag); err != nil {
 		logger.Error(err.Error())
 		return err
 	}
+	if !tagInList(tag, tags) {
+		writeAudit(m, cliActor(), "tag.add", auditTargetTag, tag, nil, FilterTag{Name: tag})
+	}
 
 	for _, username := range c.Args() {
-		selector := bson.M{"username": username}
-		users := m.FindUsers(selector, "")
-		if len(users) < 0 {
+		before, user, err := modifyUser(m, bson.M{"username": username, "deleted": nil}, func(u *User) error {
+			if stringInSlice(tag, u.Tags) {
+				return errNoChange
+			}
+			u.Tags = append(u.Tags, tag)
+			return nil
+		})
+		if err == errNoChange {
+			continue
+		} else if err == errNotFound {
 			logger.Warningf("user %s does not exist", username)
 			continue
+		} else if err != nil {
+			logger.Errorf("Failed to tag user %s: %s", username, err.Error())
+			continue
 		}
-		m.UserColl().Update(
-			selector, bson.M{
-				"$addToSet": bson.M{"tags": tag},
-			},
-		)
+		writeAudit(m, cliActor(), "user.tag", auditTargetUser, username, before, user)
 	}
 
 	return nil
 
 }
+
+func cmdTagDel(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Tag name is required")
+		cli.ShowCommandHelp(c, "del")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	tag := c.Args().Get(0)
+	if err := softDeleteTag(m, tag, cliActor(), c.String("reason")); err != nil {
+		logger.Errorf("Failed to delete tag %s: %s", tag, err.Error())
+		return err
+	}
+	logger.Noticef("Deleted tag %s", tag)
+	return nil
+}
+
+func cmdTagRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Tag name is required")
+		cli.ShowCommandHelp(c, "restore")
+		return errors.New("Invalid arguments")
+	}
+
+	initLogger(true, false, false)
+	if err := isRootUser(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	prepareConfig(c.GlobalString("config"))
+	m := getStore()
+	defer m.Close()
+
+	tag := c.Args().Get(0)
+	if err := restoreTag(m, tag, cliActor()); err != nil {
+		logger.Errorf("Failed to restore tag %s: %s", tag, err.Error())
+		return err
+	}
+	logger.Noticef("Restored tag %s", tag)
+	return nil
+}
@@ -14,6 +14,10 @@ type dbBackendEnum uint8
 const (
 	// DBEnumMongo reporesents mongodb backend
 	DBEnumMongo dbBackendEnum = iota
+	// DBEnumMemory represents in-memory backend, data is lost on exit
+	DBEnumMemory
+	// DBEnumBolt represents embedded bbolt database backend
+	DBEnumBolt
 )
 
 var dcfg DaemonConfig
@@ -23,6 +27,10 @@ func (b *dbBackendEnum) UnmarshalText(text []byte) error {
 	switch s {
 	case `mongo`, `mongodb`:
 		*b = DBEnumMongo
+	case `memory`:
+		*b = DBEnumMemory
+	case `bolt`, `bbolt`:
+		*b = DBEnumBolt
 	default:
 		return errors.New("Invalid value to database backend")
 	}
@@ -47,7 +55,8 @@ type DatabaseConfig struct {
 	Name     string            `toml:"name" default:"tunaccount"`
 	User     string            `toml:"user"`
 	Password string            `toml:"password"`
-	Options  map[string]string `toml:"options"` // database specific options
+	Options  map[string]string `toml:"options"`                                          // database specific options
+	Path     string            `toml:"path" default:"/var/lib/tunaccount/tunaccount.db"` // bolt only
 }
 
 // An LDAPConfig is ldap server configs
@@ -55,6 +64,29 @@ type LDAPConfig struct {
 	ListenAddr string `toml:"listen_addr" default:"127.0.0.1"`
 	ListenPort int    `toml:"listen_port" default:"389"`
 	Suffix     string `toml:"suffix"` // o=tuna
+	// LDAPS listener on listen_addr, disabled if 0
+	TLSListenPort int    `toml:"tls_listen_port"`
+	TLSCert       string `toml:"tls_cert"`
+	TLSKey        string `toml:"tls_key"`
+	// clients must present a certificate signed by it if set
+	TLSClientCA string `toml:"tls_client_ca"`
+	// refuse simple binds on unencrypted connections
+	RequireTLS bool `toml:"require_tls"`
+	// refuse anonymous binds and searches
+	DisableAnonymous bool `toml:"disable_anonymous"`
+	// read access of searches if set, otherwise anonymous binds read posix
+	// attributes and bound users all but userPassword
+	ACL []LDAPACL `toml:"acl"`
+}
+
+// An LDAPACL grants bind identities read access to a subtree
+type LDAPACL struct {
+	// "anonymous", "users" for any bound user, "admins" or bind DNs
+	Who []string `toml:"who"`
+	// DN of the subtree, the suffix if empty
+	Base string `toml:"base"`
+	// readable attributes, "*" for all but userPassword
+	Attrs []string `toml:"attrs"`
 }
 
 // An HTTPConfig is http server configs
@@ -69,6 +101,19 @@ type TUNAConfig struct {
 	MinimumUID int `toml:"minimum_uid" default:"2000"`
 	MinimumGID int `toml:"minimum_gid" default:"2000"`
 	DefaultGID int `toml:"default_gid" default:"2000"`
+	// IDs never allocated, e.g. "3000-3999" or "65534"
+	ReservedUIDs []string `toml:"reserved_uids"`
+	ReservedGIDs []string `toml:"reserved_gids"`
+	// GID ranges of groups with the tag, e.g. lab = "10000-19999"
+	GIDPools map[string]string `toml:"gid_pools"`
+	// days to keep soft deleted accounts, 0 disables purging
+	RetentionDays int `toml:"retention_days" default:"30"`
+	// password ageing published as shadowAccount attributes, in days
+	PasswordMaxDays  int `toml:"password_max_days" default:"99999"`
+	PasswordMinDays  int `toml:"password_min_days"`
+	PasswordWarnDays int `toml:"password_warn_days" default:"7"`
+	// days an expired password may still be changed, -1 for ever
+	InactiveDays int `toml:"inactive_days" default:"-1"`
 }
 
 // A ClientConfig specifies configurations for tunaccount cli client
@@ -98,14 +143,40 @@ func setDefaultValues(v reflect.Value) {
 }
 
 func loadDaemonConfig(cfgFile string) (*DaemonConfig, error) {
-	setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+	cfg, err := parseDaemonConfig(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	dcfg = *cfg
+	return &dcfg, nil
+}
+
+// parseDaemonConfig reads a config file without touching dcfg
+func parseDaemonConfig(cfgFile string) (*DaemonConfig, error) {
+	cfg := new(DaemonConfig)
+	setDefaultValues(reflect.ValueOf(cfg).Elem())
 
 	if _, err := os.Stat(cfgFile); err == nil {
-		if _, err := toml.DecodeFile(cfgFile, &dcfg); err != nil {
+		if _, err := toml.DecodeFile(cfgFile, cfg); err != nil {
 			logger.Errorf("Error parsing config file: %s", err.Error())
 			return nil, err
 		}
 	}
+	if err := validateIDConfig(cfg.TUNA); err != nil {
+		return nil, err
+	}
+	if err := validateShadowConfig(cfg.TUNA); err != nil {
+		return nil, err
+	}
+	if _, err := parseDN(cfg.LDAP.Suffix); err != nil {
+		return nil, err
+	}
+	if err := validateLDAPConfig(cfg.LDAP); err != nil {
+		return nil, err
+	}
+	if err := validateLDAPACL(cfg.LDAP.ACL); err != nil {
+		return nil, err
+	}
 
-	return &dcfg, nil
+	return cfg, nil
 }
@@ -0,0 +1,287 @@
+// database consistency checks and repairs
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// kinds of doctor issues
+const (
+	issueDuplicateGID   = "duplicate_gid"
+	issueDuplicateGroup = "duplicate_group_name"
+	issueMissingMember  = "missing_member"
+	issueInactiveMember = "inactive_member"
+	issueMissingPrimary = "missing_primary_group"
+	issueCounterBehind  = "counter_behind"
+	issueMissingTag     = "missing_tag"
+	issueBadPassword    = "bad_password_hash"
+	issueBadSSHKey      = "bad_ssh_key"
+)
+
+// A doctorIssue is an inconsistency found by diagnose,
+// fix is nil if it cannot be repaired safely
+type doctorIssue struct {
+	Kind   string
+	Target string
+	Detail string
+	fix    func(m Store, actor auditActor) error
+}
+
+func (i doctorIssue) String() string {
+	return fmt.Sprintf("[%s] %s: %s", i.Kind, i.Target, i.Detail)
+}
+
+// diagnose scans the whole database, deleted documents are
+// only checked where they still hold IDs or names
+func diagnose(m Store, cfg TUNAConfig) ([]doctorIssue, error) {
+	users, err := m.ListUsers(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	groups, err := m.ListGroups(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	tags, err := m.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	counters, err := m.ListCounters()
+	if err != nil {
+		return nil, err
+	}
+
+	issues := []doctorIssue{}
+	issues = append(issues, diagnoseGroupIDs(groups)...)
+	issues = append(issues, diagnoseMembers(users, groups)...)
+	issues = append(issues, diagnoseUsers(users, groups)...)
+	issues = append(issues, diagnoseTags(users, groups, tags)...)
+	counterIssues, err := diagnoseCounters(users, groups, counters, cfg)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, counterIssues...)
+	return issues, nil
+}
+
+// diagnoseGroupIDs finds universal groups clashing with tagged ones,
+// hosts of the tag would see both of them
+func diagnoseGroupIDs(groups []PosixGroup) []doctorIssue {
+	issues := []doctorIssue{}
+	universal := []PosixGroup{}
+	for _, g := range groups {
+		if g.Tag == "" && g.Deleted == nil {
+			universal = append(universal, g)
+		}
+	}
+	for _, g := range groups {
+		if g.Tag == "" || g.Deleted != nil {
+			continue
+		}
+		for _, u := range universal {
+			if u.GID == g.GID && u.Name != g.Name {
+				issues = append(issues, doctorIssue{
+					Kind:   issueDuplicateGID,
+					Target: groupAuditName(g),
+					Detail: fmt.Sprintf("GID %d is also used by universal group %s", g.GID, u.Name),
+				})
+			}
+			if u.Name == g.Name && u.GID != g.GID {
+				issues = append(issues, doctorIssue{
+					Kind:   issueDuplicateGroup,
+					Target: groupAuditName(g),
+					Detail: fmt.Sprintf("GID %d differs from universal group %s (%d)", g.GID, u.Name, u.GID),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+func diagnoseMembers(users []User, groups []PosixGroup) []doctorIssue {
+	byName := map[string]User{}
+	for _, u := range users {
+		byName[u.Username] = u
+	}
+
+	issues := []doctorIssue{}
+	for _, g := range groups {
+		missing := []string{}
+		for _, member := range g.Members {
+			u, ok := byName[member]
+			if !ok || u.Deleted != nil {
+				missing = append(missing, member)
+			} else if !u.IsActive {
+				issues = append(issues, doctorIssue{
+					Kind:   issueInactiveMember,
+					Target: groupAuditName(g),
+					Detail: fmt.Sprintf("member %s is inactive", member),
+				})
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		g := g
+		issues = append(issues, doctorIssue{
+			Kind:   issueMissingMember,
+			Target: groupAuditName(g),
+			Detail: fmt.Sprintf("members %v do not exist", missing),
+			fix: func(m Store, actor auditActor) error {
+				for _, member := range missing {
+					ref := []GroupRef{{Tag: g.Tag, GID: g.GID}}
+					if _, err := replaceMemberships(m, ref, member, "", actor); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+	return issues
+}
+
+func diagnoseUsers(users []User, groups []PosixGroup) []doctorIssue {
+	gids := map[int]bool{}
+	for _, g := range groups {
+		if g.Deleted == nil {
+			gids[g.GID] = true
+		}
+	}
+
+	issues := []doctorIssue{}
+	for _, u := range users {
+		if u.Deleted != nil {
+			continue
+		}
+		if !gids[u.GID] {
+			issues = append(issues, doctorIssue{
+				Kind:   issueMissingPrimary,
+				Target: u.Username,
+				Detail: fmt.Sprintf("primary group %d does not exist", u.GID),
+			})
+		}
+		if u.Password != "" && !isSSHAHash(u.Password) {
+			issues = append(issues, doctorIssue{
+				Kind:   issueBadPassword,
+				Target: u.Username,
+				Detail: "password is not a valid {SSHA} hash, the user cannot log in",
+			})
+		}
+		for _, key := range u.SSHKeys {
+			if _, _, err := parseSSHKey(key); err != nil {
+				issues = append(issues, doctorIssue{
+					Kind:   issueBadSSHKey,
+					Target: u.Username,
+					Detail: err.Error(),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+func diagnoseTags(users []User, groups []PosixGroup, tags []FilterTag) []doctorIssue {
+	referenced := map[string][]string{}
+	for _, u := range users {
+		for _, tag := range u.Tags {
+			referenced[tag] = append(referenced[tag], u.Username)
+		}
+	}
+	for _, g := range groups {
+		if g.Tag != "" {
+			referenced[g.Tag] = append(referenced[g.Tag], groupAuditName(g))
+		}
+	}
+
+	names := []string{}
+	for name := range referenced {
+		if !tagInList(name, tags) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	issues := []doctorIssue{}
+	for _, name := range names {
+		name := name
+		issues = append(issues, doctorIssue{
+			Kind:   issueMissingTag,
+			Target: name,
+			Detail: fmt.Sprintf("referenced by %v but absent from %s", referenced[name], mgoFilterTagColl),
+			fix: func(m Store, actor auditActor) error {
+				if err := m.EnsureTag(name); err != nil {
+					return err
+				}
+				writeAudit(m, actor, "tag.add", auditTargetTag, name, nil, FilterTag{Name: name})
+				return nil
+			},
+		})
+	}
+	return issues
+}
+
+// diagnoseCounters finds counters which would issue existing IDs
+func diagnoseCounters(users []User, groups []PosixGroup, counters map[string]int, cfg TUNAConfig) ([]doctorIssue, error) {
+	maxIDs := map[string]int{}
+	uids, err := newUIDAllocator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if uids.pool.contains(u.UID) && u.UID > maxIDs[uids.counter] {
+			maxIDs[uids.counter] = u.UID
+		}
+	}
+	for _, g := range groups {
+		gids, err := newGIDAllocator(cfg, g.Tag)
+		if err != nil {
+			return nil, err
+		}
+		if gids.pool.contains(g.GID) && g.GID > maxIDs[gids.counter] {
+			maxIDs[gids.counter] = g.GID
+		}
+	}
+
+	names := []string{}
+	for name := range maxIDs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	issues := []doctorIssue{}
+	for _, name := range names {
+		name, max := name, maxIDs[name]
+		if counters[name] >= max {
+			continue
+		}
+		issues = append(issues, doctorIssue{
+			Kind:   issueCounterBehind,
+			Target: name,
+			Detail: fmt.Sprintf("counter is %d, but ID %d is in use", counters[name], max),
+			fix: func(m Store, actor auditActor) error {
+				return raiseCounter(m, cfg, name, max, actor)
+			},
+		})
+	}
+	return issues, nil
+}
+
+// repairIssues applies the safe fixes, and returns the number of
+// fixed issues. Fixes are recorded in the audit trail.
+func repairIssues(m Store, issues []doctorIssue, actor auditActor) (int, error) {
+	fixed := 0
+	for _, issue := range issues {
+		if issue.fix == nil {
+			continue
+		}
+		if err := issue.fix(m, actor); err != nil {
+			return fixed, fmt.Errorf("Failed to fix %s: %s", issue.String(), err.Error())
+		}
+		fixed++
+	}
+	return fixed, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDoctor(t *testing.T) {
+	Convey("Test consistency checks", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+		actor := auditActor{Name: "root", Kind: actorCLI}
+
+		// the kind of data importJSON used to produce
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "users", IsActive: true}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "staff", Tag: "lab", Members: []string{"zhangsan", "ghost"}}), ShouldBeNil)
+		So(m.InsertUser(User{
+			UID: 2100, GID: 2000, Username: "zhangsan", Email: "zhangsan@example.com",
+			IsActive: true, Tags: []string{"lab"}, Password: generateSSHA("123456"),
+		}), ShouldBeNil)
+		So(m.InsertUser(User{
+			UID: 2001, GID: 4000, Username: "lisi", Email: "lisi@example.com",
+			IsActive: true, Password: "123456", SSHKeys: []string{"ssh-rsa AAAA"},
+		}), ShouldBeNil)
+
+		kinds := func(issues []doctorIssue) []string {
+			result := []string{}
+			for _, i := range issues {
+				result = append(result, i.Kind)
+			}
+			return result
+		}
+
+		Convey("Problems should be reported", func() {
+			issues, err := diagnose(m, dcfg.TUNA)
+			So(err, ShouldBeNil)
+			So(kinds(issues), ShouldResemble, []string{
+				issueDuplicateGID,
+				issueMissingMember,
+				issueMissingPrimary,
+				issueBadPassword,
+				issueBadSSHKey,
+				issueMissingTag,
+				issueCounterBehind,
+				issueCounterBehind,
+			})
+		})
+
+		Convey("Safe problems should be fixed and audited", func() {
+			issues, _ := diagnose(m, dcfg.TUNA)
+			fixed, err := repairIssues(m, issues, actor)
+			So(err, ShouldBeNil)
+			So(fixed, ShouldEqual, 4)
+
+			issues, _ = diagnose(m, dcfg.TUNA)
+			So(kinds(issues), ShouldResemble, []string{
+				issueDuplicateGID,
+				issueMissingPrimary,
+				issueBadPassword,
+				issueBadSSHKey,
+			})
+
+			groups, _ := m.ListGroups(bson.M{"tag": "lab"})
+			So(groups[0].Members, ShouldResemble, []string{"zhangsan"})
+			So(testUID(m), ShouldEqual, 2101)
+
+			records, _ := m.ListAudit(bson.M{"actor": "root"}, 0)
+			So(len(records), ShouldEqual, 4)
+		})
+
+		Convey("Clean databases should have no problems", func() {
+			c := newMemoryStore()
+			gid := testGID(c)
+			So(c.InsertGroup(PosixGroup{GID: gid, Name: "users", IsActive: true}), ShouldBeNil)
+			So(c.InsertUser(User{UID: testUID(c), GID: gid, Username: "zhangsan"}), ShouldBeNil)
+			issues, err := diagnose(c, dcfg.TUNA)
+			So(err, ShouldBeNil)
+			So(issues, ShouldBeEmpty)
+		})
+	})
+}
@@ -11,6 +11,11 @@ require (
 	github.com/smartystreets/goconvey v1.6.4
 	github.com/urfave/cli v1.22.5
 	github.com/vjeantet/ldapserver v1.0.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.9.0
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/op/go-logging.v1 v1.0.0-20160211212156-b2cb9fa56473
 )
+
+// MessageWriter, to send responses with controls
+replace github.com/vjeantet/ldapserver => ./third_party/ldapserver
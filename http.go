@@ -49,7 +49,7 @@ func runHTTPServer(listenAddr, secretKey, rootPwd string) {
 				}
 			}
 
-			m := getMongo()
+			m := getStore()
 			defer m.Close()
 			users := m.FindUsers(bson.M{"username": username}, "")
 			if len(users) != 1 {
@@ -72,7 +72,7 @@ func runHTTPServer(listenAddr, secretKey, rootPwd string) {
 				c.Set("user", rootUser)
 				return true
 			}
-			m := getMongo()
+			m := getStore()
 			defer m.Close()
 			users := m.FindUsers(bson.M{"username": username}, "")
 			if len(users) != 1 {
@@ -94,6 +94,10 @@ func runHTTPServer(listenAddr, secretKey, rootPwd string) {
 		api.GET("/refresh_token", jwtMidware.RefreshHandler)
 		api.POST("/admin/passwd", apiUpdatePassowrd)
 		api.GET("/users/", apiListUsers)
+		api.GET("/users/:username", apiGetUser)
+		api.GET("/audit", apiListAudit)
+		api.GET("/admin/counters", apiListCounters)
+		api.PUT("/admin/counters/:name", apiSetCounter)
 	}
 
 	httpServer := &http.Server{
@@ -0,0 +1,189 @@
+// referential integrity between users and groups
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A compensator records how to undo the steps of a write spanning
+// several documents, since not every backend has transactions
+type compensator struct {
+	undo []func() error
+}
+
+func (c *compensator) add(fn func() error) {
+	c.undo = append(c.undo, fn)
+}
+
+// rollback undoes the recorded steps in reverse order
+func (c *compensator) rollback() {
+	for i := len(c.undo) - 1; i >= 0; i-- {
+		if err := c.undo[i](); err != nil {
+			logger.Errorf("Failed to roll back, the directory may be inconsistent: %s", err.Error())
+		}
+	}
+	c.undo = nil
+}
+
+// checkPrimaryGroup makes sure a primary GID points at an existing group
+// visible to the user, i.e. a universal group or one under its tags
+func checkPrimaryGroup(m Store, gid int, tags []string) error {
+	groups, err := m.ListGroups(bson.M{"gid": gid, "deleted": nil})
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return fmt.Errorf("Primary group %d does not exist", gid)
+	}
+	for _, g := range groups {
+		if g.Tag == "" || stringInSlice(g.Tag, tags) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Primary group %d is not visible under the tags of the user", gid)
+}
+
+// checkMember makes sure a group member is an existing active user
+func checkMember(m Store, username string) error {
+	users, err := m.ListUsers(bson.M{"username": username, "deleted": nil})
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("No such user: %s", username)
+	}
+	if !users[0].IsActive {
+		return fmt.Errorf("User %s is inactive", username)
+	}
+	return nil
+}
+
+// checkGroupUnused refuses to delete the last group with the GID
+// while users still have it as their primary group
+func checkGroupUnused(m Store, group PosixGroup) error {
+	groups, err := m.ListGroups(bson.M{"gid": group.GID, "deleted": nil})
+	if err != nil {
+		return err
+	}
+	if len(groups) > 1 {
+		return nil
+	}
+	users, err := m.ListUsers(bson.M{"gid": group.GID, "deleted": nil})
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf(
+			"Group %s is the primary group of %d users, e.g. %s",
+			groupAuditName(group), len(users), users[0].Username,
+		)
+	}
+	return nil
+}
+
+// replaceMember changes the member old of a group to new, removes it if
+// new is empty, or adds new if old is empty
+func replaceMember(m Store, tag string, gid int, old, new string) (before, after PosixGroup, err error) {
+	selector := bson.M{"tag": tag, "gid": gid}
+	return modifyGroup(m, selector, func(g *PosixGroup) error {
+		if old != "" && !stringInSlice(old, g.Members) {
+			return errNoChange
+		} else if old == "" && stringInSlice(new, g.Members) {
+			return errNoChange
+		}
+		members := removeString(g.Members, old)
+		if new != "" && !stringInSlice(new, members) {
+			members = append(members, new)
+		}
+		g.Members = members
+		return nil
+	})
+}
+
+// replaceMemberships replaces old with new in the given groups,
+// and returns the changed ones. Changes are rolled back on failure.
+func replaceMemberships(m Store, refs []GroupRef, old, new string, actor auditActor) ([]GroupRef, error) {
+	var comp compensator
+	changed := []GroupRef{}
+	for _, ref := range refs {
+		ref := ref
+		before, group, err := replaceMember(m, ref.Tag, ref.GID, old, new)
+		if err == errNoChange {
+			continue
+		} else if err != nil {
+			comp.rollback()
+			return nil, fmt.Errorf("Failed to update members of group %d [tag: %s]: %s", ref.GID, ref.Tag, err.Error())
+		}
+		comp.add(func() error {
+			_, _, err := replaceMember(m, ref.Tag, ref.GID, new, old)
+			if err == errNoChange {
+				return nil
+			}
+			return err
+		})
+		action := "group.replaceuser"
+		if old == "" {
+			action = "group.adduser"
+		} else if new == "" {
+			action = "group.deluser"
+		}
+		writeAudit(m, actor, action, auditTargetGroup, groupAuditName(group), before, group)
+		changed = append(changed, ref)
+	}
+	return changed, nil
+}
+
+// groupsOfMember returns the groups username is member of
+func groupsOfMember(m Store, username string) ([]GroupRef, error) {
+	groups, err := m.ListGroups(bson.M{"members": username})
+	if err != nil {
+		return nil, err
+	}
+	refs := []GroupRef{}
+	for _, g := range groups {
+		refs = append(refs, GroupRef{Tag: g.Tag, GID: g.GID})
+	}
+	return refs, nil
+}
+
+// renameUser changes a username and cascades it into group members
+func renameUser(m Store, oldName, newName string, actor auditActor) error {
+	if oldName == newName {
+		return nil
+	}
+	if users, err := m.ListUsers(bson.M{"username": newName}); err != nil {
+		return err
+	} else if len(users) > 0 {
+		return fmt.Errorf("User %s already exists", newName)
+	}
+
+	before, user, err := modifyUser(m, bson.M{"username": oldName, "deleted": nil}, func(u *User) error {
+		u.Username = newName
+		return nil
+	})
+	if err == errNotFound {
+		return fmt.Errorf("No such user: %s", oldName)
+	} else if err != nil {
+		return err
+	}
+
+	refs, err := groupsOfMember(m, oldName)
+	if err == nil {
+		_, err = replaceMemberships(m, refs, oldName, newName, actor)
+	}
+	if err != nil {
+		// compensate the rename of the user document
+		_, _, uerr := modifyUser(m, bson.M{"_id": user.UID}, func(u *User) error {
+			u.Username = oldName
+			return nil
+		})
+		if uerr != nil {
+			logger.Errorf("Failed to roll back rename of %s: %s", oldName, uerr.Error())
+		}
+		return err
+	}
+	writeAudit(m, actor, "user.rename", auditTargetUser, newName, before, user)
+	return nil
+}
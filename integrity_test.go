@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// brokenGroupStore fails updates of one group
+type brokenGroupStore struct {
+	Store
+	gid int
+}
+
+func (s brokenGroupStore) UpdateGroup(group PosixGroup) error {
+	if group.GID == s.gid {
+		return errors.New("broken")
+	}
+	return s.Store.UpdateGroup(group)
+}
+
+func TestIntegrity(t *testing.T) {
+	Convey("Test referential integrity", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+		actor := auditActor{Name: "admin", Kind: actorCLI}
+
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "users", IsActive: true}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 3001, Name: "dev", Tag: "a", Members: []string{"zhangsan"}}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 3002, Name: "ops", Tag: "b", Members: []string{"zhangsan", "lisi"}}), ShouldBeNil)
+		So(m.InsertUser(User{UID: 2001, GID: 2000, Username: "zhangsan", Email: "zhangsan@example.com", IsActive: true}), ShouldBeNil)
+		So(m.InsertUser(User{UID: 2002, GID: 2000, Username: "lisi", Email: "lisi@example.com", IsActive: true}), ShouldBeNil)
+
+		members := func(gid int) []string {
+			groups, _ := m.ListGroups(bson.M{"gid": gid})
+			return groups[0].Members
+		}
+
+		Convey("Renames should cascade into groups", func() {
+			So(renameUser(m, "zhangsan", "zs", actor), ShouldBeNil)
+			So(members(3001), ShouldResemble, []string{"zs"})
+			So(members(3002), ShouldResemble, []string{"lisi", "zs"})
+			So(checkMember(m, "zhangsan"), ShouldNotBeNil)
+			So(renameUser(m, "zs", "lisi", actor), ShouldNotBeNil)
+		})
+
+		Convey("Failed renames should be rolled back", func() {
+			So(renameUser(brokenGroupStore{m, 3002}, "zhangsan", "zs", actor), ShouldNotBeNil)
+			So(checkMember(m, "zhangsan"), ShouldBeNil)
+			So(members(3001), ShouldResemble, []string{"zhangsan"})
+			So(members(3002), ShouldResemble, []string{"zhangsan", "lisi"})
+		})
+
+		Convey("Failed deletions should be rolled back", func() {
+			So(softDeleteUser(brokenGroupStore{m, 3002}, "zhangsan", actor, ""), ShouldNotBeNil)
+			So(checkMember(m, "zhangsan"), ShouldBeNil)
+			So(members(3001), ShouldResemble, []string{"zhangsan"})
+		})
+
+		Convey("Primary groups should exist and stay", func() {
+			So(checkPrimaryGroup(m, 2000, nil), ShouldBeNil)
+			So(checkPrimaryGroup(m, 4000, nil), ShouldNotBeNil)
+			So(softDeleteGroup(m, "users", "", actor, ""), ShouldNotBeNil)
+			So(softDeleteGroup(m, "dev", "a", actor, ""), ShouldBeNil)
+		})
+
+		Convey("Primary groups should be visible under the tags of the user", func() {
+			So(checkPrimaryGroup(m, 3001, []string{"a"}), ShouldBeNil)
+			So(checkPrimaryGroup(m, 3001, []string{"b"}), ShouldNotBeNil)
+			So(checkPrimaryGroup(m, 3001, nil), ShouldNotBeNil)
+
+			So(m.UpdateUser(func() User {
+				users, _ := m.ListUsers(bson.M{"username": "lisi"})
+				u := users[0]
+				u.GID = 3001
+				u.Tags = []string{"a"}
+				return u
+			}()), ShouldBeNil)
+			So(softDeleteUser(m, "lisi", actor, ""), ShouldBeNil)
+			So(m.UpdateUser(func() User {
+				users, _ := m.ListUsers(bson.M{"username": "lisi"})
+				u := users[0]
+				u.Tags = nil
+				return u
+			}()), ShouldBeNil)
+			So(restoreUser(m, "lisi", actor), ShouldNotBeNil)
+		})
+
+		Convey("Inactive users should not become members", func() {
+			So(m.UpdateUser(func() User {
+				users, _ := m.ListUsers(bson.M{"username": "lisi"})
+				u := users[0]
+				u.IsActive = false
+				return u
+			}()), ShouldBeNil)
+			So(checkMember(m, "lisi"), ShouldNotBeNil)
+			So(checkMember(m, "zhangsan"), ShouldBeNil)
+		})
+
+		Convey("Restored groups should drop deleted members", func() {
+			So(softDeleteGroup(m, "ops", "b", actor, ""), ShouldBeNil)
+			So(softDeleteUser(m, "lisi", actor, ""), ShouldBeNil)
+			So(m.UpdateGroup(func() PosixGroup {
+				groups, _ := m.ListGroups(bson.M{"gid": 3002})
+				g := groups[0]
+				g.Members = []string{"zhangsan", "lisi"}
+				return g
+			}()), ShouldBeNil)
+			So(restoreGroup(m, "ops", "b", actor), ShouldBeNil)
+			So(members(3002), ShouldResemble, []string{"zhangsan"})
+		})
+	})
+}
@@ -9,7 +9,7 @@ import (
 )
 
 // import models from json file
-func importJSON(filename string, m *mongoCtx) error {
+func importJSON(filename string, m Store) error {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return fmt.Errorf("failed to read file %s: %s", filename, err.Error())
@@ -21,17 +21,65 @@ func importJSON(filename string, m *mongoCtx) error {
 	}
 
 	if m == nil {
-		m = getMongo()
+		m = getStore()
 		defer m.Close()
 	}
 
+	actor := cliActor()
+	uids, err := newUIDAllocator(dcfg.TUNA)
+	if err != nil {
+		return err
+	}
+	dumpGIDs := map[int]bool{}
+	for _, group := range dump.PosixGroups {
+		dumpGIDs[group.GID] = true
+	}
+	imported := map[string]bool{}
 	for _, user := range dump.Users {
-		m.ensureCounterMin("uid", user.UID)
-		m.UserColl().Insert(user)
+		if err := uids.observe(m, user.UID); err != nil {
+			return err
+		}
+		keys, err := checkSSHKeys(user.SSHKeys, nil)
+		if err != nil {
+			logger.Warningf("Failed to import user %s: %s", user.Username, err.Error())
+			continue
+		}
+		user.SSHKeys = keys
+		if !dumpGIDs[user.GID] {
+			if err := checkPrimaryGroup(m, user.GID, user.Tags); err != nil {
+				logger.Warningf("Failed to import user %s: %s", user.Username, err.Error())
+				continue
+			}
+		}
+		if err := m.InsertUser(user); err != nil {
+			logger.Warningf("Failed to import user %s: %s", user.Username, err.Error())
+			continue
+		}
+		writeAudit(m, actor, "user.import", auditTargetUser, user.Username, nil, user)
+		imported[user.Username] = true
 	}
 	for _, group := range dump.PosixGroups {
-		m.ensureCounterMin("gid", group.GID)
-		m.PosixGroupColl().Insert(group)
+		gids, err := newGIDAllocator(dcfg.TUNA, group.Tag)
+		if err != nil {
+			return err
+		}
+		if err := gids.observe(m, group.GID); err != nil {
+			return err
+		}
+		members := []string{}
+		for _, member := range group.Members {
+			if imported[member] || checkMember(m, member) == nil {
+				members = append(members, member)
+			} else {
+				logger.Warningf("Dropped unknown member %s of group %s", member, group.Name)
+			}
+		}
+		group.Members = members
+		if err := m.InsertGroup(group); err != nil {
+			logger.Warningf("Failed to import group %s: %s", group.Name, err.Error())
+			continue
+		}
+		writeAudit(m, actor, "group.import", auditTargetGroup, groupAuditName(group), nil, group)
 	}
 
 	return nil
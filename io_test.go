@@ -3,7 +3,6 @@ package main
 import (
 	"io/ioutil"
 	"os"
-	"reflect"
 	"testing"
 
 	"gopkg.in/mgo.v2/bson"
@@ -12,12 +11,9 @@ import (
 )
 
 func TestImport(t *testing.T) {
+	requireMongo(t)
 	Convey("Test Import to MongoDB", t, func() {
-		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
-		dcfg.DB.Name = "tunaccount_test"
-		initMongo()
-
-		m := getMongo()
+		m := getTestMongo()
 		defer m.Close()
 
 		var dumpContent = `
@@ -51,7 +47,7 @@ func TestImport(t *testing.T) {
 }`
 
 		Convey("import json", func() {
-			m := getMongo()
+			m := getTestMongo()
 			defer m.Close()
 			tmpfile, err := ioutil.TempFile("", "tunasync")
 			So(err, ShouldBeNil)
@@ -76,9 +72,7 @@ func TestImport(t *testing.T) {
 		})
 
 		Reset(func() {
-			m := getMongo()
-			defer m.Close()
-			m.session.DB(m.dbname).DropDatabase()
+			dropTestMongo()
 		})
 	})
 
@@ -1,45 +1,77 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
-	"regexp"
 	"strconv"
-	"strings"
-
-	"gopkg.in/mgo.v2/bson"
 
 	ldapMsg "github.com/lor00x/goldap/message"
 	ldap "github.com/vjeantet/ldapserver"
 )
 
-var (
-	tagRegex, userRegex, groupRegex *regexp.Regexp
-)
+// makeLDAPServers starts the plain listener, and the LDAPS listener
+// if configured
+func makeLDAPServers(cfg LDAPConfig) ([]*ldap.Server, error) {
+	tlsConfig, err := makeLDAPTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ldapTLSConfig = tlsConfig
 
-func makeLDAPServer(listenAddr string) *ldap.Server {
-	//Create a new LDAP Server
-	server := ldap.NewServer()
-	ldap.Logger = ldap.DiscardingLogger
+	listenAddr := fmt.Sprintf("%s:%d", cfg.ListenAddr, cfg.ListenPort)
+	logger.Noticef("Listen LDAP Addr: %s", listenAddr)
+	servers := []*ldap.Server{makeLDAPServer(listenAddr, nil)}
+	if cfg.TLSListenPort > 0 {
+		listenAddr = fmt.Sprintf("%s:%d", cfg.ListenAddr, cfg.TLSListenPort)
+		logger.Noticef("Listen LDAPS Addr: %s", listenAddr)
+		servers = append(servers, makeLDAPServer(listenAddr, tlsConfig))
+	}
+	return servers, nil
+}
+
+// makeLDAPServer serves LDAP on listenAddr, over TLS if tlsConfig is set
+func makeLDAPServer(listenAddr string, tlsConfig *tls.Config) *ldap.Server {
+	return serveLDAP(listenAddr, tlsConfig, ldapRoutes())
+}
 
-	//Create routes bindings
+// ldapRoutes routes requests to their handlers
+func ldapRoutes() *ldap.RouteMux {
 	routes := ldap.NewRouteMux()
 	routes.Abandon(handleAbandon)
 	routes.Bind(handleBind)
-
-	// Regexes
-	tagRegex = regexp.MustCompile(`tag=([\w-]+)`)
-	userRegex = regexp.MustCompile(`(uid)=([\w-]+)`)
-	groupRegex = regexp.MustCompile(`(cn)=([\w-]+)`)
+	routes.Extended(handleStartTLS).RequestName(ldap.NoticeOfStartTLS)
+	routes.Extended(handlePasswordModify).RequestName(ldap.NoticeOfPasswordModify)
+	routes.Extended(handleWhoAmI).RequestName(ldap.NoticeOfWhoAmI)
 
 	routes.Search(handleSearch)
+	routes.Compare(handleCompare)
+	routes.Add(handleAdd)
+	routes.Modify(handleModify)
+	routes.Delete(handleDelete)
+	// ldapserver has no route for ModifyDN
+	routes.NotFound(handleNotFound)
+	return routes
+}
+
+// serveLDAP serves requests on listenAddr with handler
+func serveLDAP(listenAddr string, tlsConfig *tls.Config, handler ldap.Handler) *ldap.Server {
+	//Create a new LDAP Server
+	server := ldap.NewServer()
+	ldap.Logger = ldap.DiscardingLogger
 
 	//Attach routes to server
-	server.Handle(routes)
+	server.Handle(handler)
 
 	// listen on 10389 and serve
 	go func() {
-		if err := server.ListenAndServe(listenAddr); err != nil {
+		listener := func(s *ldap.Server) {
+			if tlsConfig != nil {
+				s.Listener = tls.NewListener(s.Listener, tlsConfig)
+			}
+			s.Listener = ldapListener{s.Listener}
+		}
+		if err := server.ListenAndServe(listenAddr, listener); err != nil {
 			log.Printf("LDAP Listen Error: %s", err.Error())
 		}
 	}()
@@ -61,28 +93,49 @@ func handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetBindRequest()
 	logger.Debugf("Request bind: %s", string(r.Name()))
 
+	// the connection is anonymous unless the bind succeeds
+	conn := connOf(m)
+	conn.setIdentity(nil)
+
 	res := ldap.NewBindResponse(ldap.LDAPResultSuccess)
 	if r.AuthenticationChoice() == "simple" {
-		dn := string(r.Name()) // uid=xxxx,ou=xxx
-		if dn == "" {
-			// Allow anonymous bind
+		dn, err := parseDN(string(r.Name())) // uid=xxxx,ou=xxx
+		if err != nil {
+			res.SetResultCode(ldap.LDAPResultInvalidDNSyntax)
+			res.SetDiagnosticMessage(err.Error())
+			w.Write(res)
+			return
+		}
+		if len(dn) == 0 {
+			if dcfg.LDAP.DisableAnonymous {
+				res.SetResultCode(ldap.LDAPResultInappropriateAuthentication)
+				res.SetDiagnosticMessage("Anonymous bind is disabled")
+			}
+			w.Write(res)
+			return
+		}
+		if dcfg.LDAP.RequireTLS && !conn.isTLS() {
+			res.SetResultCode(ldap.LDAPResultConfidentialityRequired)
+			res.SetDiagnosticMessage("Simple bind requires TLS")
 			w.Write(res)
 			return
 		}
-		cnPair := strings.Split(dn, ",")[0]
-		cn := strings.Split(cnPair, "=")[1]
 
-		mg := getMongo()
+		mg := getStore()
 		defer mg.Close()
 
-		logger.Debugf("Filter user: %s", cn)
-		users := mg.FindUsers(bson.M{"username": cn}, "")
-		if len(users) > 0 {
-			user := users[0]
+		var user User
+		found := false
+		if base, err := resolveLDAPBase(dn); err == nil && base.OU == "people" && base.Attr != "" {
+			logger.Debugf("Filter user: %s", base.Val)
+			user, found = findLDAPUser(mg, base.Val)
+		}
+		if found {
 			logger.Debugf("User: %#v", user)
 			pass := string(r.AuthenticationSimple())
 			if user.Authenticate(pass) {
 				logger.Debugf("Successfully authenticated user: %s", user.Username)
+				conn.setIdentity(newLDAPIdentity(user))
 				w.Write(res)
 				return
 			}
@@ -99,6 +152,34 @@ func handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 	w.Write(res)
 }
 
+// handleWhoAmI reports the authorization identity of the connection
+// as in RFC 4532, which is empty if anonymous
+func handleWhoAmI(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	// without a value the response would claim an anonymous identity
+	if !canWriteMessages(w) {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("The authorization identity cannot be returned")
+		w.Write(res)
+		return
+	}
+	authzID := ""
+	if id := connOf(m).identity(); id != nil {
+		authzID = "dn:" + id.DN.String()
+	}
+	msg, err := extendedResponseWithValue(m.MessageID().Int(), res, []byte(authzID))
+	if err != nil {
+		logger.Errorf("Failed to encode authorization identity: %s", err.Error())
+		res.SetResultCode(ldap.LDAPResultOther)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+	if err := writeMessage(w, msg); err != nil {
+		logger.Errorf("Failed to write authorization identity: %s", err.Error())
+	}
+}
+
 // handle search function
 func handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
@@ -106,100 +187,138 @@ func handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 	logger.Debugf("Request Filter: %s", r.FilterString())
 	logger.Debugf("Request Attributes: %s", r.Attributes())
 
-	// filter out invalid suffixes
-	if !strings.HasSuffix(string(r.BaseObject()), dcfg.LDAP.Suffix) {
+	dn, err := parseDN(string(r.BaseObject()))
+	if err != nil {
+		w.Write(searchDone(ldap.LDAPResultInvalidDNSyntax, err.Error()))
 		return
 	}
-
-	// Handle Stop Signal (server stop / client disconnected / Abandoned request....)
-	select {
-	case <-m.Done:
-		log.Print("Leaving handleSearch...")
+	search := newLDAPSearch(w, m, r)
+	paged, err := newPagedSearch(w, m, r, search)
+	switch {
+	case err == errInvalidCookie:
+		w.Write(searchDone(ldap.LDAPResultUnwillingToPerform, err.Error()))
+		return
+	case err == errPagingUnavailable:
+		w.Write(searchDone(ldap.LDAPResultUnavailableCriticalExtension, err.Error()))
+		return
+	case err != nil:
+		w.Write(searchDone(ldap.LDAPResultProtocolError, err.Error()))
+		return
+	case paged != nil && paged.abandoned():
+		writePagedDone(w, m, ldap.LDAPResultSuccess, paged.response(search))
 		return
-	default:
-	}
-
-	mg := getMongo()
-	defer mg.Close()
-
-	// determine people/group and tag
-	segs := strings.Split(string(r.BaseObject()), ",")
-	baseFilter := bson.M{}
-	var tag, ou, baseKey, baseVal string
-	var keymap map[string]string
-	for _, seg := range segs {
-		switch seg {
-		case "ou=people", "ou=People", "ou=users", "ou=Users":
-			ou = "people"
-			keymap = userldap2bson
-		case "ou=groups", "ou=Group", "ou=group", "ou=Groups":
-			ou = "groups"
-			keymap = groupldap2bson
+	}
+
+	if !search.runSpecial(dn) {
+		if dcfg.LDAP.DisableAnonymous && connOf(m).identity() == nil {
+			w.Write(searchDone(ldap.LDAPResultInsufficientAccessRights, "Anonymous search is disabled"))
+			return
+		}
+		base, err := resolveLDAPBase(dn)
+		if err == nil {
+			mg := getStore()
+			err = search.run(mg, base)
+			mg.Close()
 		}
-		if tagRegex.MatchString(seg) {
-			tag = tagRegex.FindStringSubmatch(seg)[1]
-		} else if userRegex.MatchString(seg) {
-			fields := userRegex.FindStringSubmatch(seg)
-			baseKey, baseVal = fields[1], fields[2]
-		} else if groupRegex.MatchString(seg) {
-			fields := groupRegex.FindStringSubmatch(seg)
-			baseKey, baseVal = fields[1], fields[2]
+		if err != nil {
+			w.Write(searchDone(ldap.LDAPResultNoSuchObject, err.Error()))
+			return
 		}
 	}
-
-	if ou == "" {
-		logger.Warningf("Invalid search DN")
+	if search.Abandoned {
+		log.Print("Leaving handleSearch...")
+		return
+	}
+	if paged != nil {
+		writePagedDone(w, m, search.Code, paged.response(search))
 		return
 	}
+	w.Write(ldap.NewSearchResultDoneResponse(search.Code))
+}
+
+// writePagedDone ends a paged search with the control of the page
+func writePagedDone(w ldap.ResponseWriter, m *ldap.Message, code int, control ldapControl) {
+	done := ldap.NewSearchResultDoneResponse(code)
+	if err := writeWithControls(w, m.MessageID().Int(), done, []ldapControl{control}); err != nil {
+		logger.Errorf("Failed to write paged results: %s", err.Error())
+		w.Write(searchDone(ldap.LDAPResultOther, err.Error()))
+	}
+}
 
-	if baseKey != "" {
-		baseFilter[keymap[baseKey]] = baseVal
-	}
-
-	filter := ldapQueryToBson(r.Filter(), keymap)
-	if len(filter) == 0 {
-		filter = baseFilter
-	} else if len(baseFilter) > 0 {
-		filter = bson.M{"$and": []bson.M{
-			filter, baseFilter,
-		}}
-	}
-
-	logger.Debugf("Mongo Filter: %#v", filter)
-
-	if ou == "people" {
-		users := mg.FindUsers(filter, tag)
-		for _, u := range users {
-			e := ldap.NewSearchResultEntry(fmt.Sprintf("uid=%s,ou=people,%s", u.Username, dcfg.LDAP.Suffix))
-			e.AddAttribute("uid", ldapMsg.AttributeValue(u.Username))
-			e.AddAttribute("cn", ldapMsg.AttributeValue(u.Username))
-			e.AddAttribute("mail", ldapMsg.AttributeValue(u.Email))
-			e.AddAttribute("gecos", ldapMsg.AttributeValue(u.Name))
-			e.AddAttribute("uidNumber", ldapMsg.AttributeValue(strconv.Itoa(u.UID)))
-			e.AddAttribute("gidNumber", ldapMsg.AttributeValue(strconv.Itoa(u.GID)))
-			e.AddAttribute("loginShell", ldapMsg.AttributeValue(u.LoginShell))
-			e.AddAttribute("homeDirectory", ldapMsg.AttributeValue(fmt.Sprintf("/home/%s", u.Username)))
-			e.AddAttribute("userPassword", ldapMsg.AttributeValue(u.Password))
-			e.AddAttribute("objectClass", "top", "posixAccount", "shadowAccount")
-			e.AddAttribute("shadowMax", "99999")
-			w.Write(e)
+// searchDone is a SearchResultDone with a diagnostic message
+func searchDone(code int, msg string) ldapMsg.SearchResultDone {
+	res := ldap.NewResponse(code)
+	res.SetDiagnosticMessage(msg)
+	return ldapMsg.SearchResultDone(res)
+}
+
+// findLDAPUser finds a user by the value of a uid in a DN, which is
+// case-insensitive. An exact match wins if usernames differ only in case.
+func findLDAPUser(m Store, username string) (User, bool) {
+	q, _ := ldapMatchToBson("username", "caseIgnoreMatch", username)
+	users := m.FindUsers(q, "")
+	for _, u := range users {
+		if u.Username == username {
+			return u, true
 		}
-	} else if ou == "groups" {
-		groups := mg.FindGroups(filter, tag)
-		for _, g := range groups {
-			e := ldap.NewSearchResultEntry(fmt.Sprintf("cn=%s,ou=groups,%s", g.Name, dcfg.LDAP.Suffix))
-			e.AddAttribute("cn", ldapMsg.AttributeValue(g.Name))
-			e.AddAttribute("gidNumber", ldapMsg.AttributeValue(strconv.Itoa(g.GID)))
-			members := []ldapMsg.AttributeValue{}
-			for _, username := range g.Members {
-				members = append(members, ldapMsg.AttributeValue(username))
+	}
+	if len(users) == 1 {
+		return users[0], true
+	}
+	return User{}, false
+}
+
+// An ldapAttribute is an attribute of a search result entry
+type ldapAttribute struct {
+	Name   string
+	Values []string
+}
+
+// userAttributes are the attributes published for a user
+func userAttributes(u User) []ldapAttribute {
+	attrs := []ldapAttribute{
+		{"uid", []string{u.Username}},
+		{"cn", []string{u.Username}},
+		{"mail", []string{u.Email}},
+		{"gecos", []string{u.Name}},
+		{"uidNumber", []string{strconv.Itoa(u.UID)}},
+		{"gidNumber", []string{strconv.Itoa(u.GID)}},
+		{"loginShell", []string{u.LoginShell}},
+		{"homeDirectory", []string{fmt.Sprintf("/home/%s", u.Username)}},
+		{"userPassword", []string{u.Password}},
+		{"objectClass", userObjectClasses},
+		{"sshPublicKey", u.SSHKeys},
+	}
+	return append(attrs, shadowAttributes(u, dcfg.TUNA)...)
+}
+
+// groupAttributes are the attributes published for a group
+func groupAttributes(g PosixGroup) []ldapAttribute {
+	return []ldapAttribute{
+		{"cn", []string{g.Name}},
+		{"gidNumber", []string{strconv.Itoa(g.GID)}},
+		{"memberUid", g.Members},
+		{"objectClass", groupObjectClasses},
+	}
+}
+
+// addAttributes adds attributes to an entry, omitting empty values
+// since LDAP attributes cannot have them. With typesOnly, only the
+// names of the attributes are added.
+func addAttributes(e *ldapMsg.SearchResultEntry, attrs []ldapAttribute, typesOnly bool) {
+	for _, attr := range attrs {
+		values := []ldapMsg.AttributeValue{}
+		for _, v := range attr.Values {
+			if v != "" {
+				values = append(values, ldapMsg.AttributeValue(v))
 			}
-			e.AddAttribute("memberUid", members...)
-			e.AddAttribute("objectClass", "top", "posixGroup")
-			w.Write(e)
 		}
+		if len(values) == 0 {
+			continue
+		}
+		if typesOnly {
+			values = nil
+		}
+		e.AddAttribute(ldapMsg.AttributeDescription(attr.Name), values...)
 	}
-
-	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
-	w.Write(res)
 }
@@ -0,0 +1,179 @@
+// access control of LDAP searches
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// identities of ACLs besides bind DNs
+const (
+	aclAnonymous = "anonymous"
+	aclUsers     = "users"
+	aclAdmins    = "admins"
+)
+
+// without ACLs, anonymous binds only read what NSS and PAM need, while bound
+// users read all but sensitive attributes. Configured ACLs replace them,
+// e.g. a rule granting "anonymous" the attrs ["*"] also publishes mail.
+var defaultLDAPACL = []LDAPACL{
+	{Who: []string{aclAnonymous}, Attrs: ldapPosixAttrs},
+	{Who: []string{aclUsers}, Attrs: []string{"*"}},
+}
+
+// ldapPosixAttrs are the attributes of posixAccount, shadowAccount and
+// posixGroup, along with the naming attributes of the DIT. sshPublicKey
+// is left out, so sshd has to bind or be granted it by an ACL.
+var ldapPosixAttrs = []string{
+	"uid", "cn", "uidNumber", "gidNumber", "gecos", "homeDirectory", "loginShell",
+	"shadowLastChange", "shadowMin", "shadowMax", "shadowWarning", "shadowInactive", "shadowExpire",
+	"memberUid", "ou", "tag", "description",
+}
+
+// An ldapIdentity is a user a connection is bound as
+type ldapIdentity struct {
+	DN       ldapDN
+	UID      int
+	Username string
+	IsAdmin  bool
+}
+
+func newLDAPIdentity(u User) *ldapIdentity {
+	dn, _ := parseDN(userEntry(u).DN)
+	return &ldapIdentity{DN: dn, UID: u.UID, Username: u.Username, IsAdmin: u.IsAdmin}
+}
+
+func (dn ldapDN) equal(other ldapDN) bool {
+	return len(dn) == len(other) && dn.hasSuffix(other)
+}
+
+func validateLDAPACL(acl []LDAPACL) error {
+	for _, rule := range acl {
+		if _, err := parseDN(rule.Base); err != nil {
+			return fmt.Errorf("Invalid ACL base %s: %s", rule.Base, err.Error())
+		}
+		for _, who := range rule.Who {
+			switch who {
+			case aclAnonymous, aclUsers, aclAdmins:
+				continue
+			}
+			if dn, err := parseDN(who); err != nil || len(dn) == 0 {
+				return fmt.Errorf("Invalid ACL identity: %s", who)
+			}
+		}
+	}
+	return nil
+}
+
+// appliesTo tells whether a rule grants access to id, nil is anonymous
+func (rule LDAPACL) appliesTo(id *ldapIdentity) bool {
+	for _, who := range rule.Who {
+		switch who {
+		case aclAnonymous:
+			if id == nil {
+				return true
+			}
+		case aclUsers:
+			if id != nil {
+				return true
+			}
+		case aclAdmins:
+			if id != nil && id.IsAdmin {
+				return true
+			}
+		default:
+			if dn, err := parseDN(who); err == nil && id != nil && dn.equal(id.DN) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// An ldapAccess is what a bind identity may read
+type ldapAccess struct {
+	rules []ldapAccessRule
+}
+
+type ldapAccessRule struct {
+	base  ldapDN
+	attrs []string
+}
+
+func newLDAPAccess(id *ldapIdentity) *ldapAccess {
+	acl := dcfg.LDAP.ACL
+	if len(acl) == 0 {
+		acl = defaultLDAPACL
+	}
+	a := &ldapAccess{}
+	for _, rule := range acl {
+		if !rule.appliesTo(id) {
+			continue
+		}
+		base := ldapSuffix()
+		if rule.Base != "" {
+			base, _ = parseDN(rule.Base)
+		}
+		a.rules = append(a.rules, ldapAccessRule{base, rule.Attrs})
+	}
+	return a
+}
+
+// readable returns the attributes readable in the subtree of dn,
+// ok is false if the entry of dn is not visible
+func (a *ldapAccess) readable(dn ldapDN) (attrs []string, ok bool) {
+	for _, rule := range a.rules {
+		if dn.hasSuffix(rule.base) {
+			attrs = append(attrs, rule.attrs...)
+			ok = true
+		}
+	}
+	return attrs, ok
+}
+
+// canReadAttr tells whether attr is in the readable attributes,
+// the object classes of visible entries are always readable
+func canReadAttr(attr string, readable []string) bool {
+	if strings.EqualFold(attr, "objectClass") || stringInSliceFold(attr, readable) {
+		return true
+	}
+	return stringInSlice("*", readable) && !stringInSliceFold(attr, ldapSensitiveAttrs)
+}
+
+// restrict removes the attributes of e which are not readable,
+// ok is false if e is not visible
+func (a *ldapAccess) restrict(e ldapEntry) (res ldapEntry, ok bool) {
+	dn, err := parseDN(e.DN)
+	if err != nil {
+		return res, false
+	}
+	readable, ok := a.readable(dn)
+	if !ok {
+		return res, false
+	}
+	res = ldapEntry{DN: e.DN, Operational: e.Operational}
+	for _, attr := range e.Attrs {
+		if canReadAttr(attr.Name, readable) {
+			res.Attrs = append(res.Attrs, attr)
+		}
+	}
+	return res, true
+}
+
+// restrictFilter makes assertions on unreadable attributes Undefined,
+// as for unknown attributes, so that filters cannot disclose them
+func restrictFilter(f ldapFilter, readable []string) ldapFilter {
+	switch f.Op {
+	case filterAnd, filterOr, filterNot:
+		children := make([]ldapFilter, len(f.Children))
+		for i, child := range f.Children {
+			children[i] = restrictFilter(child, readable)
+		}
+		f.Children = children
+		return f
+	}
+	if f.Attr != "" && !canReadAttr(f.Attr, readable) {
+		f.Attr = ""
+	}
+	return f
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPACL(t *testing.T) {
+	Convey("ACLs are validated", t, func() {
+		So(validateLDAPACL(nil), ShouldBeNil)
+		So(validateLDAPACL([]LDAPACL{{Who: []string{"anonymous", "uid=nslcd,ou=people,o=tuna"}, Base: "ou=groups,o=tuna"}}), ShouldBeNil)
+		So(validateLDAPACL([]LDAPACL{{Who: []string{"nobody"}}}), ShouldNotBeNil)
+		So(validateLDAPACL([]LDAPACL{{Who: []string{"users"}, Base: "ou=groups,"}}), ShouldNotBeNil)
+	})
+
+	Convey("Rules apply to bind identities", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		user := newLDAPIdentity(User{Username: "lisi"})
+		admin := newLDAPIdentity(User{Username: "root", IsAdmin: true})
+		nslcd := newLDAPIdentity(User{Username: "nslcd"})
+
+		rule := LDAPACL{Who: []string{"anonymous"}}
+		So(rule.appliesTo(nil), ShouldBeTrue)
+		So(rule.appliesTo(user), ShouldBeFalse)
+		rule = LDAPACL{Who: []string{"users"}}
+		So(rule.appliesTo(nil), ShouldBeFalse)
+		So(rule.appliesTo(admin), ShouldBeTrue)
+		rule = LDAPACL{Who: []string{"admins"}}
+		So(rule.appliesTo(user), ShouldBeFalse)
+		So(rule.appliesTo(admin), ShouldBeTrue)
+		rule = LDAPACL{Who: []string{"UID=NSLCD,ou=people,o=tuna"}}
+		So(rule.appliesTo(nslcd), ShouldBeTrue)
+		So(rule.appliesTo(user), ShouldBeFalse)
+		So(rule.appliesTo(nil), ShouldBeFalse)
+	})
+
+	Convey("Searches are restricted by ACLs", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		defer func() { dcfg.LDAP.ACL = nil }()
+		m := newMemoryStore()
+		for _, u := range ldapTestUsers {
+			So(m.InsertUser(u), ShouldBeNil)
+		}
+		for _, g := range ldapTestGroups {
+			So(m.InsertGroup(g), ShouldBeNil)
+		}
+
+		search := func(id *ldapIdentity, base, filter string, attrs ...string) []ldapEntry {
+			f, err := parseLDAPFilter(filter)
+			So(err, ShouldBeNil)
+			dn, err := parseDN(base)
+			So(err, ShouldBeNil)
+			b, err := resolveLDAPBase(dn)
+			So(err, ShouldBeNil)
+			entries := []ldapEntry{}
+			s := &ldapSearch{
+				Scope:      ldapMsg.SearchRequestHomeSubtree,
+				Filter:     f,
+				Attributes: attrs,
+				Access:     newLDAPAccess(id),
+				write:      func(e ldapEntry) { entries = append(entries, e) },
+				done:       func() bool { return false },
+			}
+			So(s.run(m, b), ShouldBeNil)
+			return entries
+		}
+		attrNames := func(e ldapEntry) []string {
+			names := []string{}
+			for _, attr := range e.Attrs {
+				names = append(names, attr.Name)
+			}
+			return names
+		}
+		nslcd := newLDAPIdentity(User{Username: "nslcd"})
+
+		Convey("Password hashes are hidden by default", func() {
+			entries := search(nil, "uid=lisi,ou=people,o=tuna", "(objectClass=*)", "uid", "userPassword")
+			So(len(entries), ShouldEqual, 1)
+			So(attrNames(entries[0]), ShouldResemble, []string{"uid"})
+		})
+
+		Convey("Anonymous binds only read posix and shadow attributes by default", func() {
+			entries := search(nil, "uid=lisi,ou=people,o=tuna", "(objectClass=*)", "uid", "mail", "sshPublicKey", "shadowExpire")
+			So(len(entries), ShouldEqual, 1)
+			So(attrNames(entries[0]), ShouldResemble, []string{"uid", "shadowExpire"})
+			So(len(search(nil, "ou=people,o=tuna", "(mail=*)")), ShouldEqual, 0)
+
+			entries = search(newLDAPIdentity(User{Username: "lisi"}), "uid=lisi,ou=people,o=tuna", "(mail=*)", "uid", "mail")
+			So(len(entries), ShouldEqual, 1)
+			So(attrNames(entries[0]), ShouldResemble, []string{"uid", "mail"})
+		})
+
+		Convey("Rules grant subtrees and attributes", func() {
+			dcfg.LDAP.ACL = []LDAPACL{
+				{Who: []string{"anonymous"}, Base: "ou=groups,o=tuna", Attrs: []string{"*"}},
+				{Who: []string{"users"}, Attrs: []string{"uid", "uidNumber"}},
+				{Who: []string{"uid=nslcd,ou=people,o=tuna"}, Base: "ou=people,o=tuna", Attrs: []string{"*", "userPassword"}},
+			}
+
+			entries := search(nil, "o=tuna", "(objectClass=*)")
+			So(len(entries), ShouldEqual, 1+len(ldapTestGroups))
+			So(entries[0].DN, ShouldEqual, "ou=groups,o=tuna")
+
+			entries = search(newLDAPIdentity(User{Username: "lisi"}), "ou=people,o=tuna", "(uid=lisi)")
+			So(len(entries), ShouldEqual, 1)
+			So(attrNames(entries[0]), ShouldResemble, []string{"uid", "uidNumber", "objectClass"})
+			// filters on unreadable attributes are Undefined
+			So(len(search(newLDAPIdentity(User{Username: "lisi"}), "ou=people,o=tuna", "(gidNumber=2000)")), ShouldEqual, 0)
+			So(len(search(newLDAPIdentity(User{Username: "lisi"}), "ou=people,o=tuna", "(!(gidNumber=2000))")), ShouldEqual, 0)
+
+			entries = search(nslcd, "uid=lisi,ou=people,o=tuna", "(objectClass=*)", "userPassword")
+			So(len(entries), ShouldEqual, 1)
+			So(attrNames(entries[0]), ShouldResemble, []string{"userPassword"})
+		})
+	})
+}
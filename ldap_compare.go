@@ -0,0 +1,81 @@
+// Compare operation, evaluated on the entries searches return
+package main
+
+import (
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// compareEntry returns the entry of dn with only attr, as a base
+// search with access would return it
+func compareEntry(m Store, dn ldapDN, attr string, access *ldapAccess) (ldapEntry, error) {
+	var entry *ldapEntry
+	s := &ldapSearch{
+		Scope:      ldapMsg.SearchRequestScopeBaseObject,
+		Filter:     ldapFilter{Op: filterPresent, Attr: "objectClass"},
+		Attributes: []string{attr},
+		Access:     access,
+		write:      func(e ldapEntry) { entry = &e },
+		done:       func() bool { return false },
+	}
+	if !s.runSpecial(dn) {
+		base, err := resolveLDAPBase(dn)
+		if err == nil {
+			err = s.run(m, base)
+		}
+		if err != nil {
+			return ldapEntry{}, err
+		}
+	}
+	// entries may also be hidden by ACLs
+	if entry == nil {
+		return ldapEntry{}, errNoSuchObject
+	}
+	return *entry, nil
+}
+
+// compareLDAP evaluates an attribute value assertion on the entry of dn,
+// and returns the result code of the Compare operation
+func compareLDAP(m Store, dn ldapDN, attr, value string, access *ldapAccess) (int, string) {
+	entry, err := compareEntry(m, dn, attr, access)
+	if err != nil {
+		return ldap.LDAPResultNoSuchObject, err.Error()
+	}
+	if findLDAPAttribute(entry.Attrs, attr) < 0 {
+		return ldap.LDAPResultNoSuchAttribute, "No attribute " + attr
+	}
+	f := ldapFilter{Op: filterEquality, Attr: attr, Value: value}
+	switch evalLDAPFilter(f, entry.Attrs, entryKeymap(entry.Attrs)) {
+	case evalTrue:
+		return ldap.LDAPResultCompareTrue, ""
+	case evalFalse:
+		return ldap.LDAPResultCompareFalse, ""
+	}
+	return ldap.LDAPResultInvalidAttributeSyntax, "Invalid value of " + attr
+}
+
+func handleCompare(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetCompareRequest()
+	attr := string(r.Ava().AttributeDesc())
+	logger.Debugf("Request compare: %s %s", string(r.Entry()), attr)
+
+	respond := func(code int, msg string) {
+		res := ldap.NewResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(ldapMsg.CompareResponse(res))
+	}
+	dn, err := parseDN(string(r.Entry()))
+	if err != nil {
+		respond(ldap.LDAPResultInvalidDNSyntax, err.Error())
+		return
+	}
+	conn := connOf(m)
+	if dcfg.LDAP.DisableAnonymous && conn.identity() == nil {
+		respond(ldap.LDAPResultInsufficientAccessRights, "Anonymous compare is disabled")
+		return
+	}
+
+	mg := getStore()
+	defer mg.Close()
+	respond(compareLDAP(mg, dn, attr, string(r.Ava().AssertionValue()), newLDAPAccess(conn.identity())))
+}
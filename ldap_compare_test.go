@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ldap "github.com/vjeantet/ldapserver"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPCompare(t *testing.T) {
+	Convey("Compare evaluates attributes of search results", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		dcfg.DB.Backend = DBEnumMemory
+		So(initStore(), ShouldBeNil)
+		m := getStore()
+		defer m.Close()
+		lisi := *(&User{UID: 2000, GID: 2000, Username: "lisi", Email: "lisi@tuna.tsinghua.edu.cn", IsActive: true}).Passwd("lisi")
+		So(m.InsertUser(lisi), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "tuna", IsActive: true, Members: []string{"lisi"}}), ShouldBeNil)
+
+		compare := func(dn, attr, value string, id *ldapIdentity) int {
+			parsed, err := parseDN(dn)
+			So(err, ShouldBeNil)
+			code, _ := compareLDAP(m, parsed, attr, value, newLDAPAccess(id))
+			return code
+		}
+		So(compare("uid=lisi,ou=people,o=tuna", "uid", "LiSi", nil), ShouldEqual, ldap.LDAPResultCompareTrue)
+		So(compare("uid=lisi,ou=people,o=tuna", "uidNumber", "2001", nil), ShouldEqual, ldap.LDAPResultCompareFalse)
+		So(compare("uid=lisi,ou=people,o=tuna", "uidNumber", "x", nil), ShouldEqual, ldap.LDAPResultInvalidAttributeSyntax)
+		So(compare("uid=lisi,ou=people,o=tuna", "description", "x", nil), ShouldEqual, ldap.LDAPResultNoSuchAttribute)
+		So(compare("cn=tuna,ou=groups,o=tuna", "memberUid", "lisi", nil), ShouldEqual, ldap.LDAPResultCompareTrue)
+		So(compare("uid=wangwu,ou=people,o=tuna", "uid", "wangwu", nil), ShouldEqual, ldap.LDAPResultNoSuchObject)
+		So(compare("", "supportedExtension", string(ldap.NoticeOfWhoAmI), nil), ShouldEqual, ldap.LDAPResultCompareTrue)
+
+		// password hashes are only visible if granted by ACLs
+		dcfg.LDAP.ACL = append(defaultLDAPACL, LDAPACL{Who: []string{"uid=lisi,ou=people,o=tuna"}, Attrs: []string{"userPassword"}})
+		So(compare("uid=lisi,ou=people,o=tuna", "userPassword", lisi.Password, nil), ShouldEqual, ldap.LDAPResultNoSuchAttribute)
+		So(compare("uid=lisi,ou=people,o=tuna", "userPassword", lisi.Password, newLDAPIdentity(lisi)), ShouldEqual, ldap.LDAPResultCompareTrue)
+	})
+
+	Convey("Who Am I reports the bound identity", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		dcfg.DB.Backend = DBEnumMemory
+		So(initStore(), ShouldBeNil)
+		m := getStore()
+		defer m.Close()
+		So(m.InsertUser(*(&User{UID: 2000, Username: "lisi", Email: "lisi@tuna.tsinghua.edu.cn", IsActive: true}).Passwd("lisi")), ShouldBeNil)
+
+		conn, stop := dialTestLDAPServer()
+		defer stop()
+		messageID := 0
+		whoami := func() string {
+			messageID++
+			tag, res := ldapRoundTrip(conn, messageID, 0x77, berTLV(0x80, []byte(ldap.NoticeOfWhoAmI)))
+			So(tag, ShouldEqual, 0x78)
+			So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultSuccess)
+			var field []byte
+			for len(res) > 0 {
+				tag, field, res, _ = berRead(res)
+				if tag == berResponseValue {
+					return string(field)
+				}
+			}
+			return ""
+		}
+		So(whoami(), ShouldEqual, "")
+
+		bind := append(berEncodeInteger(3), berTLV(berOctetString, []byte("uid=lisi,ou=people,o=tuna"))...)
+		bind = append(bind, berTLV(0x80, []byte("lisi"))...)
+		messageID++
+		_, res := ldapRoundTrip(conn, messageID, 0x60, bind)
+		So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultSuccess)
+		So(whoami(), ShouldEqual, "dn:uid=lisi,ou=people,o=tuna")
+
+		// an error rather than an anonymous identity
+		opConn, stopOp := dialLDAPServerWith(opOnlyHandler{ldapRoutes()})
+		defer stopOp()
+		messageID++
+		tag, res := ldapRoundTrip(opConn, messageID, 0x77, berTLV(0x80, []byte(ldap.NoticeOfWhoAmI)))
+		So(tag, ShouldEqual, 0x78)
+		So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+	})
+}
@@ -0,0 +1,110 @@
+// client connections and their sessions
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An ldapListener accepts connections as ldapConns
+type ldapListener struct {
+	net.Listener
+}
+
+func (l ldapListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ldapConn{conn: c}, nil
+}
+
+// An ldapConn is a client connection with the state of its session,
+// which lives as long as the connection. The underlying connection
+// is replaced by StartTLS.
+type ldapConn struct {
+	mu   sync.RWMutex
+	conn net.Conn
+	bind *ldapIdentity
+}
+
+func (c *ldapConn) raw() net.Conn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+func (c *ldapConn) Read(b []byte) (int, error)         { return c.raw().Read(b) }
+func (c *ldapConn) Write(b []byte) (int, error)        { return c.raw().Write(b) }
+func (c *ldapConn) Close() error                       { return c.raw().Close() }
+func (c *ldapConn) LocalAddr() net.Addr                { return c.raw().LocalAddr() }
+func (c *ldapConn) RemoteAddr() net.Addr               { return c.raw().RemoteAddr() }
+func (c *ldapConn) SetDeadline(t time.Time) error      { return c.raw().SetDeadline(t) }
+func (c *ldapConn) SetReadDeadline(t time.Time) error  { return c.raw().SetReadDeadline(t) }
+func (c *ldapConn) SetWriteDeadline(t time.Time) error { return c.raw().SetWriteDeadline(t) }
+
+func (c *ldapConn) isTLS() bool {
+	_, ok := c.raw().(*tls.Conn)
+	return ok
+}
+
+func (c *ldapConn) setRaw(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+}
+
+// identity is who the connection is bound as, nil if anonymous
+func (c *ldapConn) identity() *ldapIdentity {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bind
+}
+
+func (c *ldapConn) setIdentity(id *ldapIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bind = id
+}
+
+// currentIdentity re-reads the user the connection is bound as, so that
+// privileges revoked since the bind no longer apply. It is nil if the
+// connection is anonymous or the user was deactivated or deleted.
+func (c *ldapConn) currentIdentity(m Store) *ldapIdentity {
+	id := c.identity()
+	if id == nil {
+		return nil
+	}
+	users := m.FindUsers(bson.M{"_id": id.UID}, "")
+	if len(users) == 0 {
+		logger.Debugf("User %s bound to the connection is gone", id.Username)
+		return nil
+	}
+	return newLDAPIdentity(users[0])
+}
+
+// actor is who performs mutations on the connection
+func (c *ldapConn) actor() auditActor {
+	actor := auditActor{Kind: actorLDAP}
+	if host, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
+		actor.IP = host
+	}
+	if id := c.identity(); id != nil {
+		actor.Name = id.Username
+	}
+	return actor
+}
+
+// connOf returns the connection of a request
+func connOf(m *ldap.Message) *ldapConn {
+	if c, ok := m.Client.GetConn().(*ldapConn); ok {
+		return c
+	}
+	// not accepted by an ldapListener, the session is not kept
+	return &ldapConn{conn: m.Client.GetConn()}
+}
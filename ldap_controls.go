@@ -0,0 +1,207 @@
+// LDAP controls, which ldapserver only sends through its MessageWriter
+package main
+
+import (
+	"errors"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+var (
+	errBERSyntax       = errors.New("Invalid BER encoding")
+	errNoMessageWriter = errors.New("Responses cannot carry controls or values")
+)
+
+// BER tags used in control values
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berSequence    = 0x30
+	berControls    = 0xa0
+	// responseValue of extended responses
+	berResponseValue = 0x8b
+)
+
+func berTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	default:
+		size := []byte{}
+		for ; n > 0; n >>= 8 {
+			size = append([]byte{byte(n)}, size...)
+		}
+		b = append(b, 0x80|byte(len(size)))
+		b = append(b, size...)
+	}
+	return append(b, content...)
+}
+
+func berEncodeInteger(n int) []byte {
+	content := []byte{}
+	for {
+		content = append([]byte{byte(n)}, content...)
+		// the remaining bits are the sign of the last byte
+		if n >= -128 && n < 128 {
+			break
+		}
+		n >>= 8
+	}
+	return berTLV(berInteger, content)
+}
+
+// berRead reads a tag-length-value, and returns the remaining bytes
+func berRead(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBERSyntax
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, errBERSyntax
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n < 0 || len(b) < n {
+		return 0, nil, nil, errBERSyntax
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+func berDecodeInteger(content []byte) (int, error) {
+	if len(content) == 0 || len(content) > 4 {
+		return 0, errBERSyntax
+	}
+	n := int(int8(content[0]))
+	for _, c := range content[1:] {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
+
+// An ldapControl is a control of a request or a response
+type ldapControl struct {
+	OID      string
+	Critical bool
+	Value    []byte
+}
+
+func (c ldapControl) encode() []byte {
+	content := berTLV(berOctetString, []byte(c.OID))
+	if c.Critical {
+		content = append(content, berTLV(berBoolean, []byte{0xff})...)
+	}
+	if c.Value != nil {
+		content = append(content, berTLV(berOctetString, c.Value)...)
+	}
+	return berTLV(berSequence, content)
+}
+
+// requestControl finds the control of a request by OID
+func requestControl(m *ldap.Message, oid string) (ldapControl, bool) {
+	controls := m.Controls()
+	if controls == nil {
+		return ldapControl{}, false
+	}
+	for _, c := range *controls {
+		if string(c.ControlType()) != oid {
+			continue
+		}
+		res := ldapControl{OID: oid, Critical: bool(c.Criticality())}
+		if v := c.ControlValue(); v != nil {
+			res.Value = []byte(*v)
+		}
+		return res, true
+	}
+	return ldapControl{}, false
+}
+
+// messageWithControls builds a response message with controls,
+// goldap cannot set them, so the encoded message is extended and
+// read back
+func messageWithControls(messageID int, po ldapMsg.ProtocolOp, controls []ldapControl) (*ldapMsg.LDAPMessage, error) {
+	return rewriteMessage(messageID, po, func(content []byte) ([]byte, error) {
+		encoded := []byte{}
+		for _, c := range controls {
+			encoded = append(encoded, c.encode()...)
+		}
+		return append(content, berTLV(berControls, encoded)...), nil
+	})
+}
+
+// extendedResponseWithValue builds an extended response with a value,
+// which goldap cannot set either
+func extendedResponseWithValue(messageID int, res ldapMsg.ExtendedResponse, value []byte) (*ldapMsg.LDAPMessage, error) {
+	return rewriteMessage(messageID, res, func(content []byte) ([]byte, error) {
+		_, id, rest, err := berRead(content)
+		if err != nil {
+			return nil, err
+		}
+		tag, op, rest, err := berRead(rest)
+		if err != nil {
+			return nil, err
+		}
+		op = append(op, berTLV(berResponseValue, value)...)
+		res := append(berTLV(berInteger, id), berTLV(tag, op)...)
+		return append(res, rest...), nil
+	})
+}
+
+// rewriteMessage encodes a message, rewrites the content of its
+// sequence and reads it back
+func rewriteMessage(messageID int, po ldapMsg.ProtocolOp, rewrite func(content []byte) ([]byte, error)) (*ldapMsg.LDAPMessage, error) {
+	m := ldapMsg.NewLDAPMessageWithProtocolOp(po)
+	m.SetMessageID(messageID)
+	data, err := m.Write()
+	if err != nil {
+		return nil, err
+	}
+	_, content, _, err := berRead(data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if content, err = rewrite(content); err != nil {
+		return nil, err
+	}
+	res, err := ldapMsg.ReadLDAPMessage(ldapMsg.NewBytes(0, berTLV(berSequence, content)))
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// writeWithControls sends a response with controls
+func writeWithControls(w ldap.ResponseWriter, messageID int, po ldapMsg.ProtocolOp, controls []ldapControl) error {
+	msg, err := messageWithControls(messageID, po, controls)
+	if err != nil {
+		return err
+	}
+	return writeMessage(w, msg)
+}
+
+// canWriteMessages tells whether responses written to w
+// can carry controls and extended response values
+func canWriteMessages(w ldap.ResponseWriter) bool {
+	_, ok := w.(ldap.MessageWriter)
+	return ok
+}
+
+// writeMessage sends a whole message, which fails if w
+// only writes protocol ops
+func writeMessage(w ldap.ResponseWriter, msg *ldapMsg.LDAPMessage) error {
+	mw, ok := w.(ldap.MessageWriter)
+	if !ok {
+		return errNoMessageWriter
+	}
+	mw.WriteMessage(msg)
+	return nil
+}
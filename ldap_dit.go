@@ -0,0 +1,448 @@
+// searches over the virtual directory tree
+package main
+
+import (
+	"errors"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OUs below the suffix and each tag
+var ldapContainers = []string{"people", "groups"}
+
+// structural object classes of the suffix by the type of its RDN
+var suffixObjectClasses = map[string]string{
+	"o":  "organization",
+	"dc": "domain",
+	"ou": "organizationalUnit",
+}
+
+// attributes which are only returned when requested by name
+var ldapSensitiveAttrs = []string{"userPassword"}
+
+// An ldapEntry is an entry of a search result,
+// Operational attributes are only returned on request.
+// Public entries are readable regardless of ACLs.
+type ldapEntry struct {
+	DN          string
+	Attrs       []ldapAttribute
+	Operational []ldapAttribute
+	Public      bool
+}
+
+func operationalAttributes(dn string, leaf bool) []ldapAttribute {
+	hasSubordinates := "TRUE"
+	if leaf {
+		hasSubordinates = "FALSE"
+	}
+	return []ldapAttribute{
+		{"entryDN", []string{dn}},
+		{"hasSubordinates", []string{hasSubordinates}},
+		{"subschemaSubentry", []string{ldapSubschemaDN}},
+	}
+}
+
+// selectAttributes keeps the attributes requested as in RFC 4511,
+// no attributes or "*" select all user attributes, "+" selects the
+// operational ones, and "1.1" alone selects none
+func selectAttributes(e ldapEntry, selection []string) ldapEntry {
+	all, operational := len(selection) == 0, false
+	for _, sel := range selection {
+		switch sel {
+		case "*":
+			all = true
+		case "+":
+			operational = true
+		}
+	}
+	res := ldapEntry{DN: e.DN}
+	for _, attr := range e.Attrs {
+		if stringInSliceFold(attr.Name, selection) ||
+			all && !stringInSliceFold(attr.Name, ldapSensitiveAttrs) {
+			res.Attrs = append(res.Attrs, attr)
+		}
+	}
+	for _, attr := range e.Operational {
+		if operational || stringInSliceFold(attr.Name, selection) {
+			res.Attrs = append(res.Attrs, attr)
+		}
+	}
+	return res
+}
+
+// suffixEntry is the entry of the suffix, with the values of its RDN
+func suffixEntry() ldapEntry {
+	dn := dcfg.LDAP.Suffix
+	e := ldapEntry{DN: dn, Operational: operationalAttributes(dn, false)}
+	classes := []string{"top"}
+	if suffix := ldapSuffix(); len(suffix) > 0 {
+		for _, ava := range suffix[0] {
+			e.Attrs = append(e.Attrs, ldapAttribute{ava.Type, []string{ava.Value}})
+			class, ok := suffixObjectClasses[ava.Type]
+			if !ok {
+				class = "extensibleObject"
+			}
+			if !stringInSlice(class, classes) {
+				classes = append(classes, class)
+			}
+		}
+	}
+	e.Attrs = append(e.Attrs, ldapAttribute{"objectClass", classes})
+	return e
+}
+
+func tagEntry(t FilterTag) ldapEntry {
+	dn := "tag=" + escapeDNValue(t.Name) + "," + dcfg.LDAP.Suffix
+	return ldapEntry{
+		DN: dn,
+		Attrs: []ldapAttribute{
+			{"tag", []string{t.Name}},
+			{"description", []string{t.Desc}},
+			{"objectClass", []string{"top", "filterTag"}},
+		},
+		Operational: operationalAttributes(dn, false),
+	}
+}
+
+func containerDN(ou, tag string) string {
+	if tag == "" {
+		return "ou=" + ou + "," + dcfg.LDAP.Suffix
+	}
+	return "ou=" + ou + ",tag=" + escapeDNValue(tag) + "," + dcfg.LDAP.Suffix
+}
+
+func containerEntry(ou, tag string) ldapEntry {
+	dn := containerDN(ou, tag)
+	return ldapEntry{
+		DN: dn,
+		Attrs: []ldapAttribute{
+			{"ou", []string{ou}},
+			{"objectClass", []string{"top", "organizationalUnit"}},
+		},
+		Operational: operationalAttributes(dn, false),
+	}
+}
+
+func userEntry(u User) ldapEntry {
+	dn := "uid=" + escapeDNValue(u.Username) + ",ou=people," + dcfg.LDAP.Suffix
+	return ldapEntry{DN: dn, Attrs: userAttributes(u), Operational: operationalAttributes(dn, true)}
+}
+
+func groupEntry(g PosixGroup) ldapEntry {
+	dn := "cn=" + escapeDNValue(g.Name) + ",ou=groups," + dcfg.LDAP.Suffix
+	return ldapEntry{DN: dn, Attrs: groupAttributes(g), Operational: operationalAttributes(dn, true)}
+}
+
+// sources of search entries, in the order they are sent
+const (
+	sourceBase = iota
+	sourceContainers
+	sourceTags
+	sourcePeople
+	sourceGroups
+)
+
+// An ldapPosition orders the entries of a search, so that a paged
+// search resumes after the last entry sent. ID is the index of
+// containers, the UID of users or the GID of groups, which are
+// ordered by tag first as Store.EachGroup streams them.
+type ldapPosition struct {
+	Source int
+	ID     int
+	Tag    string
+}
+
+func (p ldapPosition) after(q ldapPosition) bool {
+	if p.Source != q.Source {
+		return p.Source > q.Source
+	}
+	if p.Tag != q.Tag {
+		return p.Tag > q.Tag
+	}
+	return p.ID > q.ID
+}
+
+// errStopSearch stops iterating the store once a search is stopped
+var errStopSearch = errors.New("Search stopped")
+
+// An ldapSearch sends the entries of a search within its limits,
+// Code is the result code once the search is stopped. A paged search
+// sends at most PageSize entries after Resume, More tells whether
+// entries remain after Last. Entries are not restricted by ACLs if
+// Access is nil.
+type ldapSearch struct {
+	Scope      int
+	Filter     ldapFilter
+	Attributes []string
+	SizeLimit  int
+	Deadline   time.Time
+	PageSize   int
+	Resume     *ldapPosition
+	Access     *ldapAccess
+
+	// write sends an entry, done tells whether the search is abandoned
+	write func(e ldapEntry)
+	done  func() bool
+
+	Sent      int
+	Code      int
+	Abandoned bool
+	Last      ldapPosition
+	More      bool
+}
+
+func newLDAPSearch(w ldap.ResponseWriter, m *ldap.Message, r ldapMsg.SearchRequest) *ldapSearch {
+	typesOnly := bool(r.TypesOnly())
+	s := &ldapSearch{
+		Scope:     int(r.Scope()),
+		Filter:    newLDAPFilter(r.Filter()),
+		SizeLimit: int(r.SizeLimit()),
+		Access:    newLDAPAccess(connOf(m).identity()),
+		write: func(e ldapEntry) {
+			res := ldap.NewSearchResultEntry(e.DN)
+			addAttributes(&res, e.Attrs, typesOnly)
+			w.Write(res)
+		},
+		done: func() bool {
+			select {
+			case <-m.Done:
+				return true
+			default:
+				return false
+			}
+		},
+	}
+	for _, attr := range r.Attributes() {
+		s.Attributes = append(s.Attributes, string(attr))
+	}
+	if r.TimeLimit() > 0 {
+		s.Deadline = time.Now().Add(time.Duration(r.TimeLimit()) * time.Second)
+	}
+	return s
+}
+
+func (s *ldapSearch) stopped() bool {
+	return s.Code != ldap.LDAPResultSuccess || s.Abandoned || s.More
+}
+
+// send writes an entry, and returns false if the search must stop
+func (s *ldapSearch) send(e ldapEntry, pos ldapPosition) bool {
+	if s.stopped() {
+		return false
+	}
+	if s.Resume != nil && !pos.after(*s.Resume) {
+		return true
+	}
+	if s.Access != nil && !e.Public {
+		var ok bool
+		if e, ok = s.Access.restrict(e); !ok {
+			return true
+		}
+	}
+	if s.done() {
+		logger.Debugf("Search abandoned")
+		s.Abandoned = true
+		return false
+	}
+	if !s.Deadline.IsZero() && time.Now().After(s.Deadline) {
+		s.Code = ldap.LDAPResultTimeLimitExceeded
+		return false
+	}
+	if s.SizeLimit > 0 && s.Sent >= s.SizeLimit {
+		s.Code = ldap.LDAPResultSizeLimitExceeded
+		return false
+	}
+	if s.PageSize > 0 && s.Sent >= s.PageSize {
+		s.More = true
+		return false
+	}
+	s.write(selectAttributes(e, s.Attributes))
+	s.Sent++
+	s.Last = pos
+	return true
+}
+
+// sendEntry sends an entry which is not in the store
+// if the filter evaluates to TRUE on it
+func (s *ldapSearch) sendEntry(e ldapEntry, pos ldapPosition) bool {
+	attrs := append(append([]ldapAttribute{}, e.Attrs...), e.Operational...)
+	keymap := entryKeymap(attrs)
+	filter := s.Filter
+	if s.Access != nil && !e.Public {
+		dn, _ := parseDN(e.DN)
+		readable, _ := s.Access.readable(dn)
+		filter = restrictFilter(filter, readable)
+	}
+	if evalLDAPFilter(filter, attrs, keymap) != evalTrue {
+		return true
+	}
+	return s.send(e, pos)
+}
+
+// entryKeymap recognizes the attributes of an entry in filters
+func entryKeymap(attrs []ldapAttribute) map[string]string {
+	keymap := map[string]string{}
+	for _, attr := range attrs {
+		keymap[attr.Name] = attr.Name
+	}
+	return keymap
+}
+
+func (s *ldapSearch) sendContainer(ou, tag string) bool {
+	pos := ldapPosition{Source: sourceContainers}
+	for i, name := range ldapContainers {
+		if name == ou {
+			pos.ID = i
+		}
+	}
+	return s.sendEntry(containerEntry(ou, tag), pos)
+}
+
+// resumeQuery skips the entries of source sent in previous pages,
+// ok is false if the whole source has been sent
+func (s *ldapSearch) resumeQuery(source int) (q bson.M, ok bool) {
+	switch {
+	case s.Resume == nil || s.Resume.Source < source:
+		return bson.M{}, true
+	case s.Resume.Source > source:
+		return nil, false
+	case source == sourcePeople:
+		return bson.M{"_id": bson.M{"$gt": s.Resume.ID}}, true
+	}
+	return bson.M{"$or": []bson.M{
+		{"tag": bson.M{"$gt": s.Resume.Tag}},
+		{"tag": s.Resume.Tag, "gid": bson.M{"$gt": s.Resume.ID}},
+	}}, true
+}
+
+// sendLeaves streams the users or groups below an OU matching
+// the filter and the query of the base entry
+func (s *ldapSearch) sendLeaves(m Store, ou, tag string, baseFilter bson.M) {
+	if s.stopped() {
+		return
+	}
+	// leaves are always below the OUs of the suffix
+	f := s.Filter
+	if s.Access != nil {
+		dn, _ := parseDN(containerDN(ou, ""))
+		readable, _ := s.Access.readable(dn)
+		f = restrictFilter(f, readable)
+	}
+	var err error
+	switch ou {
+	case "people":
+		resume, ok := s.resumeQuery(sourcePeople)
+		if !ok {
+			return
+		}
+		filter := bsonAnd([]bson.M{
+			ldapFilterToBson(f, userldap2bson, userObjectClasses),
+			baseFilter, resume, visibleUsers(tag),
+		})
+		logger.Debugf("Mongo Filter: %#v", filter)
+		err = m.EachUser(filter, func(u User) error {
+			if !s.send(userEntry(u), ldapPosition{Source: sourcePeople, ID: u.UID}) {
+				return errStopSearch
+			}
+			return nil
+		})
+	case "groups":
+		resume, ok := s.resumeQuery(sourceGroups)
+		if !ok {
+			return
+		}
+		filter := bsonAnd([]bson.M{
+			ldapFilterToBson(f, groupldap2bson, groupObjectClasses),
+			baseFilter, resume, visibleGroups(tag),
+		})
+		logger.Debugf("Mongo Filter: %#v", filter)
+		err = m.EachGroup(filter, func(g PosixGroup) error {
+			if !s.send(groupEntry(g), ldapPosition{Source: sourceGroups, ID: g.GID, Tag: g.Tag}) {
+				return errStopSearch
+			}
+			return nil
+		})
+	}
+	if err != nil && err != errStopSearch {
+		logger.Errorf("Failed to search %s: %s", ou, err.Error())
+		s.Code = ldap.LDAPResultOther
+	}
+}
+
+// run searches below base, it returns errNoSuchObject
+// if the base entry does not exist
+func (s *ldapSearch) run(m Store, base ldapBase) error {
+	tags, err := m.ListTags()
+	if err != nil {
+		logger.Errorf("Failed to list tags: %s", err.Error())
+	}
+	var tag *FilterTag
+	if base.Tag != "" {
+		if tag = findTag(base.Tag, tags); tag == nil || tag.Deleted != nil {
+			logger.Debugf("Tag %s does not exist", base.Tag)
+			return errNoSuchObject
+		}
+	}
+
+	switch {
+	case base.Attr != "":
+		keymap := userldap2bson
+		if base.OU == "groups" {
+			keymap = groupldap2bson
+		}
+		name, key, _ := ldapAttrKey(base.Attr, keymap)
+		baseFilter, _ := ldapMatchToBson(key, ldapAttrRule(name), base.Val)
+		exists := false
+		if base.OU == "people" {
+			exists = len(m.FindUsers(baseFilter, base.Tag)) > 0
+		} else {
+			exists = len(m.FindGroups(baseFilter, base.Tag)) > 0
+		}
+		if !exists {
+			return errNoSuchObject
+		}
+		// leaves have no children
+		if s.Scope != ldapMsg.SearchRequestSingleLevel {
+			s.sendLeaves(m, base.OU, base.Tag, baseFilter)
+		}
+	case base.OU != "":
+		if s.Scope != ldapMsg.SearchRequestSingleLevel {
+			s.sendContainer(base.OU, base.Tag)
+		}
+		if s.Scope != ldapMsg.SearchRequestScopeBaseObject {
+			s.sendLeaves(m, base.OU, base.Tag, bson.M{})
+		}
+	default:
+		if s.Scope != ldapMsg.SearchRequestSingleLevel {
+			if tag != nil {
+				s.sendEntry(tagEntry(*tag), ldapPosition{Source: sourceBase})
+			} else {
+				s.sendEntry(suffixEntry(), ldapPosition{Source: sourceBase})
+			}
+		}
+		if s.Scope == ldapMsg.SearchRequestScopeBaseObject {
+			return nil
+		}
+		for _, ou := range ldapContainers {
+			s.sendContainer(ou, base.Tag)
+		}
+		// tags are children of the suffix, their subtrees are views
+		// of the same users and groups, so they are not repeated
+		if tag == nil {
+			for _, t := range tags {
+				if t.Deleted == nil {
+					s.sendEntry(tagEntry(t), ldapPosition{Source: sourceTags, Tag: t.Name})
+				}
+			}
+		}
+		if s.Scope == ldapMsg.SearchRequestHomeSubtree {
+			for _, ou := range ldapContainers {
+				s.sendLeaves(m, ou, base.Tag, bson.M{})
+			}
+		}
+	}
+	return nil
+}
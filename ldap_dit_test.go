@@ -0,0 +1,216 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPSearch(t *testing.T) {
+	Convey("Searches follow the scope and limits", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		m := newMemoryStore()
+		for _, u := range ldapTestUsers {
+			So(m.InsertUser(u), ShouldBeNil)
+		}
+		for _, g := range ldapTestGroups {
+			So(m.InsertGroup(g), ShouldBeNil)
+		}
+		So(m.InsertTag(FilterTag{Name: "ci", Desc: "CI runners"}), ShouldBeNil)
+		So(m.InsertTag(FilterTag{Name: "old", Deleted: &Tombstone{}}), ShouldBeNil)
+
+		var dns []string
+		newSearch := func(scope int, filter string) *ldapSearch {
+			f, err := parseLDAPFilter(filter)
+			So(err, ShouldBeNil)
+			dns = []string{}
+			return &ldapSearch{
+				Scope:  scope,
+				Filter: f,
+				write:  func(e ldapEntry) { dns = append(dns, e.DN) },
+				done:   func() bool { return false },
+			}
+		}
+		search := func(base string, scope int, filter string) ([]string, error) {
+			dn, err := parseDN(base)
+			So(err, ShouldBeNil)
+			b, err := resolveLDAPBase(dn)
+			So(err, ShouldBeNil)
+			s := newSearch(scope, filter)
+			err = s.run(m, b)
+			So(s.Code, ShouldEqual, ldap.LDAPResultSuccess)
+			return dns, err
+		}
+		base, one, sub := ldapMsg.SearchRequestScopeBaseObject, ldapMsg.SearchRequestSingleLevel, ldapMsg.SearchRequestHomeSubtree
+
+		Convey("Base scope returns the base entry", func() {
+			dns, err := search("uid=LiSi,ou=people,o=tuna", base, "(objectClass=*)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"uid=lisi,ou=people,o=tuna"})
+
+			dns, err = search("uid=lisi,ou=people,o=tuna", base, "(uid=zhangsan)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{})
+
+			dns, err = search("uid=lisi,ou=people,o=tuna", one, "(objectClass=*)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{})
+
+			dns, err = search("cn=dev,ou=groups,o=tuna", sub, "(objectClass=*)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"cn=dev,ou=groups,o=tuna"})
+
+			dns, err = search("ou=people,o=tuna", base, "(objectClass=*)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"ou=people,o=tuna"})
+
+			dns, err = search("ou=people,o=tuna", base, "(objectClass=posixAccount)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{})
+
+			dns, err = search("o=tuna", base, "(objectClass=organization)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"o=tuna"})
+
+			dns, err = search("tag=ci,o=tuna", base, "(&(objectClass=filterTag)(description=CI runners))")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"tag=ci,o=tuna"})
+
+			for _, dn := range []string{"tag=old,o=tuna", "tag=nothing,o=tuna", "ou=people,tag=nothing,o=tuna"} {
+				_, err = search(dn, base, "(objectClass=*)")
+				So(err, ShouldEqual, errNoSuchObject)
+			}
+
+			_, err = search("uid=nobody,ou=people,o=tuna", base, "(objectClass=*)")
+			So(err, ShouldEqual, errNoSuchObject)
+			_, err = search("cn=lisi,ou=groups,o=tuna", base, "(objectClass=*)")
+			So(err, ShouldEqual, errNoSuchObject)
+		})
+
+		Convey("One-level scope returns the children", func() {
+			dns, err := search("o=tuna", one, "(objectClass=*)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"ou=people,o=tuna", "ou=groups,o=tuna", "tag=ci,o=tuna"})
+
+			dns, err = search("tag=ci,o=tuna", one, "(ou=groups)")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"ou=groups,tag=ci,o=tuna"})
+
+			dns, err = search("ou=groups,o=tuna", one, "(objectClass=posixGroup)")
+			So(err, ShouldBeNil)
+			So(len(dns), ShouldEqual, 3)
+		})
+
+		Convey("Subtree scope returns the whole tree", func() {
+			dns, err := search("o=tuna", sub, "(objectClass=*)")
+			So(err, ShouldBeNil)
+			So(len(dns), ShouldEqual, 4+len(ldapTestUsers)+len(ldapTestGroups))
+
+			dns, err = search("tag=ci,o=tuna", sub, "(!(objectClass=posixAccount))")
+			So(err, ShouldBeNil)
+			So(dns[:3], ShouldResemble, []string{"tag=ci,o=tuna", "ou=people,tag=ci,o=tuna", "ou=groups,tag=ci,o=tuna"})
+
+			dns, err = search("ou=people,o=tuna", sub, "(|(ou=people)(uid=lisi))")
+			So(err, ShouldBeNil)
+			So(dns, ShouldResemble, []string{"ou=people,o=tuna", "uid=lisi,ou=people,o=tuna"})
+		})
+
+		Convey("The Root DSE and the subschema are searchable", func() {
+			special := func(base string, scope int, filter string, attrs ...string) []ldapEntry {
+				dn, err := parseDN(base)
+				So(err, ShouldBeNil)
+				s := newSearch(scope, filter)
+				s.Attributes = attrs
+				entries := []ldapEntry{}
+				s.write = func(e ldapEntry) { entries = append(entries, e) }
+				So(s.runSpecial(dn), ShouldBeTrue)
+				return entries
+			}
+
+			entries := special("", base, "(objectClass=*)")
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].DN, ShouldEqual, "")
+			So(entries[0].Attrs, ShouldContain, ldapAttribute{"namingContexts", []string{"o=tuna"}})
+			So(entries[0].Attrs, ShouldContain, ldapAttribute{"supportedControl", []string{pagedResultsOID}})
+			So(len(special("", sub, "(objectClass=*)")), ShouldEqual, 0)
+
+			entries = special("CN=Subschema", base, "(objectClass=subschema)", "objectClasses")
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Attrs, ShouldResemble, []ldapAttribute{{"objectClasses", ldapObjectClasses}})
+			So(len(special("cn=subschema", base, "(objectClass=posixAccount)")), ShouldEqual, 0)
+			// descriptions start with numeric OIDs, which clients require
+			numericOID := regexp.MustCompile(`^\( [0-9]+(\.[0-9]+)+ `)
+			for _, defs := range [][]string{ldapSyntaxes, ldapSchemaMatchingRules, ldapAttributeTypes, ldapObjectClasses} {
+				for _, def := range defs {
+					So(numericOID.MatchString(def), ShouldBeTrue)
+				}
+			}
+
+			dn, _ := parseDN("ou=people,o=tuna")
+			So(newSearch(base, "(objectClass=*)").runSpecial(dn), ShouldBeFalse)
+		})
+
+		Convey("Limits stop the search", func() {
+			dn, _ := parseDN("ou=people,o=tuna")
+			b, _ := resolveLDAPBase(dn)
+
+			s := newSearch(one, "(objectClass=*)")
+			s.SizeLimit = 2
+			So(s.run(m, b), ShouldBeNil)
+			So(s.Code, ShouldEqual, ldap.LDAPResultSizeLimitExceeded)
+			So(len(dns), ShouldEqual, 2)
+
+			s = newSearch(one, "(objectClass=*)")
+			s.SizeLimit = len(ldapTestUsers)
+			So(s.run(m, b), ShouldBeNil)
+			So(s.Code, ShouldEqual, ldap.LDAPResultSuccess)
+			So(len(dns), ShouldEqual, len(ldapTestUsers))
+
+			s = newSearch(one, "(objectClass=*)")
+			s.Deadline = time.Now().Add(-time.Second)
+			So(s.run(m, b), ShouldBeNil)
+			So(s.Code, ShouldEqual, ldap.LDAPResultTimeLimitExceeded)
+			So(len(dns), ShouldEqual, 0)
+
+			s = newSearch(one, "(objectClass=*)")
+			s.done = func() bool { return len(dns) == 1 }
+			So(s.run(m, b), ShouldBeNil)
+			So(s.Abandoned, ShouldBeTrue)
+			So(len(dns), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Only requested attributes are returned", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		e := userEntry(User{UID: 2000, GID: 2000, Username: "lisi", Password: generateSSHA("pass"), LoginShell: "/bin/bash"})
+
+		names := func(selection ...string) []string {
+			res := []string{}
+			for _, attr := range selectAttributes(e, selection).Attrs {
+				res = append(res, attr.Name)
+			}
+			return res
+		}
+		all := names()
+		So(all, ShouldContain, "uid")
+		So(all, ShouldContain, "objectClass")
+		So(all, ShouldNotContain, "userPassword")
+		So(all, ShouldNotContain, "entryDN")
+		So(names("*"), ShouldResemble, all)
+		So(names("1.1"), ShouldResemble, []string{})
+		So(names("UID", "gidnumber", "nothing"), ShouldResemble, []string{"uid", "gidNumber"})
+		So(names("uid", "1.1"), ShouldResemble, []string{"uid"})
+		So(names("userPassword"), ShouldResemble, []string{"userPassword"})
+		So(names("+"), ShouldResemble, []string{"entryDN", "hasSubordinates", "subschemaSubentry"})
+		So(names("uid", "entryDN"), ShouldResemble, []string{"uid", "entryDN"})
+		So(names("*", "+"), ShouldResemble, append(all, "entryDN", "hasSubordinates", "subschemaSubentry"))
+	})
+}
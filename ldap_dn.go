@@ -0,0 +1,316 @@
+// distinguished names of RFC 4514
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errNoSuchObject = errors.New("No such object")
+
+// An ldapAVA is an attribute value assertion of an RDN,
+// Type is folded to lower case
+type ldapAVA struct {
+	Type  string
+	Value string
+}
+
+// An ldapRDN is a relative distinguished name, which has
+// several AVAs if it is multi-valued
+type ldapRDN []ldapAVA
+
+// An ldapDN lists RDNs from the entry to the root
+type ldapDN []ldapRDN
+
+// attribute types which may be given by OID
+var ldapTypeOIDs = map[string]string{
+	"2.5.4.3":                    "cn",
+	"2.5.4.10":                   "o",
+	"2.5.4.11":                   "ou",
+	"0.9.2342.19200300.100.1.1":  "uid",
+	"0.9.2342.19200300.100.1.25": "dc",
+}
+
+// parseDN parses the string representation of a DN, unescaping values
+// and dropping insignificant spaces. The empty string is the root DN.
+func parseDN(s string) (ldapDN, error) {
+	dn := ldapDN{}
+	if strings.TrimSpace(s) == "" {
+		return dn, nil
+	}
+	p := &dnParser{s: s}
+	rdn := ldapRDN{}
+	for {
+		ava, err := p.ava()
+		if err != nil {
+			return nil, err
+		}
+		rdn = append(rdn, ava)
+		if p.pos == len(s) {
+			return append(dn, rdn), nil
+		}
+		switch s[p.pos] {
+		case '+':
+		case ',', ';':
+			dn = append(dn, rdn)
+			rdn = ldapRDN{}
+		default:
+			return nil, p.errorf("unexpected %q", s[p.pos])
+		}
+		p.pos++
+	}
+}
+
+type dnParser struct {
+	s   string
+	pos int
+}
+
+func (p *dnParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid DN %q at %d: %s", p.s, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *dnParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *dnParser) ava() (ldapAVA, error) {
+	p.skipSpaces()
+	eq := strings.IndexByte(p.s[p.pos:], '=')
+	if eq < 0 {
+		return ldapAVA{}, p.errorf("missing '='")
+	}
+	attr := strings.TrimRight(p.s[p.pos:p.pos+eq], " ")
+	if !isDNAttributeType(attr) {
+		return ldapAVA{}, p.errorf("invalid attribute type %q", attr)
+	}
+	attr = strings.ToLower(attr)
+	attr = strings.TrimPrefix(attr, "oid.")
+	if name, ok := ldapTypeOIDs[attr]; ok {
+		attr = name
+	}
+	p.pos += eq + 1
+	p.skipSpaces()
+
+	value, err := p.value()
+	if err != nil {
+		return ldapAVA{}, err
+	}
+	return ldapAVA{Type: attr, Value: value}, nil
+}
+
+// isDNAttributeType checks for a descriptor or a numeric OID
+func isDNAttributeType(s string) bool {
+	if s == "" {
+		return false
+	}
+	if len(s) > 4 && strings.EqualFold(s[:4], "oid.") {
+		s = s[4:]
+	}
+	if s[0] >= '0' && s[0] <= '9' {
+		for _, part := range strings.Split(s, ".") {
+			if part == "" || strings.Trim(part, "0123456789") != "" {
+				return false
+			}
+		}
+		return true
+	}
+	for i, c := range s {
+		alpha := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !alpha && (i == 0 || c != '-' && (c < '0' || c > '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *dnParser) value() (string, error) {
+	if p.pos < len(p.s) && p.s[p.pos] == '#' {
+		return p.hexValue()
+	}
+	var b []byte
+	// end of the significant part, trailing spaces are dropped
+	significant := 0
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case ',', ';', '+':
+			return string(b[:significant]), nil
+		case '"', '<', '>':
+			return "", p.errorf("unescaped %q", c)
+		case '\\':
+			if p.pos+1 >= len(p.s) {
+				return "", p.errorf("incomplete escape")
+			}
+			next := p.s[p.pos+1]
+			if strings.IndexByte(` "#+,;<=>\`, next) >= 0 {
+				b = append(b, next)
+				p.pos += 2
+				significant = len(b)
+				continue
+			}
+			if p.pos+2 >= len(p.s) {
+				return "", p.errorf("incomplete escape")
+			}
+			v, err := hex.DecodeString(p.s[p.pos+1 : p.pos+3])
+			if err != nil {
+				return "", p.errorf("invalid escape")
+			}
+			b = append(b, v[0])
+			p.pos += 3
+			significant = len(b)
+			continue
+		}
+		b = append(b, c)
+		if c != ' ' {
+			significant = len(b)
+		}
+		p.pos++
+	}
+	return string(b[:significant]), nil
+}
+
+// hexValue reads the #hexstring form, the BER encoding is kept as is
+func (p *dnParser) hexValue() (string, error) {
+	start := p.pos + 1
+	end := start
+	for end < len(p.s) && strings.IndexByte(",;+ ", p.s[end]) < 0 {
+		end++
+	}
+	v, err := hex.DecodeString(p.s[start:end])
+	if err != nil || end == start {
+		return "", p.errorf("invalid hex value")
+	}
+	p.pos = end
+	p.skipSpaces()
+	return string(v), nil
+}
+
+// escapeDNValue escapes an attribute value for the string form of a DN
+func escapeDNValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case strings.IndexByte(`"+,;<=>\`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(v)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (dn ldapDN) String() string {
+	rdns := []string{}
+	for _, rdn := range dn {
+		avas := []string{}
+		for _, ava := range rdn {
+			avas = append(avas, ava.Type+"="+escapeDNValue(ava.Value))
+		}
+		rdns = append(rdns, strings.Join(avas, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// equal compares RDNs, values are compared case-insensitively
+// since the naming attributes here all use caseIgnoreMatch
+func (rdn ldapRDN) equal(other ldapRDN) bool {
+	if len(rdn) != len(other) {
+		return false
+	}
+	for _, ava := range rdn {
+		found := false
+		for _, o := range other {
+			if ava.Type == o.Type && strings.EqualFold(ava.Value, o.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSuffix tells whether dn is suffix or below it
+func (dn ldapDN) hasSuffix(suffix ldapDN) bool {
+	if len(dn) < len(suffix) {
+		return false
+	}
+	offset := len(dn) - len(suffix)
+	for i, rdn := range suffix {
+		if !dn[offset+i].equal(rdn) {
+			return false
+		}
+	}
+	return true
+}
+
+// ldapSuffix is the parsed suffix of the directory, which is
+// validated when the config is loaded
+func ldapSuffix() ldapDN {
+	suffix, err := parseDN(dcfg.LDAP.Suffix)
+	if err != nil {
+		logger.Errorf("Invalid LDAP suffix: %s", err.Error())
+		return ldapDN{}
+	}
+	return suffix
+}
+
+// OU names of people and groups
+var (
+	ldapPeopleOUs = []string{"people", "users"}
+	ldapGroupOUs  = []string{"groups", "group"}
+)
+
+// An ldapBase is a DN below the suffix resolved to the directory tree,
+// i.e. [uid=<user>|cn=<group>,]ou=<people|groups>[,tag=<tag>],<suffix>
+type ldapBase struct {
+	OU   string
+	Tag  string
+	Attr string
+	Val  string
+}
+
+// resolveLDAPBase resolves the RDNs of dn above the suffix,
+// errNoSuchObject is returned if it is not in the tree
+func resolveLDAPBase(dn ldapDN) (ldapBase, error) {
+	base := ldapBase{}
+	suffix := ldapSuffix()
+	if !dn.hasSuffix(suffix) {
+		return base, errNoSuchObject
+	}
+	rdns := dn[:len(dn)-len(suffix)]
+	for i := len(rdns) - 1; i >= 0; i-- {
+		if len(rdns[i]) != 1 {
+			return base, errNoSuchObject
+		}
+		ava := rdns[i][0]
+		switch {
+		case ava.Type == "tag" && base.Tag == "" && base.OU == "":
+			base.Tag = ava.Value
+		case ava.Type == "ou" && base.OU == "" && stringInSliceFold(ava.Value, ldapPeopleOUs):
+			base.OU = "people"
+		case ava.Type == "ou" && base.OU == "" && stringInSliceFold(ava.Value, ldapGroupOUs):
+			base.OU = "groups"
+		case base.Attr == "" && base.OU == "people" && (ava.Type == "uid" || ava.Type == "cn"):
+			base.Attr, base.Val = ava.Type, ava.Value
+		case base.Attr == "" && base.OU == "groups" && ava.Type == "cn":
+			base.Attr, base.Val = ava.Type, ava.Value
+		default:
+			return base, errNoSuchObject
+		}
+	}
+	return base, nil
+}
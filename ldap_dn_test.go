@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPDN(t *testing.T) {
+	Convey("DNs are parsed", t, func() {
+		dn, err := parseDN(` UID = zhangsan , OU=People,0.9.2342.19200300.100.1.25=example+O=tuna `)
+		So(err, ShouldBeNil)
+		So(dn, ShouldResemble, ldapDN{
+			{{"uid", "zhangsan"}},
+			{{"ou", "People"}},
+			{{"dc", "example"}, {"o", "tuna"}},
+		})
+
+		dn, err = parseDN(`cn=a\,b\+c\20\\,o=\#x\ ;o=\E5\BC\A0 `)
+		So(err, ShouldBeNil)
+		So(dn, ShouldResemble, ldapDN{
+			{{"cn", "a,b+c \\"}},
+			{{"o", "#x "}},
+			{{"o", "张"}},
+		})
+		So(dn.String(), ShouldEqual, `cn=a\,b\+c \\,o=\#x\ ,o=张`)
+
+		dn, err = parseDN(`cn=#04024869,o=`)
+		So(err, ShouldBeNil)
+		So(dn, ShouldResemble, ldapDN{{{"cn", "\x04\x02Hi"}}, {{"o", ""}}})
+
+		dn, err = parseDN("")
+		So(err, ShouldBeNil)
+		So(len(dn), ShouldEqual, 0)
+
+		for _, bad := range []string{
+			"zhangsan", "uid=a,", ",uid=a", "=a", "1uid=a", "u id=a",
+			`uid=a"b`, "uid=<a>", `uid=a\`, `uid=a\4`, `uid=a\zz`, "cn=#zz", "uid=a+",
+		} {
+			_, err := parseDN(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Values are escaped", t, func() {
+		for _, v := range []string{"a.b+c", " x ", "#1", `a"b<c>d;e=f\`, "a,b", "\x00"} {
+			dn, err := parseDN("uid=" + escapeDNValue(v))
+			So(err, ShouldBeNil)
+			So(dn[0][0].Value, ShouldEqual, v)
+		}
+	})
+
+	Convey("DNs are resolved in the directory tree", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "dc=example,o=tuna"
+
+		resolve := func(s string) (ldapBase, error) {
+			dn, err := parseDN(s)
+			So(err, ShouldBeNil)
+			return resolveLDAPBase(dn)
+		}
+
+		base, err := resolve("DC=Example, O=TUNA")
+		So(err, ShouldBeNil)
+		So(base, ShouldResemble, ldapBase{})
+
+		base, err = resolve("uid=LiSi,ou=Users,tag=ci,dc=example,o=tuna")
+		So(err, ShouldBeNil)
+		So(base, ShouldResemble, ldapBase{OU: "people", Tag: "ci", Attr: "uid", Val: "LiSi"})
+
+		base, err = resolve("cn=dev,ou=Group,dc=example,o=tuna")
+		So(err, ShouldBeNil)
+		So(base, ShouldResemble, ldapBase{OU: "groups", Attr: "cn", Val: "dev"})
+
+		for _, s := range []string{
+			"o=tuna", "dc=other,o=tuna", "ou=hosts,dc=example,o=tuna",
+			"uid=a,dc=example,o=tuna", "uid=a,ou=groups,dc=example,o=tuna",
+			"ou=people,ou=groups,dc=example,o=tuna", "tag=a,ou=people,dc=example,o=tuna",
+			"uid=a,uid=b,ou=people,dc=example,o=tuna", "uid=a+cn=b,ou=people,dc=example,o=tuna",
+		} {
+			_, err := resolve(s)
+			So(err, ShouldEqual, errNoSuchObject)
+		}
+	})
+
+	Convey("Users are found by DN values case-insensitively", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+		So(m.InsertUser(User{UID: 2000, Username: "lisi", Email: "lisi@example.com", IsActive: true}), ShouldBeNil)
+		So(m.InsertUser(User{UID: 2001, Username: "wangwu", Email: "wangwu@example.com", IsActive: true}), ShouldBeNil)
+		So(m.InsertUser(User{UID: 2002, Username: "WangWu", Email: "WangWu@example.com", IsActive: true}), ShouldBeNil)
+
+		u, ok := findLDAPUser(m, "LISI")
+		So(ok, ShouldBeTrue)
+		So(u.UID, ShouldEqual, 2000)
+		u, ok = findLDAPUser(m, "WangWu")
+		So(ok, ShouldBeTrue)
+		So(u.UID, ShouldEqual, 2002)
+		_, ok = findLDAPUser(m, "WANGWU")
+		So(ok, ShouldBeFalse)
+		_, ok = findLDAPUser(m, "li.si")
+		So(ok, ShouldBeFalse)
+	})
+}
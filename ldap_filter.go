@@ -0,0 +1,767 @@
+// LDAP search filters and their translation to BSON queries
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// filter choices of RFC 4511
+const (
+	filterAnd = iota
+	filterOr
+	filterNot
+	filterEquality
+	filterSubstrings
+	filterGreaterOrEqual
+	filterLessOrEqual
+	filterPresent
+	filterApprox
+	filterExtensible
+)
+
+// An ldapFilter is a search filter independent of the wire format,
+// it is converted from goldap filters or parsed from RFC 4515 strings
+type ldapFilter struct {
+	Op       int
+	Children []ldapFilter
+	Attr     string
+	Value    string
+
+	// substrings
+	Initial string
+	Any     []string
+	Final   string
+
+	// extensible match
+	Rule         string
+	DNAttributes bool
+}
+
+// matching rules supported in extensible matches, by name and OID
+var ldapMatchingRules = map[string]string{
+	"caseexactmatch":             "caseExactMatch",
+	"2.5.13.5":                   "caseExactMatch",
+	"caseexactia5match":          "caseExactMatch",
+	"1.3.6.1.4.1.1466.109.114.1": "caseExactMatch",
+	"octetstringmatch":           "caseExactMatch",
+	"2.5.13.17":                  "caseExactMatch",
+	"caseignorematch":            "caseIgnoreMatch",
+	"2.5.13.2":                   "caseIgnoreMatch",
+	"caseignoreia5match":         "caseIgnoreMatch",
+	"1.3.6.1.4.1.1466.109.114.2": "caseIgnoreMatch",
+	"integermatch":               "integerMatch",
+	"2.5.13.14":                  "integerMatch",
+	"numericstringmatch":         "integerMatch",
+	"2.5.13.8":                   "integerMatch",
+	"integerorderingmatch":       "integerMatch",
+	"2.5.13.15":                  "integerMatch",
+	"caseignoreorderingmatch":    "caseIgnoreMatch",
+	"2.5.13.3":                   "caseIgnoreMatch",
+	"caseexactorderingmatch":     "caseExactMatch",
+	"2.5.13.6":                   "caseExactMatch",
+	"caseignoresubstringsmatch":  "caseIgnoreMatch",
+	"2.5.13.4":                   "caseIgnoreMatch",
+}
+
+// newLDAPFilter converts a filter decoded by goldap
+func newLDAPFilter(filter ldapMsg.Filter) ldapFilter {
+	switch f := filter.(type) {
+	case ldapMsg.FilterAnd:
+		res := ldapFilter{Op: filterAnd}
+		for _, child := range f {
+			res.Children = append(res.Children, newLDAPFilter(child))
+		}
+		return res
+	case ldapMsg.FilterOr:
+		res := ldapFilter{Op: filterOr}
+		for _, child := range f {
+			res.Children = append(res.Children, newLDAPFilter(child))
+		}
+		return res
+	case ldapMsg.FilterNot:
+		return ldapFilter{Op: filterNot, Children: []ldapFilter{newLDAPFilter(f.Filter)}}
+	case ldapMsg.FilterEqualityMatch:
+		return ldapFilter{Op: filterEquality, Attr: string(f.AttributeDesc()), Value: string(f.AssertionValue())}
+	case ldapMsg.FilterGreaterOrEqual:
+		return ldapFilter{Op: filterGreaterOrEqual, Attr: string(f.AttributeDesc()), Value: string(f.AssertionValue())}
+	case ldapMsg.FilterLessOrEqual:
+		return ldapFilter{Op: filterLessOrEqual, Attr: string(f.AttributeDesc()), Value: string(f.AssertionValue())}
+	case ldapMsg.FilterApproxMatch:
+		return ldapFilter{Op: filterApprox, Attr: string(f.AttributeDesc()), Value: string(f.AssertionValue())}
+	case ldapMsg.FilterPresent:
+		return ldapFilter{Op: filterPresent, Attr: string(f)}
+	case ldapMsg.FilterSubstrings:
+		res := ldapFilter{Op: filterSubstrings, Attr: string(f.Type_())}
+		for _, s := range f.Substrings() {
+			switch v := s.(type) {
+			case ldapMsg.SubstringInitial:
+				res.Initial = string(v)
+			case ldapMsg.SubstringAny:
+				res.Any = append(res.Any, string(v))
+			case ldapMsg.SubstringFinal:
+				res.Final = string(v)
+			}
+		}
+		return res
+	case ldapMsg.FilterExtensibleMatch:
+		return newExtensibleFilter(f)
+	}
+	logger.Warningf("Unsupported LDAP filter: %T", filter)
+	return ldapFilter{Op: -1}
+}
+
+// BER tags of the fields of MatchingRuleAssertion
+const (
+	berMatchingRule = 0x81
+	berMatchType    = 0x82
+	berMatchValue   = 0x83
+	berDNAttributes = 0x84
+)
+
+// newExtensibleFilter reads a MatchingRuleAssertion, goldap does not
+// export its fields, so it is encoded as the protocol op of a message
+// and read back like messageWithControls does
+func newExtensibleFilter(f ldapMsg.FilterExtensibleMatch) ldapFilter {
+	res, err := decodeExtensibleFilter(f)
+	if err != nil {
+		logger.Warningf("Unsupported extensible match filter: %s", err.Error())
+		return ldapFilter{Op: -1}
+	}
+	return res
+}
+
+func decodeExtensibleFilter(f ldapMsg.FilterExtensibleMatch) (ldapFilter, error) {
+	res := ldapFilter{Op: filterExtensible}
+	data, err := ldapMsg.NewLDAPMessageWithProtocolOp(f).Write()
+	if err != nil {
+		return res, err
+	}
+	_, content, _, err := berRead(data.Bytes())
+	if err != nil {
+		return res, err
+	}
+	// skip the message ID
+	if _, _, content, err = berRead(content); err != nil {
+		return res, err
+	}
+	if _, content, _, err = berRead(content); err != nil {
+		return res, err
+	}
+	for len(content) > 0 {
+		var tag byte
+		var value []byte
+		if tag, value, content, err = berRead(content); err != nil {
+			return res, err
+		}
+		switch tag {
+		case berMatchingRule:
+			res.Rule = string(value)
+		case berMatchType:
+			res.Attr = string(value)
+		case berMatchValue:
+			res.Value = string(value)
+		case berDNAttributes:
+			res.DNAttributes = len(value) == 1 && value[0] != 0
+		default:
+			return res, errBERSyntax
+		}
+	}
+	return res, nil
+}
+
+// parseLDAPFilter parses the string representation of RFC 4515
+func parseLDAPFilter(s string) (ldapFilter, error) {
+	p := &filterParser{s: s}
+	f, err := p.filter()
+	if err != nil {
+		return f, err
+	}
+	if p.pos != len(s) {
+		return f, fmt.Errorf("Unexpected %q at %d in filter", s[p.pos:], p.pos)
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid filter at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) expect(c byte) error {
+	if p.pos >= len(p.s) || p.s[p.pos] != c {
+		return p.errorf("expecting %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) filter() (ldapFilter, error) {
+	if err := p.expect('('); err != nil {
+		return ldapFilter{}, err
+	}
+	if p.pos >= len(p.s) {
+		return ldapFilter{}, p.errorf("unexpected end")
+	}
+
+	var f ldapFilter
+	var err error
+	switch p.s[p.pos] {
+	case '&', '|':
+		f.Op = filterAnd
+		if p.s[p.pos] == '|' {
+			f.Op = filterOr
+		}
+		p.pos++
+		for p.pos < len(p.s) && p.s[p.pos] == '(' {
+			child, err := p.filter()
+			if err != nil {
+				return f, err
+			}
+			f.Children = append(f.Children, child)
+		}
+	case '!':
+		p.pos++
+		child, err := p.filter()
+		if err != nil {
+			return f, err
+		}
+		f = ldapFilter{Op: filterNot, Children: []ldapFilter{child}}
+	default:
+		f, err = p.item()
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, p.expect(')')
+}
+
+func (p *filterParser) item() (ldapFilter, error) {
+	end := strings.IndexByte(p.s[p.pos:], ')')
+	if end < 0 {
+		return ldapFilter{}, p.errorf("missing ')'")
+	}
+	item := p.s[p.pos : p.pos+end]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return ldapFilter{}, p.errorf("missing '='")
+	}
+	p.pos += end
+
+	attr, raw := item[:eq], item[eq+1:]
+	f := ldapFilter{Attr: attr}
+	switch attr[len(attr)-1] {
+	case '~':
+		f.Op, f.Attr = filterApprox, attr[:len(attr)-1]
+	case '>':
+		f.Op, f.Attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		f.Op, f.Attr = filterLessOrEqual, attr[:len(attr)-1]
+	case ':':
+		return parseExtensible(attr[:len(attr)-1], raw)
+	default:
+		if raw == "*" {
+			return ldapFilter{Op: filterPresent, Attr: attr}, nil
+		}
+		if strings.Contains(raw, "*") {
+			return parseSubstrings(attr, raw)
+		}
+		f.Op = filterEquality
+	}
+	var err error
+	if f.Value, err = unescapeFilterValue(raw); err != nil {
+		return f, err
+	}
+	if f.Attr == "" {
+		return f, fmt.Errorf("Invalid filter: missing attribute in %q", item)
+	}
+	return f, nil
+}
+
+// parseExtensible parses attr[:dn][:rule]:=value, desc is without ':='
+func parseExtensible(desc, raw string) (ldapFilter, error) {
+	f := ldapFilter{Op: filterExtensible}
+	parts := strings.Split(desc, ":")
+	f.Attr = parts[0]
+	for _, part := range parts[1:] {
+		if strings.EqualFold(part, "dn") {
+			f.DNAttributes = true
+		} else if part != "" {
+			f.Rule = part
+		}
+	}
+	if f.Attr == "" && f.Rule == "" {
+		return f, fmt.Errorf("Invalid extensible filter %q", desc)
+	}
+	var err error
+	f.Value, err = unescapeFilterValue(raw)
+	return f, err
+}
+
+func parseSubstrings(attr, raw string) (ldapFilter, error) {
+	f := ldapFilter{Op: filterSubstrings, Attr: attr}
+	pieces := strings.Split(raw, "*")
+	for i, piece := range pieces {
+		v, err := unescapeFilterValue(piece)
+		if err != nil {
+			return f, err
+		}
+		switch {
+		case i == 0:
+			f.Initial = v
+		case i == len(pieces)-1:
+			f.Final = v
+		case v != "":
+			f.Any = append(f.Any, v)
+		}
+	}
+	return f, nil
+}
+
+// unescapeFilterValue decodes \XX escapes of RFC 4515
+func unescapeFilterValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("Invalid escape in filter value %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Invalid escape in filter value %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// ldapNoMatch is a query no document satisfies
+func ldapNoMatch() bson.M {
+	return bson.M{"_id": bson.M{"$in": []interface{}{}}}
+}
+
+func isLDAPNoMatch(q bson.M) bool {
+	return reflect.DeepEqual(q, ldapNoMatch())
+}
+
+// bsonAnd joins queries, omitting the ones matching everything
+func bsonAnd(qs []bson.M) bson.M {
+	res := []bson.M{}
+	for _, q := range qs {
+		if isLDAPNoMatch(q) {
+			return ldapNoMatch()
+		} else if len(q) > 0 {
+			res = append(res, q)
+		}
+	}
+	switch len(res) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return res[0]
+	}
+	return bson.M{"$and": res}
+}
+
+// bsonOr joins queries, omitting the ones matching nothing
+func bsonOr(qs []bson.M) bson.M {
+	res := []bson.M{}
+	for _, q := range qs {
+		if len(q) == 0 {
+			return bson.M{}
+		} else if !isLDAPNoMatch(q) {
+			res = append(res, q)
+		}
+	}
+	switch len(res) {
+	case 0:
+		return ldapNoMatch()
+	case 1:
+		return res[0]
+	}
+	return bson.M{"$or": res}
+}
+
+// bsonNot negates a query with $nor, as MongoDB has no top-level $not
+func bsonNot(q bson.M) bson.M {
+	if len(q) == 0 {
+		return ldapNoMatch()
+	} else if isLDAPNoMatch(q) {
+		return bson.M{}
+	}
+	return bson.M{"$nor": []bson.M{q}}
+}
+
+// An ldapCondition is a filter translated under the three-valued logic
+// of RFC 4511, documents matching neither query evaluate to Undefined
+type ldapCondition struct {
+	True  bson.M
+	False bson.M
+}
+
+func ldapUndefined() ldapCondition {
+	return ldapCondition{True: ldapNoMatch(), False: ldapNoMatch()}
+}
+
+// ldapDefined is the condition of a filter item which is never Undefined
+func ldapDefined(q bson.M) ldapCondition {
+	return ldapCondition{True: q, False: bsonNot(q)}
+}
+
+// ldapAttrKey finds the document key of an attribute,
+// attribute names are case-insensitive
+func ldapAttrKey(attr string, keymap map[string]string) (name, key string, ok bool) {
+	for name, key := range keymap {
+		if strings.EqualFold(name, attr) {
+			return name, key, true
+		}
+	}
+	return "", "", false
+}
+
+// ldapAttrRule is the equality matching rule of an attribute
+func ldapAttrRule(name string) string {
+	if ldapIntegerFields[name] {
+		return "integerMatch"
+	} else if ldapCaseIgnoreFields[name] {
+		return "caseIgnoreMatch"
+	}
+	return "caseExactMatch"
+}
+
+// ldapFilterToBson translates a filter to a query on documents described
+// by keymap, objectClasses are the classes every such entry has.
+// Only entries for which the filter evaluates to TRUE are matched.
+func ldapFilterToBson(f ldapFilter, keymap map[string]string, objectClasses []string) bson.M {
+	return ldapFilterCondition(f, keymap, objectClasses).True
+}
+
+func ldapFilterCondition(f ldapFilter, keymap map[string]string, objectClasses []string) ldapCondition {
+	switch f.Op {
+	case filterAnd, filterOr:
+		trues, falses := []bson.M{}, []bson.M{}
+		for _, child := range f.Children {
+			c := ldapFilterCondition(child, keymap, objectClasses)
+			trues = append(trues, c.True)
+			falses = append(falses, c.False)
+		}
+		if f.Op == filterAnd {
+			return ldapCondition{True: bsonAnd(trues), False: bsonOr(falses)}
+		}
+		return ldapCondition{True: bsonOr(trues), False: bsonAnd(falses)}
+	case filterNot:
+		if len(f.Children) != 1 {
+			return ldapUndefined()
+		}
+		c := ldapFilterCondition(f.Children[0], keymap, objectClasses)
+		return ldapCondition{True: c.False, False: c.True}
+	}
+
+	if strings.EqualFold(f.Attr, "objectClass") {
+		return objectClassCondition(f, objectClasses)
+	}
+	name, key, ok := ldapAttrKey(f.Attr, keymap)
+	if !ok {
+		return ldapUndefined()
+	}
+	if q, ok := ldapItemToBson(f, key, ldapAttrRule(name)); ok {
+		return ldapDefined(q)
+	}
+	return ldapUndefined()
+}
+
+// ldapItemToBson translates a filter item on an attribute with the given
+// equality rule, it fails if the item would be Undefined
+func ldapItemToBson(f ldapFilter, key, rule string) (bson.M, bool) {
+	isInt := rule == "integerMatch"
+	switch f.Op {
+	case filterEquality:
+		return ldapMatchToBson(key, rule, f.Value)
+	case filterGreaterOrEqual, filterLessOrEqual:
+		var v interface{} = f.Value
+		if isInt {
+			n, err := parseLDAPInteger(f.Value)
+			if err != nil {
+				return nil, false
+			}
+			v = n
+		}
+		op := "$lte"
+		if f.Op == filterGreaterOrEqual {
+			op = "$gte"
+		}
+		if isInt {
+			return bson.M{key: bson.M{op: v}}, true
+		}
+		// empty strings are absent values, not the smallest ones
+		return bson.M{key: bson.M{op: v, "$ne": ""}}, true
+	case filterPresent:
+		return bson.M{key: bson.M{"$nin": []interface{}{nil, "", []interface{}{}}}}, true
+	case filterApprox:
+		if isInt {
+			return ldapMatchToBson(key, rule, f.Value)
+		}
+		return ldapMatchToBson(key, "caseIgnoreMatch", f.Value)
+	case filterSubstrings:
+		// integers have no substring matching rule
+		if isInt {
+			return nil, false
+		}
+		if f.Initial == "" && f.Final == "" && len(f.Any) == 0 {
+			return ldapItemToBson(ldapFilter{Op: filterPresent, Attr: f.Attr}, key, rule)
+		}
+		re := bson.RegEx{Pattern: substringPattern(f)}
+		if rule == "caseIgnoreMatch" {
+			re.Options = "i"
+		}
+		return bson.M{key: re}, true
+	case filterExtensible:
+		if f.Rule != "" {
+			var ok bool
+			if rule, ok = ldapMatchingRules[strings.ToLower(f.Rule)]; !ok {
+				return nil, false
+			}
+			// the rule must apply to the syntax of the attribute
+			if (rule == "integerMatch") != isInt {
+				return nil, false
+			}
+		}
+		// dnAttributes are ignored since RDN attributes are entry attributes
+		return ldapMatchToBson(key, rule, f.Value)
+	}
+	return nil, false
+}
+
+// ldapMatchToBson is an equality match with rule
+func ldapMatchToBson(key, rule, value string) (bson.M, bool) {
+	if value == "" && rule != "integerMatch" {
+		// attributes have no empty values
+		return ldapNoMatch(), true
+	}
+	switch rule {
+	case "integerMatch":
+		n, err := parseLDAPInteger(value)
+		if err != nil {
+			return nil, false
+		}
+		return bson.M{key: n}, true
+	case "caseIgnoreMatch":
+		return bson.M{key: bson.RegEx{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}}, true
+	}
+	return bson.M{key: value}, true
+}
+
+// parseLDAPInteger parses an assertion value of the INTEGER syntax,
+// which has neither spaces nor leading zeros, RFC 4517 3.3.16
+func parseLDAPInteger(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || strconv.Itoa(n) != s {
+		return 0, fmt.Errorf("Invalid INTEGER %q", s)
+	}
+	return n, nil
+}
+
+func substringPattern(f ldapFilter) string {
+	pieces := []string{regexp.QuoteMeta(f.Initial)}
+	for _, s := range f.Any {
+		pieces = append(pieces, regexp.QuoteMeta(s))
+	}
+	pieces = append(pieces, regexp.QuoteMeta(f.Final))
+	return "^" + strings.Join(pieces, ".*") + "$"
+}
+
+// objectClassCondition evaluates assertions on objectClass, which has
+// the same values on every entry of an OU. As objectClass only has
+// an equality rule, other assertions are Undefined.
+func objectClassCondition(f ldapFilter, objectClasses []string) ldapCondition {
+	matched := false
+	switch {
+	case f.Op == filterPresent:
+		matched = len(objectClasses) > 0
+	case f.Op == filterEquality, f.Op == filterApprox:
+		matched = stringInSliceFold(f.Value, objectClasses)
+	case f.Op == filterExtensible && f.Rule == "":
+		matched = stringInSliceFold(f.Value, objectClasses)
+	default:
+		return ldapUndefined()
+	}
+	if matched {
+		return ldapDefined(bson.M{})
+	}
+	return ldapDefined(ldapNoMatch())
+}
+
+func stringInSliceFold(s string, list []string) bool {
+	for _, item := range list {
+		if strings.EqualFold(s, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// results of evalLDAPFilter
+const (
+	evalFalse = iota
+	evalTrue
+	evalUndefined
+)
+
+// evalLDAPFilter evaluates a filter on the attributes of an entry which
+// is not stored in the database. Attributes absent from keymap are not
+// recognized, except objectClass.
+func evalLDAPFilter(f ldapFilter, attrs []ldapAttribute, keymap map[string]string) int {
+	switch f.Op {
+	case filterAnd:
+		res := evalTrue
+		for _, c := range f.Children {
+			switch evalLDAPFilter(c, attrs, keymap) {
+			case evalFalse:
+				return evalFalse
+			case evalUndefined:
+				res = evalUndefined
+			}
+		}
+		return res
+	case filterOr:
+		res := evalFalse
+		for _, c := range f.Children {
+			switch evalLDAPFilter(c, attrs, keymap) {
+			case evalTrue:
+				return evalTrue
+			case evalUndefined:
+				res = evalUndefined
+			}
+		}
+		return res
+	case filterNot:
+		switch evalLDAPFilter(f.Children[0], attrs, keymap) {
+		case evalTrue:
+			return evalFalse
+		case evalFalse:
+			return evalTrue
+		}
+		return evalUndefined
+	}
+
+	var name, rule string
+	if strings.EqualFold(f.Attr, "objectClass") {
+		name, rule = "objectClass", "caseIgnoreMatch"
+	} else if n, _, ok := ldapAttrKey(f.Attr, keymap); ok {
+		name, rule = n, ldapAttrRule(n)
+	} else {
+		return evalUndefined
+	}
+	values := []string{}
+	for _, attr := range attrs {
+		if attr.Name == name {
+			for _, v := range attr.Values {
+				if v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+
+	any := func(pred func(v string) bool) int {
+		for _, v := range values {
+			if pred(v) {
+				return evalTrue
+			}
+		}
+		return evalFalse
+	}
+	equal := func(rule, assertion string) int {
+		switch rule {
+		case "integerMatch":
+			n, err := parseLDAPInteger(assertion)
+			if err != nil {
+				return evalUndefined
+			}
+			return any(func(v string) bool { i, _ := strconv.Atoi(v); return i == n })
+		case "caseIgnoreMatch":
+			return any(func(v string) bool { return strings.EqualFold(v, assertion) })
+		}
+		return any(func(v string) bool { return v == assertion })
+	}
+
+	switch f.Op {
+	case filterPresent:
+		return any(func(string) bool { return true })
+	case filterEquality:
+		return equal(rule, f.Value)
+	case filterApprox:
+		if rule == "integerMatch" {
+			return equal(rule, f.Value)
+		}
+		return equal("caseIgnoreMatch", f.Value)
+	case filterGreaterOrEqual, filterLessOrEqual:
+		if name == "objectClass" {
+			return evalUndefined
+		}
+		ge := f.Op == filterGreaterOrEqual
+		if rule == "integerMatch" {
+			n, err := parseLDAPInteger(f.Value)
+			if err != nil {
+				return evalUndefined
+			}
+			return any(func(v string) bool { i, _ := strconv.Atoi(v); return (i >= n) == ge || i == n })
+		}
+		return any(func(v string) bool { return (v >= f.Value) == ge || v == f.Value })
+	case filterSubstrings:
+		if name == "objectClass" || rule == "integerMatch" {
+			return evalUndefined
+		}
+		fold := func(s string) string {
+			if rule == "caseIgnoreMatch" {
+				return strings.ToLower(s)
+			}
+			return s
+		}
+		return any(func(v string) bool {
+			v = fold(v)
+			if !strings.HasPrefix(v, fold(f.Initial)) {
+				return false
+			}
+			v = v[len(f.Initial):]
+			for _, s := range f.Any {
+				i := strings.Index(v, fold(s))
+				if i < 0 {
+					return false
+				}
+				v = v[i+len(s):]
+			}
+			return strings.HasSuffix(v, fold(f.Final))
+		})
+	case filterExtensible:
+		if f.Attr == "" {
+			return evalUndefined
+		}
+		if f.Rule == "" {
+			return equal(rule, f.Value)
+		}
+		r, ok := ldapMatchingRules[strings.ToLower(f.Rule)]
+		if !ok || name == "objectClass" || (r == "integerMatch") != (rule == "integerMatch") {
+			return evalUndefined
+		}
+		return equal(r, f.Value)
+	}
+	return evalUndefined
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPFilter(t *testing.T) {
+	Convey("RFC 4515 filters are parsed", t, func() {
+		f, err := parseLDAPFilter(`(&(objectClass=posixAccount)(!(uid=a\2ab*))(cn=*x*y*)(uidNumber>=2000)(gidNumber:2.5.13.14:=2000))`)
+		So(err, ShouldBeNil)
+		So(f.Op, ShouldEqual, filterAnd)
+		So(len(f.Children), ShouldEqual, 5)
+		So(f.Children[1].Children[0].Op, ShouldEqual, filterSubstrings)
+		So(f.Children[1].Children[0].Initial, ShouldEqual, "a*b")
+		So(f.Children[2].Any, ShouldResemble, []string{"x", "y"})
+		So(f.Children[3].Op, ShouldEqual, filterGreaterOrEqual)
+		So(f.Children[4].Op, ShouldEqual, filterExtensible)
+		So(f.Children[4].Rule, ShouldEqual, "2.5.13.14")
+
+		for _, bad := range []string{"", "uid=a", "(uid=a", "(=a)", `(uid=\4)`, "(uid=a))"} {
+			_, err := parseLDAPFilter(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Extensible filters decoded by goldap are converted", t, func() {
+		decode := func(filter []byte) ldapFilter {
+			search := berTLV(berOctetString, []byte("o=tuna"))
+			search = append(search, berTLV(0x0a, []byte{2})...)
+			search = append(search, berTLV(0x0a, []byte{0})...)
+			search = append(search, berEncodeInteger(0)...)
+			search = append(search, berEncodeInteger(0)...)
+			search = append(search, berTLV(berBoolean, []byte{0})...)
+			search = append(search, filter...)
+			search = append(search, berTLV(berSequence, nil)...)
+			data := berTLV(berSequence, append(berEncodeInteger(1), berTLV(0x63, search)...))
+			msg, err := ldapMsg.ReadLDAPMessage(ldapMsg.NewBytes(0, data))
+			So(err, ShouldBeNil)
+			r := msg.ProtocolOp().(ldapMsg.SearchRequest)
+			return newLDAPFilter(r.Filter())
+		}
+
+		assertion := berTLV(berMatchingRule, []byte("2.5.13.14"))
+		assertion = append(assertion, berTLV(berMatchType, []byte("gidNumber"))...)
+		assertion = append(assertion, berTLV(berMatchValue, []byte("2000"))...)
+		assertion = append(assertion, berTLV(berDNAttributes, []byte{0xff})...)
+		So(decode(berTLV(0xa9, assertion)), ShouldResemble, ldapFilter{
+			Op: filterExtensible, Rule: "2.5.13.14", Attr: "gidNumber", Value: "2000", DNAttributes: true,
+		})
+
+		assertion = append(berTLV(berMatchValue, []byte("lisi")), berTLV(berDNAttributes, []byte{0})...)
+		f := decode(berTLV(0xa0, berTLV(0xa9, assertion)))
+		So(f.Op, ShouldEqual, filterAnd)
+		So(f.Children, ShouldResemble, []ldapFilter{{Op: filterExtensible, Value: "lisi"}})
+	})
+
+	Convey("Filters follow RFC 4515 semantics", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+		for _, u := range ldapTestUsers {
+			So(m.InsertUser(u), ShouldBeNil)
+		}
+		for _, g := range ldapTestGroups {
+			So(m.InsertGroup(g), ShouldBeNil)
+		}
+
+		searchUsers := func(q bson.M) []string {
+			names := []string{}
+			for _, u := range m.FindUsers(q, "") {
+				names = append(names, u.Username)
+			}
+			sort.Strings(names)
+			return names
+		}
+		searchGroups := func(q bson.M) []string {
+			names := []string{}
+			for _, g := range m.FindGroups(q, "") {
+				names = append(names, g.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		// names of the entries whose results are want, in the
+		// order of ldapTestUsers or ldapTestGroups
+		expected := func(names []string, results string, want byte) []string {
+			res := []string{}
+			for i, name := range names {
+				if results[i] == want {
+					res = append(res, name)
+				}
+			}
+			sort.Strings(res)
+			return res
+		}
+		userNames, groupNames := []string{}, []string{}
+		for _, u := range ldapTestUsers {
+			userNames = append(userNames, u.Username)
+		}
+		for _, g := range ldapTestGroups {
+			groupNames = append(groupNames, g.Name)
+		}
+
+		Convey("Translated filters follow the conformance table", func() {
+			for _, tc := range ldapConformanceCases {
+				f, err := parseLDAPFilter(tc.filter)
+				So(err, ShouldBeNil)
+
+				c := ldapFilterCondition(f, userldap2bson, userObjectClasses)
+				So(fmt.Sprintf("%s on users: %v", tc.filter, searchUsers(c.True)), ShouldEqual,
+					fmt.Sprintf("%s on users: %v", tc.filter, expected(userNames, tc.users, 'T')))
+				So(fmt.Sprintf("NOT %s on users: %v", tc.filter, searchUsers(c.False)), ShouldEqual,
+					fmt.Sprintf("NOT %s on users: %v", tc.filter, expected(userNames, tc.users, 'F')))
+
+				c = ldapFilterCondition(f, groupldap2bson, groupObjectClasses)
+				So(fmt.Sprintf("%s on groups: %v", tc.filter, searchGroups(c.True)), ShouldEqual,
+					fmt.Sprintf("%s on groups: %v", tc.filter, expected(groupNames, tc.groups, 'T')))
+				So(fmt.Sprintf("NOT %s on groups: %v", tc.filter, searchGroups(c.False)), ShouldEqual,
+					fmt.Sprintf("NOT %s on groups: %v", tc.filter, expected(groupNames, tc.groups, 'F')))
+			}
+		})
+
+		Convey("evalLDAPFilter follows the conformance table", func() {
+			for _, tc := range ldapConformanceCases {
+				f, err := parseLDAPFilter(tc.filter)
+				So(err, ShouldBeNil)
+				users, groups := "", ""
+				for _, u := range ldapTestUsers {
+					users += string("FTU"[evalLDAPFilter(f, userAttributes(u), userldap2bson)])
+				}
+				for _, g := range ldapTestGroups {
+					groups += string("FTU"[evalLDAPFilter(f, groupAttributes(g), groupldap2bson)])
+				}
+				So(tc.filter+" "+users+" "+groups, ShouldEqual, tc.filter+" "+tc.users+" "+tc.groups)
+			}
+		})
+
+		Convey("Examples of client lookups", func() {
+			user := func(s string) []string {
+				f, err := parseLDAPFilter(s)
+				So(err, ShouldBeNil)
+				return searchUsers(ldapFilterToBson(f, userldap2bson, userObjectClasses))
+			}
+			group := func(s string) []string {
+				f, err := parseLDAPFilter(s)
+				So(err, ShouldBeNil)
+				return searchGroups(ldapFilterToBson(f, groupldap2bson, groupObjectClasses))
+			}
+			So(user("(!(uid=lisi))"), ShouldResemble, []string{"Wang.Wu", "a.b+c", "zhangsan"})
+			So(user("(!(nsUniqueId=x))"), ShouldResemble, []string{})
+			So(user("(&(objectClass=posixGroup)(uid=lisi))"), ShouldResemble, []string{})
+			So(user("(&(objectclass=posixAccount)(uid=LISI))"), ShouldResemble, []string{"lisi"})
+			So(user("(&(objectClass=posixAccount)(|(uid=li.si)(mail=LI.SI@*)))"), ShouldResemble, []string{"lisi"})
+			So(user("(|(!(uidNumber=x))(uid=zhangsan))"), ShouldResemble, []string{"zhangsan"})
+			So(user("(uid=*)"), ShouldResemble, []string{"Wang.Wu", "a.b+c", "lisi", "zhangsan"})
+			So(user("(mail=*)"), ShouldResemble, []string{"a.b+c", "lisi", "zhangsan"})
+			So(user("(!(mail=*))"), ShouldResemble, []string{"Wang.Wu"})
+			So(group("(&(objectClass=posixGroup)(memberUid=lisi))"), ShouldResemble, []string{"dev", "staff"})
+			So(group("(&(objectClass=posixAccount)(memberUid=lisi))"), ShouldResemble, []string{})
+		})
+	})
+}
+
+var ldapTestUsers = []User{
+	{UID: 2000, GID: 2000, Username: "zhangsan", Name: "Zhang San", Email: "zhangsan@example.com", LoginShell: "/bin/bash", IsActive: true},
+	{UID: 2001, GID: 2000, Username: "lisi", Name: "Li Si", Email: "Li.Si@Example.com", LoginShell: "/bin/zsh", IsActive: true},
+	{UID: 2002, GID: 2001, Username: "a.b+c", Email: "ab@example.org", LoginShell: "/bin/bash", IsActive: true},
+	{UID: 3000, GID: 2001, Username: "Wang.Wu", Name: "王五", LoginShell: "/bin/Bash", IsActive: true},
+}
+
+var ldapTestGroups = []PosixGroup{
+	{GID: 2000, Name: "staff", Members: []string{"zhangsan", "lisi"}, IsActive: true},
+	{GID: 2001, Name: "dev", Members: []string{"lisi", "Wang.Wu"}, IsActive: true},
+	{GID: 2010, Name: "Empty", IsActive: true},
+}
+
+// ldapConformanceCases give the result of each filter on ldapTestUsers
+// and ldapTestGroups, one letter per entry in their order: True, False
+// or Undefined. They are worked out from RFC 4515 and RFC 4511 4.5.1.7,
+// with the equality rules the server uses: caseIgnoreMatch for uid, cn,
+// mail and gecos, caseExactMatch for loginShell and memberUid, and
+// integerMatch for uidNumber and gidNumber. Choices the RFCs leave to
+// the server are noted along the cases.
+var ldapConformanceCases = []struct {
+	filter string
+	users  string // zhangsan, lisi, a.b+c, Wang.Wu
+	groups string // staff, dev, Empty
+}{
+	// attribute names are case-insensitive; an entry type only
+	// recognizes the attributes it can be searched by
+	{"(uid=lisi)", "FTFF", "UUU"},
+	{"(uid=LISI)", "FTFF", "UUU"},
+	{"(UID=lisi)", "FTFF", "UUU"},
+	{"(uid=li)", "FFFF", "UUU"},
+	{"(cn=wang.wu)", "FFFT", "FFF"},
+	{"(cn=staff)", "FFFF", "TFF"},
+	{"(cn=STAFF)", "FFFF", "TFF"},
+	// attributes have no empty values, Wang.Wu has no mail and Empty no members
+	{"(mail=)", "FFFF", "UUU"},
+	{"(memberUid=)", "UUUU", "FFF"},
+	// INTEGER has neither spaces nor leading zeros, RFC 4517 3.3.16,
+	// and invalid assertion values are Undefined
+	{"(uidNumber=2001)", "FTFF", "UUU"},
+	{"(uidNumber=02001)", "UUUU", "UUU"},
+	{"(uidNumber= 2001)", "UUUU", "UUU"},
+	{"(uidNumber=abc)", "UUUU", "UUU"},
+	{"(gidNumber=2000)", "TTFF", "TFF"},
+	{"(gidNumber=)", "UUUU", "UUU"},
+	{"(uidNumber>=2001)", "FTTT", "UUU"},
+	{"(uidNumber<=2001)", "TTFF", "UUU"},
+	{"(gidNumber>=2001)", "FFTT", "FTT"},
+	{"(gidNumber<=x)", "UUUU", "UUU"},
+	// strings have no ordering rule in the schema, the server orders octets
+	{"(uid>=m)", "TFFF", "UUU"},
+	{"(uid<=m)", "FTTT", "UUU"},
+	{"(mail<=m)", "FTTF", "UUU"},
+	{"(mail>=)", "TTTF", "UUU"},
+	{"(loginShell>=/bin/c)", "FTFF", "UUU"},
+	// substrings follow the case handling of the equality rule
+	{"(uid=zhang*)", "TFFF", "UUU"},
+	{"(uid=*s*)", "TTFF", "UUU"},
+	{"(uid=*S*)", "TTFF", "UUU"},
+	{"(uid=a.b+*)", "FFTF", "UUU"},
+	{"(uid=a*b*c)", "FFTF", "UUU"},
+	{"(uid=.*)", "FFFF", "UUU"},
+	{"(mail=*@example.com)", "TTFF", "UUU"},
+	{"(mail=*@EXAMPLE.*)", "TTTF", "UUU"},
+	{"(loginShell=*bash)", "TFTF", "UUU"},
+	{"(loginShell=*Bash)", "FFFT", "UUU"},
+	{"(memberUid=lisi)", "UUUU", "TTF"},
+	{"(memberUid=LISI)", "UUUU", "FFF"},
+	{"(memberUid=wang*)", "UUUU", "FFF"},
+	{"(memberUid=Wang*)", "UUUU", "FTF"},
+	{"(gecos=王*)", "FFFT", "UUU"},
+	// integers have no substrings rule
+	{"(uidNumber=20*)", "UUUU", "UUU"},
+	// presence
+	{"(memberUid=*)", "UUUU", "TTF"},
+	{"(gidNumber=*)", "TTTT", "TTT"},
+	{"(gecos=*)", "TTFT", "UUU"},
+	{"(mail=*)", "TTTF", "UUU"},
+	{"(uid=*)", "TTTT", "UUU"},
+	// approximate matches ignore case, except for integers
+	{"(uid~=LISI)", "FTFF", "UUU"},
+	{"(loginShell~=/BIN/BASH)", "TFTT", "UUU"},
+	{"(uidNumber~=2000)", "TFFF", "UUU"},
+	{"(memberUid~=LISI)", "UUUU", "TTF"},
+	// extensible matches use the equality rule without a matching rule,
+	// rules for another syntax or unknown ones are Undefined, and so are
+	// matches without a type, which the server does not implement. The
+	// RDNs are attributes of the entries, so dnAttributes adds nothing.
+	{"(uid:=lisi)", "FTFF", "UUU"},
+	{"(uid:=LISI)", "FTFF", "UUU"},
+	{"(uid:caseExactMatch:=LISI)", "FFFF", "UUU"},
+	{"(uid:2.5.13.2:=LISI)", "FTFF", "UUU"},
+	{"(uid:dn:caseIgnoreMatch:=LISI)", "FTFF", "UUU"},
+	{"(uidNumber:integerMatch:=2002)", "FFTF", "UUU"},
+	{"(uidNumber:caseIgnoreMatch:=2002)", "UUUU", "UUU"},
+	{"(uid:integerMatch:=2002)", "UUUU", "UUU"},
+	{"(uid:unknownMatch:=lisi)", "UUUU", "UUU"},
+	{"(:caseIgnoreMatch:=lisi)", "UUUU", "UUU"},
+	{"(memberUid:caseIgnoreMatch:=LISI)", "UUUU", "TTF"},
+	// attributes which cannot be searched and unknown ones
+	{"(homeDirectory=/home/lisi)", "UUUU", "UUU"},
+	{"(userPassword=*)", "UUUU", "UUU"},
+	{"(nsUniqueId=*)", "UUUU", "UUU"},
+	{"(!(nsUniqueId=x))", "UUUU", "UUU"},
+	{"(!(uidNumber=x))", "UUUU", "UUU"},
+	// objectClass is compared by name with the classes the entry
+	// publishes, and has no ordering or substrings rule
+	{"(objectClass=posixAccount)", "TTTT", "FFF"},
+	{"(objectclass=POSIXACCOUNT)", "TTTT", "FFF"},
+	{"(objectClass=posixGroup)", "FFFF", "TTT"},
+	{"(objectClass=top)", "TTTT", "TTT"},
+	{"(objectClass=inetOrgPerson)", "FFFF", "FFF"},
+	{"(objectClass=*)", "TTTT", "TTT"},
+	{"(objectClass=posix*)", "UUUU", "UUU"},
+	{"(objectClass>=a)", "UUUU", "UUU"},
+	{"(objectClass~=posixaccount)", "TTTT", "FFF"},
+	{"(objectClass:=posixAccount)", "TTTT", "FFF"},
+	{"(objectClass:caseExactMatch:=posixAccount)", "UUUU", "UUU"},
+	{"(!(objectClass=posixAccount))", "FFFF", "TTT"},
+	{"(!(objectClass=posix*))", "UUUU", "UUU"},
+	// absolute True and False, RFC 4526
+	{"(&)", "TTTT", "TTT"},
+	{"(|)", "FFFF", "FFF"},
+	{"(!(&))", "FFFF", "FFF"},
+	{"(!(|))", "TTTT", "TTT"},
+	// NOT swaps True and False and keeps Undefined
+	{"(!(uid=lisi))", "TFTT", "UUU"},
+	{"(!(!(uid=lisi)))", "FTFF", "UUU"},
+	{"(!(mail=*))", "FFFT", "UUU"},
+	{"(!(memberUid=lisi))", "UUUU", "FFT"},
+	// AND is False if a child is False, else Undefined if one is;
+	// OR is True if a child is True, else Undefined if one is
+	{"(&(objectClass=posixAccount)(uid=lisi))", "FTFF", "FFF"},
+	{"(&(objectClass=posixGroup)(uid=lisi))", "FFFF", "UUU"},
+	{"(&(objectClass=posixGroup)(cn=dev))", "FFFF", "FTF"},
+	{"(|(uid=lisi)(nsUniqueId=x))", "UTUU", "UUU"},
+	{"(&(uid=lisi)(nsUniqueId=x))", "FUFF", "UUU"},
+	{"(!(|(uid=lisi)(nsUniqueId=x)))", "UFUU", "UUU"},
+	{"(!(&(uid=lisi)(nsUniqueId=x)))", "TUTT", "UUU"},
+	{"(&(uid=*)(!(uid=lisi))(uidNumber<=2001))", "TFFF", "UUU"},
+	{"(|(!(uidNumber=x))(uid=zhangsan))", "TUUU", "UUU"},
+	{"(&(!(uidNumber=x))(uid=zhangsan))", "UFFF", "UUU"},
+	{"(|(&(gidNumber=2000)(!(cn=staff)))(memberUid=Wang.Wu))", "TTUU", "FTF"},
+	{"(!(|(cn=dev)(memberUid=zhangsan)))", "UUUU", "FFT"},
+	{"(&(objectClass=inetOrgPerson)(|(uid=lisi)(mail=lisi)))", "FFFF", "FFF"},
+	{"(|(objectClass=inetOrgPerson)(uid=lisi))", "FTFF", "UUU"},
+	{"(&(objectClass=posixAccount)(|(uid=li.si)(mail=li.si*)))", "FTFF", "FFF"},
+	{"(!(&(objectClass=posix*)(uid=lisi)))", "TUTT", "UUU"},
+	{"(|(objectClass=posix*)(uid=lisi))", "UTUU", "UUU"},
+	{"(&(|(objectClass=posix*)(uid=lisi))(uidNumber>=2000))", "UTUU", "UUU"},
+}
@@ -0,0 +1,190 @@
+// simple paged results control of RFC 2696
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+const pagedResultsOID = "1.2.840.113556.1.4.319"
+
+// idle cursors are dropped after pagedCursorTTL, as ldapserver
+// does not tell when a connection is closed
+const (
+	pagedCursorTTL  = 10 * time.Minute
+	maxPagedCursors = 16
+)
+
+var (
+	errInvalidCookie     = errors.New("Invalid paged results cookie")
+	errPagingUnavailable = errors.New("Paged results are not available")
+)
+
+// pagedControl is the value of the paged results control
+type pagedControl struct {
+	Size   int
+	Cookie []byte
+}
+
+func parsePagedControl(value []byte) (pagedControl, error) {
+	p := pagedControl{}
+	tag, content, _, err := berRead(value)
+	if err != nil || tag != berSequence {
+		return p, errBERSyntax
+	}
+	tag, size, content, err := berRead(content)
+	if err != nil || tag != berInteger {
+		return p, errBERSyntax
+	}
+	if p.Size, err = berDecodeInteger(size); err != nil {
+		return p, err
+	}
+	tag, cookie, _, err := berRead(content)
+	if err != nil || tag != berOctetString {
+		return p, errBERSyntax
+	}
+	p.Cookie = cookie
+	return p, nil
+}
+
+func (p pagedControl) encode() []byte {
+	content := append(berEncodeInteger(p.Size), berTLV(berOctetString, p.Cookie)...)
+	return berTLV(berSequence, content)
+}
+
+// A pagedCursor is where a paged search resumes, it is only valid for
+// the same search on the same connection
+type pagedCursor struct {
+	Search  string
+	Last    ldapPosition
+	Expires time.Time
+}
+
+// pagedCursors holds the cursors of each connection by cookie
+type pagedCursors struct {
+	sync.Mutex
+	conns map[interface{}]map[string]pagedCursor
+}
+
+var ldapCursors = &pagedCursors{conns: map[interface{}]map[string]pagedCursor{}}
+
+// take removes and returns the cursor of a cookie
+func (c *pagedCursors) take(conn interface{}, cookie string) (pagedCursor, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cursor, ok := c.conns[conn][cookie]
+	delete(c.conns[conn], cookie)
+	if ok && time.Now().After(cursor.Expires) {
+		return cursor, false
+	}
+	return cursor, ok
+}
+
+// put saves a cursor and returns its cookie
+func (c *pagedCursors) put(conn interface{}, cursor pagedCursor) string {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for key, cursors := range c.conns {
+		for cookie, cur := range cursors {
+			if now.After(cur.Expires) {
+				delete(cursors, cookie)
+			}
+		}
+		if len(cursors) == 0 {
+			delete(c.conns, key)
+		}
+	}
+
+	cursors := c.conns[conn]
+	if cursors == nil {
+		cursors = map[string]pagedCursor{}
+		c.conns[conn] = cursors
+	}
+	if len(cursors) >= maxPagedCursors {
+		// drop the cursor expiring first
+		oldest := ""
+		for cookie, cur := range cursors {
+			if oldest == "" || cur.Expires.Before(cursors[oldest].Expires) {
+				oldest = cookie
+			}
+		}
+		delete(cursors, oldest)
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	cookie := hex.EncodeToString(b)
+	cursor.Expires = now.Add(pagedCursorTTL)
+	cursors[cookie] = cursor
+	return cookie
+}
+
+// A pagedSearch is a search with the paged results control
+type pagedSearch struct {
+	conn   interface{}
+	search string
+	size   int
+}
+
+// newPagedSearch sets up paging of s if the request has the control.
+// If w cannot send the control back, it is ignored unless critical
+// as in RFC 2696.
+func newPagedSearch(w ldap.ResponseWriter, m *ldap.Message, r ldapMsg.SearchRequest, s *ldapSearch) (*pagedSearch, error) {
+	control, ok := requestControl(m, pagedResultsOID)
+	if !ok {
+		return nil, nil
+	}
+	if !canWriteMessages(w) {
+		if control.Critical {
+			return nil, errPagingUnavailable
+		}
+		logger.Warningf("Responses to %T cannot carry controls, ignoring paged results", w)
+		return nil, nil
+	}
+	value, err := parsePagedControl(control.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pagedSearch{
+		conn: m.Client,
+		search: fmt.Sprintf(
+			"%s|%d|%s|%v|%v", r.BaseObject(), r.Scope(), r.FilterString(), r.Attributes(), r.TypesOnly(),
+		),
+		size: value.Size,
+	}
+	if len(value.Cookie) > 0 {
+		cursor, ok := ldapCursors.take(p.conn, string(value.Cookie))
+		if !ok || cursor.Search != p.search {
+			return nil, errInvalidCookie
+		}
+		s.Resume = &cursor.Last
+	}
+	s.PageSize = p.size
+	return p, nil
+}
+
+// abandoned tells whether the client gives up the search,
+// which is done by asking for an empty page
+func (p *pagedSearch) abandoned() bool {
+	return p.size <= 0
+}
+
+// response is the control of the last page, its cookie is empty
+// once all entries are sent
+func (p *pagedSearch) response(s *ldapSearch) ldapControl {
+	value := pagedControl{Cookie: []byte{}}
+	if s.More && s.Code == ldap.LDAPResultSuccess {
+		value.Cookie = []byte(ldapCursors.put(p.conn, pagedCursor{Search: p.search, Last: s.Last}))
+	}
+	return ldapControl{OID: pagedResultsOID, Value: value.encode()}
+}
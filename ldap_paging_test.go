@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPPaging(t *testing.T) {
+	Convey("Control values are encoded in BER", t, func() {
+		for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, -1, -129, 1 << 30} {
+			tag, content, rest, err := berRead(berEncodeInteger(n))
+			So(err, ShouldBeNil)
+			So(tag, ShouldEqual, berInteger)
+			So(len(rest), ShouldEqual, 0)
+			v, err := berDecodeInteger(content)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, n)
+		}
+
+		cookie := make([]byte, 300)
+		p, err := parsePagedControl(pagedControl{Size: 500, Cookie: cookie}.encode())
+		So(err, ShouldBeNil)
+		So(p.Size, ShouldEqual, 500)
+		So(p.Cookie, ShouldResemble, cookie)
+
+		for _, bad := range [][]byte{
+			nil, {0x30}, {0x30, 0x03, 0x02, 0x01}, {0x04, 0x00},
+			{0x30, 0x02, 0x02, 0x00}, {0x30, 0x03, 0x02, 0x01, 0x05},
+		} {
+			_, err := parsePagedControl(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Responses carry controls", t, func() {
+		done := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+		control := ldapControl{OID: pagedResultsOID, Value: pagedControl{Cookie: []byte("abc")}.encode()}
+		msg, err := messageWithControls(7, done, []ldapControl{control})
+		So(err, ShouldBeNil)
+		So(msg.MessageID().Int(), ShouldEqual, 7)
+		So(msg.Controls(), ShouldNotBeNil)
+		controls := *msg.Controls()
+		So(len(controls), ShouldEqual, 1)
+		So(string(controls[0].ControlType()), ShouldEqual, pagedResultsOID)
+		p, err := parsePagedControl([]byte(*controls[0].ControlValue()))
+		So(err, ShouldBeNil)
+		So(string(p.Cookie), ShouldEqual, "abc")
+	})
+
+	Convey("Clients receive the cookies of paged searches", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		dcfg.DB.Backend = DBEnumMemory
+		So(initStore(), ShouldBeNil)
+		m := getStore()
+		for _, u := range ldapTestUsers {
+			So(m.InsertUser(u), ShouldBeNil)
+		}
+		m.Close()
+
+		conn, stop := dialTestLDAPServer()
+		defer stop()
+
+		search := berTLV(berOctetString, []byte("ou=people,o=tuna"))
+		search = append(search, berTLV(0x0a, []byte{2})...)
+		search = append(search, berTLV(0x0a, []byte{0})...)
+		search = append(search, berEncodeInteger(0)...)
+		search = append(search, berEncodeInteger(0)...)
+		search = append(search, berTLV(berBoolean, []byte{0})...)
+		search = append(search, berTLV(0x87, []byte("uid"))...)
+		search = append(search, berTLV(berSequence, nil)...)
+
+		var cookie []byte
+		entries := 0
+		for messageID := 1; messageID < 10; messageID++ {
+			paged := pagedControl{Size: 1, Cookie: cookie}
+			ldapSend(conn, messageID, 0x63, search, []ldapControl{{OID: pagedResultsOID, Value: paged.encode()}})
+			for {
+				tag, res, controls := ldapReadResponse(conn, messageID)
+				if tag == 0x64 {
+					entries++
+					continue
+				}
+				So(tag, ShouldEqual, 0x65)
+				So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultSuccess)
+				So(controls, ShouldNotBeNil)
+
+				_, control, _, err := berRead(controls)
+				So(err, ShouldBeNil)
+				_, oid, rest, err := berRead(control)
+				So(err, ShouldBeNil)
+				So(string(oid), ShouldEqual, pagedResultsOID)
+				_, value, _, err := berRead(rest)
+				So(err, ShouldBeNil)
+				p, err := parsePagedControl(value)
+				So(err, ShouldBeNil)
+				cookie = p.Cookie
+				break
+			}
+			if len(cookie) == 0 {
+				break
+			}
+		}
+		So(len(cookie), ShouldEqual, 0)
+		So(entries, ShouldEqual, len(ldapTestUsers))
+
+		Convey("Paging is ignored if responses cannot carry controls", func() {
+			conn, stop := dialLDAPServerWith(opOnlyHandler{ldapRoutes()})
+			defer stop()
+			run := func(messageID int, control ldapControl) (sent int, code int, controls []byte) {
+				ldapSend(conn, messageID, 0x63, search, []ldapControl{control})
+				for {
+					tag, res, controls := ldapReadResponse(conn, messageID)
+					if tag != 0x64 {
+						So(tag, ShouldEqual, 0x65)
+						return sent, ldapResultCode(res), controls
+					}
+					sent++
+				}
+			}
+			paged := ldapControl{OID: pagedResultsOID, Value: pagedControl{Size: 1}.encode()}
+			entries, code, controls := run(1, paged)
+			So(code, ShouldEqual, ldap.LDAPResultSuccess)
+			So(entries, ShouldEqual, len(ldapTestUsers))
+			So(controls, ShouldBeNil)
+
+			paged.Critical = true
+			entries, code, _ = run(2, paged)
+			So(code, ShouldEqual, ldap.LDAPResultUnavailableCriticalExtension)
+			So(entries, ShouldEqual, 0)
+		})
+	})
+
+	for name, backend := range map[string]dbBackendEnum{"memory": DBEnumMemory, "bolt": DBEnumBolt} {
+		testPagedSearch(t, name, backend)
+	}
+
+	Convey("Cursors belong to a connection", t, func() {
+		c := &pagedCursors{conns: map[interface{}]map[string]pagedCursor{}}
+		last := ldapPosition{Source: sourcePeople, ID: 2001}
+		cookie := c.put("a", pagedCursor{Search: "s", Last: last})
+
+		_, ok := c.take("b", cookie)
+		So(ok, ShouldBeFalse)
+		cursor, ok := c.take("a", cookie)
+		So(ok, ShouldBeTrue)
+		So(cursor.Last, ShouldResemble, last)
+		_, ok = c.take("a", cookie)
+		So(ok, ShouldBeFalse)
+
+		cookie = c.put("a", pagedCursor{Search: "s"})
+		c.conns["a"][cookie] = pagedCursor{Search: "s", Expires: time.Now().Add(-time.Second)}
+		_, ok = c.take("a", cookie)
+		So(ok, ShouldBeFalse)
+
+		cookies := []string{}
+		for i := 0; i <= maxPagedCursors; i++ {
+			cookies = append(cookies, c.put("a", pagedCursor{Search: "s"}))
+		}
+		So(len(c.conns["a"]), ShouldEqual, maxPagedCursors)
+		_, ok = c.take("a", cookies[len(cookies)-1])
+		So(ok, ShouldBeTrue)
+	})
+}
+
+func testPagedSearch(t *testing.T, name string, backend dbBackendEnum) {
+	Convey("Paged searches on the "+name+" store resume after the last page", t, func() {
+		tmpdir, err := ioutil.TempDir("", "tunaccount")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		c := dcfg.DB
+		c.Backend = backend
+		c.Path = filepath.Join(tmpdir, "tunaccount.db")
+		m, err := openStore(c, false)
+		So(err, ShouldBeNil)
+		defer m.Close()
+		for _, u := range ldapTestUsers {
+			So(m.InsertUser(u), ShouldBeNil)
+		}
+		for _, g := range ldapTestGroups {
+			So(m.InsertGroup(g), ShouldBeNil)
+		}
+		// tagged groups interleave with universal ones by GID
+		So(m.InsertTag(FilterTag{Name: "ci"}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 1990, Name: "ci", Tag: "ci", IsActive: true}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2005, Name: "runner", Tag: "ci", IsActive: true}), ShouldBeNil)
+		f, err := parseLDAPFilter("(objectClass=*)")
+		So(err, ShouldBeNil)
+
+		search := func(dn string, pageSize int) []string {
+			parsed, err := parseDN(dn)
+			So(err, ShouldBeNil)
+			base, err := resolveLDAPBase(parsed)
+			So(err, ShouldBeNil)
+			dns := []string{}
+			var resume *ldapPosition
+			for pages := 1; ; pages++ {
+				So(pages, ShouldBeLessThan, 20)
+				s := &ldapSearch{
+					Scope:    ldapMsg.SearchRequestHomeSubtree,
+					Filter:   f,
+					PageSize: pageSize,
+					Resume:   resume,
+					write:    func(e ldapEntry) { dns = append(dns, e.DN) },
+					done:     func() bool { return false },
+				}
+				So(s.run(m, base), ShouldBeNil)
+				So(s.Code, ShouldEqual, ldap.LDAPResultSuccess)
+				if pageSize > 0 {
+					So(s.Sent, ShouldBeLessThanOrEqualTo, pageSize)
+				}
+				if !s.More {
+					return dns
+				}
+				last := s.Last
+				resume = &last
+			}
+		}
+
+		for _, dn := range []string{"o=tuna", "ou=groups,tag=ci,o=tuna"} {
+			all := search(dn, 0)
+			So(search(dn, 2), ShouldResemble, all)
+			seen := map[string]bool{}
+			for _, dn := range all {
+				So(seen[dn], ShouldBeFalse)
+				seen[dn] = true
+			}
+		}
+		So(len(search("ou=groups,tag=ci,o=tuna", 0)), ShouldEqual, 1+len(ldapTestGroups)+2)
+	})
+}
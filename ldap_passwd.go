@@ -0,0 +1,206 @@
+// Password Modify extended operation of RFC 3062
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tags of the fields of PasswdModifyRequestValue
+const (
+	berUserIdentity = 0x80
+	berOldPasswd    = 0x81
+	berNewPasswd    = 0x82
+	berGenPasswd    = 0x80
+)
+
+const (
+	generatedPasswordLength = 16
+	passwordAlphabet        = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+)
+
+// A passwdModifyRequest is the value of a Password Modify request,
+// the old password is only verified if HasOld is set
+type passwdModifyRequest struct {
+	UserIdentity string
+	OldPasswd    string
+	HasOld       bool
+	NewPasswd    string
+}
+
+func parsePasswdModifyRequest(value []byte) (passwdModifyRequest, error) {
+	req := passwdModifyRequest{}
+	// all fields are optional, and so is the value
+	if value == nil {
+		return req, nil
+	}
+	tag, content, _, err := berRead(value)
+	if err != nil || tag != berSequence {
+		return req, errBERSyntax
+	}
+	for len(content) > 0 {
+		var field []byte
+		tag, field, content, err = berRead(content)
+		if err != nil {
+			return req, err
+		}
+		switch tag {
+		case berUserIdentity:
+			req.UserIdentity = string(field)
+		case berOldPasswd:
+			req.OldPasswd, req.HasOld = string(field), true
+		case berNewPasswd:
+			req.NewPasswd = string(field)
+		default:
+			return req, errBERSyntax
+		}
+	}
+	return req, nil
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, generatedPasswordLength)
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// passwdTarget is the username of the userIdentity of a request,
+// which is either a DN or a username
+func passwdTarget(identity string) (string, bool) {
+	dn, err := parseDN(identity)
+	if err != nil || len(dn) == 0 {
+		return identity, true
+	}
+	base, err := resolveLDAPBase(dn)
+	if err != nil || base.OU != "people" || base.Attr == "" {
+		return "", false
+	}
+	return base.Val, true
+}
+
+// handlePasswordModify changes the password of the bound user, or of
+// anyone if the bound user is an admin as in the HTTP API
+func handlePasswordModify(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	fail := func(code int, msg string) {
+		res.SetResultCode(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	}
+
+	conn := connOf(m)
+	id := conn.identity()
+	switch {
+	case dcfg.ReadOnly:
+		fail(ldap.LDAPResultUnwillingToPerform, "Server is read-only")
+		return
+	case dcfg.LDAP.RequireTLS && !conn.isTLS():
+		fail(ldap.LDAPResultConfidentialityRequired, "Password changes require TLS")
+		return
+	case id == nil:
+		fail(ldap.LDAPResultUnwillingToPerform, "Bind required")
+		return
+	}
+
+	r := m.GetExtendedRequest()
+	var value []byte
+	if v := r.RequestValue(); v != nil {
+		value = []byte(*v)
+	}
+	req, err := parsePasswdModifyRequest(value)
+	if err != nil {
+		fail(ldap.LDAPResultProtocolError, err.Error())
+		return
+	}
+	// nobody would know a generated password which cannot be returned
+	if req.NewPasswd == "" && !canWriteMessages(w) {
+		fail(ldap.LDAPResultUnwillingToPerform, "Generated passwords cannot be returned, a new password is required")
+		return
+	}
+
+	mg := getStore()
+	defer mg.Close()
+
+	// the bound user may have lost its privileges since the bind
+	if id = conn.currentIdentity(mg); id == nil {
+		fail(ldap.LDAPResultInsufficientAccessRights, "Permission denied")
+		return
+	}
+
+	username := id.Username
+	if req.UserIdentity != "" {
+		var ok bool
+		if username, ok = passwdTarget(req.UserIdentity); !ok {
+			fail(ldap.LDAPResultNoSuchObject, "No such user")
+			return
+		}
+	}
+
+	target, found := findLDAPUser(mg, username)
+	switch {
+	case !found:
+		fail(ldap.LDAPResultNoSuchObject, "No such user")
+		return
+	case target.Username != id.Username && !id.IsAdmin:
+		fail(ldap.LDAPResultInsufficientAccessRights, "Permission denied")
+		return
+	case req.HasOld && !target.Authenticate(req.OldPasswd):
+		fail(ldap.LDAPResultInvalidCredentials, "invalid credentials")
+		return
+	}
+
+	newPass := req.NewPasswd
+	var msg *ldapMsg.LDAPMessage
+	if newPass == "" {
+		if newPass, err = generatePassword(); err != nil {
+			logger.Errorf("Failed to generate password: %s", err.Error())
+			fail(ldap.LDAPResultOther, err.Error())
+			return
+		}
+		// the generated password is returned as genPasswd, the response
+		// is encoded before the change so that it cannot fail afterwards
+		value = berTLV(berSequence, berTLV(berGenPasswd, []byte(newPass)))
+		if msg, err = extendedResponseWithValue(m.MessageID().Int(), res, value); err != nil {
+			logger.Errorf("Failed to encode generated password: %s", err.Error())
+			fail(ldap.LDAPResultOther, err.Error())
+			return
+		}
+	}
+
+	before, after, err := modifyUser(mg, bson.M{"_id": target.UID, "deleted": nil}, func(u *User) error {
+		u.Passwd(newPass)
+		return nil
+	})
+	switch err {
+	case nil:
+	case errNotFound:
+		fail(ldap.LDAPResultNoSuchObject, "No such user")
+		return
+	default:
+		logger.Errorf("Failed to update password: %s", err.Error())
+		fail(ldap.LDAPResultOther, err.Error())
+		return
+	}
+	writeAudit(mg, conn.actor(), "user.passwd", auditTargetUser, after.Username, before, after)
+	logger.Debugf("Password of %s updated by %s", after.Username, id.Username)
+
+	if msg == nil {
+		w.Write(res)
+		return
+	}
+	if err := writeMessage(w, msg); err != nil {
+		// not expected, as canWriteMessages was checked
+		logger.Errorf("Failed to write generated password of %s: %s", after.Username, err.Error())
+	}
+}
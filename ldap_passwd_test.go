@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPPasswordModify(t *testing.T) {
+	Convey("Password Modify requests are parsed", t, func() {
+		req, err := parsePasswdModifyRequest(nil)
+		So(err, ShouldBeNil)
+		So(req, ShouldResemble, passwdModifyRequest{})
+
+		value := berTLV(berUserIdentity, []byte("uid=lisi,ou=people,o=tuna"))
+		value = append(value, berTLV(berOldPasswd, nil)...)
+		value = append(value, berTLV(berNewPasswd, []byte("new"))...)
+		req, err = parsePasswdModifyRequest(berTLV(berSequence, value))
+		So(err, ShouldBeNil)
+		So(req, ShouldResemble, passwdModifyRequest{
+			UserIdentity: "uid=lisi,ou=people,o=tuna", HasOld: true, NewPasswd: "new",
+		})
+
+		for _, bad := range [][]byte{{0x30}, berTLV(berOctetString, nil), berTLV(berSequence, berTLV(0x83, nil))} {
+			_, err := parsePasswdModifyRequest(bad)
+			So(err, ShouldNotBeNil)
+		}
+
+		p, err := generatePassword()
+		So(err, ShouldBeNil)
+		So(len(p), ShouldEqual, generatedPasswordLength)
+	})
+
+	Convey("Users change passwords over LDAP", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		dcfg.DB.Backend = DBEnumMemory
+		So(initStore(), ShouldBeNil)
+		m := getStore()
+		defer m.Close()
+		So(m.InsertUser(*(&User{UID: 2000, Username: "lisi", Email: "lisi@tuna.tsinghua.edu.cn", IsActive: true}).Passwd("old")), ShouldBeNil)
+		So(m.InsertUser(*(&User{UID: 2001, Username: "zhangsan", Email: "zhangsan@tuna.tsinghua.edu.cn", IsActive: true}).Passwd("pass")), ShouldBeNil)
+
+		username, ok := passwdTarget("LiSi")
+		So(ok, ShouldBeTrue)
+		So(username, ShouldEqual, "LiSi")
+		username, ok = passwdTarget("uid=lisi,ou=people,o=tuna")
+		So(ok, ShouldBeTrue)
+		So(username, ShouldEqual, "lisi")
+		_, ok = passwdTarget("cn=dev,ou=groups,o=tuna")
+		So(ok, ShouldBeFalse)
+
+		conn, stop := dialTestLDAPServer()
+		defer stop()
+		messageID := 0
+		modify := func(fields ...[]byte) (int, []byte) {
+			value := []byte{}
+			for _, f := range fields {
+				value = append(value, f...)
+			}
+			op := berTLV(0x80, []byte(ldap.NoticeOfPasswordModify))
+			op = append(op, berTLV(0x81, berTLV(berSequence, value))...)
+			messageID++
+			tag, res := ldapRoundTrip(conn, messageID, 0x77, op)
+			So(tag, ShouldEqual, 0x78)
+
+			// resultCode, matchedDN, diagnosticMessage, then the value
+			code := ldapResultCode(res)
+			var field []byte
+			for res != nil && len(res) > 0 {
+				tag, field, res, _ = berRead(res)
+				if tag == berResponseValue {
+					return code, field
+				}
+			}
+			return code, nil
+		}
+		authenticates := func(username, password string) bool {
+			users := m.FindUsers(bson.M{"username": username}, "")
+			So(len(users), ShouldEqual, 1)
+			return users[0].Authenticate(password)
+		}
+
+		code, _ := modify(berTLV(berNewPasswd, []byte("new")))
+		So(code, ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+
+		bind := append(berEncodeInteger(3), berTLV(berOctetString, []byte("uid=lisi,ou=people,o=tuna"))...)
+		bind = append(bind, berTLV(0x80, []byte("old"))...)
+		messageID++
+		_, res := ldapRoundTrip(conn, messageID, 0x60, bind)
+		So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultSuccess)
+
+		code, _ = modify(berTLV(berOldPasswd, []byte("wrong")), berTLV(berNewPasswd, []byte("new")))
+		So(code, ShouldEqual, ldap.LDAPResultInvalidCredentials)
+		code, _ = modify(berTLV(berUserIdentity, []byte("zhangsan")), berTLV(berNewPasswd, []byte("new")))
+		So(code, ShouldEqual, ldap.LDAPResultInsufficientAccessRights)
+		So(authenticates("zhangsan", "pass"), ShouldBeTrue)
+
+		code, value := modify(berTLV(berOldPasswd, []byte("old")), berTLV(berNewPasswd, []byte("new")))
+		So(code, ShouldEqual, ldap.LDAPResultSuccess)
+		So(value, ShouldBeNil)
+		So(authenticates("lisi", "new"), ShouldBeTrue)
+
+		code, value = modify()
+		So(code, ShouldEqual, ldap.LDAPResultSuccess)
+		tag, gen, _, err := berRead(value)
+		So(err, ShouldBeNil)
+		So(tag, ShouldEqual, berSequence)
+		tag, gen, _, err = berRead(gen)
+		So(err, ShouldBeNil)
+		So(tag, ShouldEqual, berGenPasswd)
+		So(len(gen), ShouldEqual, generatedPasswordLength)
+		So(authenticates("lisi", string(gen)), ShouldBeTrue)
+
+		// privileges are read on each request, not kept from the bind
+		update := func(fn func(u *User)) {
+			users, err := m.ListUsers(bson.M{"username": "lisi"})
+			So(err, ShouldBeNil)
+			fn(&users[0])
+			So(m.UpdateUser(users[0]), ShouldBeNil)
+		}
+		update(func(u *User) { u.IsAdmin = true })
+		code, _ = modify(berTLV(berUserIdentity, []byte("zhangsan")), berTLV(berNewPasswd, []byte("new")))
+		So(code, ShouldEqual, ldap.LDAPResultSuccess)
+		So(authenticates("zhangsan", "new"), ShouldBeTrue)
+		update(func(u *User) { u.IsActive = false })
+		code, _ = modify(berTLV(berUserIdentity, []byte("zhangsan")), berTLV(berNewPasswd, []byte("newer")))
+		So(code, ShouldEqual, ldap.LDAPResultInsufficientAccessRights)
+		So(authenticates("zhangsan", "new"), ShouldBeTrue)
+
+		// generated passwords are refused if responses cannot carry them
+		opConn, stopOp := dialLDAPServerWith(opOnlyHandler{ldapRoutes()})
+		defer stopOp()
+		conn = opConn
+		bind = append(berEncodeInteger(3), berTLV(berOctetString, []byte("uid=zhangsan,ou=people,o=tuna"))...)
+		bind = append(bind, berTLV(0x80, []byte("new"))...)
+		messageID++
+		_, res = ldapRoundTrip(conn, messageID, 0x60, bind)
+		So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultSuccess)
+		code, _ = modify()
+		So(code, ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+		So(authenticates("zhangsan", "new"), ShouldBeTrue)
+		code, _ = modify(berTLV(berNewPasswd, []byte("newer")))
+		So(code, ShouldEqual, ldap.LDAPResultSuccess)
+		So(authenticates("zhangsan", "newer"), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,113 @@
+// LDAPS and StartTLS
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// ldapTLSConfig is used by the LDAPS listener and StartTLS,
+// it is nil if TLS is not configured
+var ldapTLSConfig *tls.Config
+
+const startTLSTimeout = 30 * time.Second
+
+func validateLDAPConfig(cfg LDAPConfig) error {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("Both tls_cert and tls_key are required for LDAP over TLS")
+	}
+	if cfg.TLSCert == "" {
+		switch {
+		case cfg.TLSListenPort > 0:
+			return errors.New("LDAPS listener requires tls_cert and tls_key")
+		case cfg.RequireTLS:
+			return errors.New("require_tls requires tls_cert and tls_key")
+		case cfg.TLSClientCA != "":
+			return errors.New("tls_client_ca requires tls_cert and tls_key")
+		}
+	}
+	return nil
+}
+
+// makeLDAPTLSConfig loads the certificates of cfg,
+// it returns nil if TLS is not configured
+func makeLDAPTLSConfig(cfg LDAPConfig) (*tls.Config, error) {
+	if cfg.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", cfg.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func handleStartTLS(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	res.SetResponseName(ldap.NoticeOfStartTLS)
+	switch {
+	case ldapTLSConfig == nil:
+		res.SetResultCode(ldap.LDAPResultUnavailable)
+		res.SetDiagnosticMessage("TLS is not configured")
+		w.Write(res)
+		return
+	case connOf(m).isTLS():
+		res.SetResultCode(ldap.LDAPResultOperationsError)
+		res.SetDiagnosticMessage("TLS is already established")
+		w.Write(res)
+		return
+	}
+
+	// the response must be sent in clear before the handshake, so it
+	// is written to the connection rather than queued by ldapserver
+	c := connOf(m)
+	conn := c.raw()
+	msg := ldapMsg.NewLDAPMessageWithProtocolOp(res)
+	msg.SetMessageID(m.MessageID().Int())
+	data, err := msg.Write()
+	if err != nil {
+		logger.Errorf("Failed to encode StartTLS response: %s", err.Error())
+		return
+	}
+	if _, err := conn.Write(data.Bytes()); err != nil {
+		logger.Errorf("Failed to send StartTLS response: %s", err.Error())
+		return
+	}
+
+	tlsConn := tls.Server(conn, ldapTLSConfig)
+	conn.SetDeadline(time.Now().Add(startTLSTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		// the connection is unusable once the handshake fails
+		logger.Warningf("StartTLS handshake with %s failed: %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c.setRaw(tlsConn)
+	// renew the buffers of ldapserver
+	m.Client.SetConn(c)
+	logger.Debugf("StartTLS with %s established", conn.RemoteAddr())
+}
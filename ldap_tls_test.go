@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir
+func writeTestCert(dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+
+	certFile, keyFile = filepath.Join(dir, "ldap.crt"), filepath.Join(dir, "ldap.key")
+	So(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), ShouldBeNil)
+	So(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), ShouldBeNil)
+	return certFile, keyFile
+}
+
+// dialTestLDAPServer starts a plain LDAP server and connects to it
+func dialTestLDAPServer() (net.Conn, func()) {
+	return dialLDAPServerWith(ldapRoutes())
+}
+
+// dialLDAPServerWith serves requests with handler
+func dialLDAPServerWith(handler ldap.Handler) (net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+	addr := l.Addr().String()
+	l.Close()
+	server := serveLDAP(addr, nil, handler)
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	So(err, ShouldBeNil)
+	return conn, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+// opWriter hides the MessageWriter of ldapserver,
+// like ResponseWriters which only write protocol ops
+type opWriter struct {
+	w ldap.ResponseWriter
+}
+
+func (w opWriter) Write(po ldapMsg.ProtocolOp) { w.w.Write(po) }
+
+// opOnlyHandler serves requests with opWriters
+type opOnlyHandler struct {
+	ldap.Handler
+}
+
+func (h opOnlyHandler) ServeLDAP(w ldap.ResponseWriter, m *ldap.Message) {
+	h.Handler.ServeLDAP(opWriter{w}, m)
+}
+
+// ldapRoundTrip sends a request and returns the protocol op of its response
+func ldapRoundTrip(conn net.Conn, messageID int, tag byte, op []byte) (byte, []byte) {
+	ldapSend(conn, messageID, tag, op, nil)
+	tag, op, _ = ldapReadResponse(conn, messageID)
+	return tag, op
+}
+
+// ldapSend sends a request with controls
+func ldapSend(conn net.Conn, messageID int, tag byte, op []byte, controls []ldapControl) {
+	content := append(berEncodeInteger(messageID), berTLV(tag, op)...)
+	if controls != nil {
+		encoded := []byte{}
+		for _, c := range controls {
+			encoded = append(encoded, c.encode()...)
+		}
+		content = append(content, berTLV(berControls, encoded)...)
+	}
+	_, err := conn.Write(berTLV(berSequence, content))
+	So(err, ShouldBeNil)
+}
+
+// ldapReadResponse reads a response, and returns its protocol op and
+// the encoded controls if any
+func ldapReadResponse(conn net.Conn, messageID int) (byte, []byte, []byte) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	So(err, ShouldBeNil)
+	size := []byte{}
+	n := int(header[1])
+	if n&0x80 != 0 {
+		size = make([]byte, n&0x7f)
+		_, err = io.ReadFull(conn, size)
+		So(err, ShouldBeNil)
+		n = 0
+		for _, c := range size {
+			n = n<<8 | int(c)
+		}
+	}
+	content := make([]byte, n)
+	_, err = io.ReadFull(conn, content)
+	So(err, ShouldBeNil)
+
+	_, id, content, err := berRead(content)
+	So(err, ShouldBeNil)
+	n, err = berDecodeInteger(id)
+	So(err, ShouldBeNil)
+	So(n, ShouldEqual, messageID)
+	tag, op, rest, err := berRead(content)
+	So(err, ShouldBeNil)
+	var controls []byte
+	if len(rest) > 0 {
+		var ctag byte
+		ctag, controls, _, err = berRead(rest)
+		So(err, ShouldBeNil)
+		So(ctag, ShouldEqual, berControls)
+	}
+	return tag, op, controls
+}
+
+// ldapResultCode reads the result code of a response
+func ldapResultCode(op []byte) int {
+	_, code, _, err := berRead(op)
+	So(err, ShouldBeNil)
+	n, err := berDecodeInteger(code)
+	So(err, ShouldBeNil)
+	return n
+}
+
+func TestLDAPTLS(t *testing.T) {
+	Convey("TLS options are validated", t, func() {
+		So(validateLDAPConfig(LDAPConfig{}), ShouldBeNil)
+		So(validateLDAPConfig(LDAPConfig{TLSCert: "a.crt", TLSKey: "a.key", TLSListenPort: 636, RequireTLS: true}), ShouldBeNil)
+		So(validateLDAPConfig(LDAPConfig{TLSCert: "a.crt"}), ShouldNotBeNil)
+		So(validateLDAPConfig(LDAPConfig{TLSListenPort: 636}), ShouldNotBeNil)
+		So(validateLDAPConfig(LDAPConfig{RequireTLS: true}), ShouldNotBeNil)
+		So(validateLDAPConfig(LDAPConfig{TLSClientCA: "ca.crt"}), ShouldNotBeNil)
+
+		tlsConfig, err := makeLDAPTLSConfig(LDAPConfig{})
+		So(err, ShouldBeNil)
+		So(tlsConfig, ShouldBeNil)
+		_, err = makeLDAPTLSConfig(LDAPConfig{TLSCert: "/nonexistent.crt", TLSKey: "/nonexistent.key"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("StartTLS encrypts plain connections", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		dcfg.LDAP.RequireTLS = true
+		defer func() { dcfg.LDAP.RequireTLS = false }()
+
+		certFile, keyFile := writeTestCert(t.TempDir())
+		tlsConfig, err := makeLDAPTLSConfig(LDAPConfig{TLSCert: certFile, TLSKey: keyFile, TLSClientCA: certFile})
+		So(err, ShouldBeNil)
+		So(tlsConfig.ClientAuth, ShouldEqual, tls.RequireAndVerifyClientCert)
+		tlsConfig.ClientAuth = tls.NoClientCert
+		ldapTLSConfig = tlsConfig
+		defer func() { ldapTLSConfig = nil }()
+
+		conn, stop := dialTestLDAPServer()
+		defer stop()
+
+		bind := append(berEncodeInteger(3), berTLV(berOctetString, []byte("uid=lisi,ou=people,o=tuna"))...)
+		bind = append(bind, berTLV(0x80, []byte("pass"))...)
+		tag, res := ldapRoundTrip(conn, 1, 0x60, bind)
+		So(tag, ShouldEqual, 0x61)
+		So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultConfidentialityRequired)
+
+		tag, res = ldapRoundTrip(conn, 2, 0x77, berTLV(0x80, []byte(ldap.NoticeOfStartTLS)))
+		So(tag, ShouldEqual, 0x78)
+		So(ldapResultCode(res), ShouldEqual, ldap.LDAPResultSuccess)
+
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		So(tlsConn.Handshake(), ShouldBeNil)
+
+		// a base search of the Root DSE
+		search := berTLV(berOctetString, nil)
+		search = append(search, berTLV(0x0a, []byte{0})...)
+		search = append(search, berTLV(0x0a, []byte{0})...)
+		search = append(search, berEncodeInteger(0)...)
+		search = append(search, berEncodeInteger(0)...)
+		search = append(search, berTLV(berBoolean, []byte{0})...)
+		search = append(search, berTLV(0x87, []byte("objectClass"))...)
+		search = append(search, berTLV(berSequence, nil)...)
+		tag, res = ldapRoundTrip(tlsConn, 3, 0x63, search)
+		So(tag, ShouldEqual, 0x64)
+		_, name, _, err := berRead(res)
+		So(err, ShouldBeNil)
+		So(len(name), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,964 @@
+// Add, Modify, Delete and ModifyDN of users and groups
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An ldapResultError is an error reported with its own result code
+type ldapResultError struct {
+	Code int
+	Msg  string
+}
+
+func (e ldapResultError) Error() string {
+	return e.Msg
+}
+
+func ldapErrorf(code int, format string, args ...interface{}) error {
+	return ldapResultError{code, fmt.Sprintf(format, args...)}
+}
+
+// ldapResultOf is the result code and diagnostic message of a write
+func ldapResultOf(err error) (int, string) {
+	if e, ok := err.(ldapResultError); ok {
+		return e.Code, e.Msg
+	}
+	switch err {
+	case nil:
+		return ldap.LDAPResultSuccess, ""
+	case errNoSuchObject, errNotFound:
+		return ldap.LDAPResultNoSuchObject, errNoSuchObject.Error()
+	case errDuplicateKey:
+		return ldap.LDAPResultEntryAlreadyExists, "Entry already exists"
+	case errConflict:
+		return ldap.LDAPResultBusy, err.Error()
+	}
+	logger.Errorf("Failed to write LDAP entry: %s", err.Error())
+	return ldap.LDAPResultOther, err.Error()
+}
+
+func ldapResponse(err error) ldapMsg.LDAPResult {
+	code, msg := ldapResultOf(err)
+	res := ldap.NewResponse(code)
+	res.SetDiagnosticMessage(msg)
+	return res
+}
+
+// checkLDAPWrite makes sure the connection may modify the directory,
+// which is only allowed to admins as in the HTTP API. Privileges are
+// checked against the store, not as they were at bind time.
+func checkLDAPWrite(m Store, conn *ldapConn) error {
+	switch {
+	case dcfg.ReadOnly:
+		return ldapErrorf(ldap.LDAPResultUnwillingToPerform, "Server is read-only")
+	case dcfg.LDAP.RequireTLS && !conn.isTLS():
+		return ldapErrorf(ldap.LDAPResultConfidentialityRequired, "Writes require TLS")
+	}
+	if id := conn.currentIdentity(m); id == nil || !id.IsAdmin {
+		return ldapErrorf(ldap.LDAPResultInsufficientAccessRights, "Permission denied")
+	}
+	return nil
+}
+
+// resolveLDAPLeaf resolves the DN of a user or group, a tag in
+// the DN must exist
+func resolveLDAPLeaf(m Store, s string) (ldapBase, error) {
+	dn, err := parseDN(s)
+	if err != nil {
+		return ldapBase{}, ldapErrorf(ldap.LDAPResultInvalidDNSyntax, "%s", err.Error())
+	}
+	base, err := resolveLDAPBase(dn)
+	if err != nil {
+		return base, err
+	}
+	if base.Attr == "" {
+		return base, ldapErrorf(ldap.LDAPResultUnwillingToPerform, "Only users and groups can be modified")
+	}
+	if base.Tag != "" && !tagLive(m, base.Tag) {
+		return base, errNoSuchObject
+	}
+	return base, nil
+}
+
+func tagLive(m Store, name string) bool {
+	tags, err := m.ListTags()
+	if err != nil {
+		logger.Errorf("Failed to list tags: %s", err.Error())
+		return false
+	}
+	tag := findTag(name, tags)
+	return tag != nil && tag.Deleted == nil
+}
+
+// findLDAPUserEntry finds the user of a DN, which must be visible
+// under the tag of the DN
+func findLDAPUserEntry(m Store, base ldapBase) (User, error) {
+	u, found := findLDAPUser(m, base.Val)
+	if !found || !userVisible(&u, base.Tag) {
+		return u, errNoSuchObject
+	}
+	return u, nil
+}
+
+// findLDAPGroup finds the group of a DN, a group of the tag wins over
+// a universal one and an exact name over a case-insensitive match
+func findLDAPGroup(m Store, base ldapBase) (PosixGroup, error) {
+	q, _ := ldapMatchToBson("name", "caseIgnoreMatch", base.Val)
+	best, score := PosixGroup{}, -1
+	for _, g := range m.FindGroups(q, base.Tag) {
+		s := 0
+		if g.Tag == base.Tag {
+			s += 2
+		}
+		if g.Name == base.Val {
+			s++
+		}
+		if s > score {
+			best, score = g, s
+		}
+	}
+	if score < 0 {
+		return best, errNoSuchObject
+	}
+	return best, nil
+}
+
+// ldapAttrValueEqual compares values with the matching rule of name
+func ldapAttrValueEqual(name, a, b string) bool {
+	if ldapCaseIgnoreFields[name] || name == "objectClass" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func ldapAttrHasValue(attr ldapAttribute, v string) bool {
+	for _, value := range attr.Values {
+		if ldapAttrValueEqual(attr.Name, value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapAttrValuesEqual(name string, a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range b {
+		if !ldapAttrHasValue(ldapAttribute{name, a}, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func findLDAPAttribute(attrs []ldapAttribute, name string) int {
+	for i, attr := range attrs {
+		if strings.EqualFold(attr.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// withoutLDAPAttribute removes the attribute of name from attrs
+func withoutLDAPAttribute(attrs []ldapAttribute, name string) []ldapAttribute {
+	res := []ldapAttribute{}
+	for _, attr := range attrs {
+		if !strings.EqualFold(attr.Name, name) {
+			res = append(res, attr)
+		}
+	}
+	return res
+}
+
+// entryAttributes are the attributes of an entry as a client sees them,
+// without empty values
+func entryAttributes(attrs []ldapAttribute) []ldapAttribute {
+	entry := []ldapAttribute{}
+	for _, attr := range attrs {
+		values := []string{}
+		for _, v := range attr.Values {
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			entry = append(entry, ldapAttribute{attr.Name, values})
+		}
+	}
+	return entry
+}
+
+// requestAttribute converts an attribute of a request, its name is
+// replaced by the one published in known if any
+func requestAttribute(name ldapMsg.AttributeDescription, vals []ldapMsg.AttributeValue, known []ldapAttribute) (ldapAttribute, error) {
+	attr := ldapAttribute{Name: string(name)}
+	if i := findLDAPAttribute(known, attr.Name); i >= 0 {
+		attr.Name = known[i].Name
+	}
+	for _, v := range vals {
+		if ldapAttrHasValue(attr, string(v)) {
+			return attr, ldapErrorf(ldap.LDAPResultAttributeOrValueExists, "Duplicate value of %s", attr.Name)
+		}
+		attr.Values = append(attr.Values, string(v))
+	}
+	return attr, nil
+}
+
+// applyLDAPChange applies a change of a Modify request to attrs
+func applyLDAPChange(attrs []ldapAttribute, op int, change ldapAttribute) ([]ldapAttribute, error) {
+	i := findLDAPAttribute(attrs, change.Name)
+	switch op {
+	case ldapMsg.ModifyRequestChangeOperationAdd:
+		if len(change.Values) == 0 {
+			return attrs, ldapErrorf(ldap.LDAPResultProtocolError, "No values to add to %s", change.Name)
+		} else if i < 0 {
+			return append(attrs, ldapAttribute{change.Name, append([]string{}, change.Values...)}), nil
+		}
+		for _, v := range change.Values {
+			if ldapAttrHasValue(attrs[i], v) {
+				return attrs, ldapErrorf(ldap.LDAPResultAttributeOrValueExists, "%s already has value %s", change.Name, v)
+			}
+			attrs[i].Values = append(attrs[i].Values, v)
+		}
+	case ldapMsg.ModifyRequestChangeOperationDelete:
+		if i < 0 {
+			return attrs, ldapErrorf(ldap.LDAPResultNoSuchAttribute, "No attribute %s", change.Name)
+		}
+		if len(change.Values) == 0 {
+			return append(attrs[:i], attrs[i+1:]...), nil
+		}
+		for _, v := range change.Values {
+			if !ldapAttrHasValue(attrs[i], v) {
+				return attrs, ldapErrorf(ldap.LDAPResultNoSuchAttribute, "%s has no value %s", change.Name, v)
+			}
+			values := []string{}
+			for _, value := range attrs[i].Values {
+				if !ldapAttrValueEqual(change.Name, value, v) {
+					values = append(values, value)
+				}
+			}
+			attrs[i].Values = values
+		}
+		if len(attrs[i].Values) == 0 {
+			return append(attrs[:i], attrs[i+1:]...), nil
+		}
+	case ldapMsg.ModifyRequestChangeOperationReplace:
+		if i >= 0 {
+			attrs = append(attrs[:i], attrs[i+1:]...)
+		}
+		if len(change.Values) > 0 {
+			attrs = append(attrs, ldapAttribute{change.Name, append([]string{}, change.Values...)})
+		}
+	default:
+		return attrs, ldapErrorf(ldap.LDAPResultProtocolError, "Unknown modify operation %d", op)
+	}
+	return attrs, nil
+}
+
+// fromLDAPAttributes maps attrs through keymap onto v, a *User or
+// *PosixGroup. Fields of absent attributes are cleared, attributes
+// not in keymap are left to the caller.
+func fromLDAPAttributes(v interface{}, attrs []ldapAttribute, keymap map[string]string) error {
+	values := map[string][]string{}
+	names := map[string]string{}
+	for _, attr := range attrs {
+		name, key, ok := ldapAttrKey(attr.Name, keymap)
+		if !ok {
+			continue
+		}
+		if prev, ok := names[key]; ok {
+			if !ldapAttrValuesEqual(name, values[key], attr.Values) {
+				return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s and %s must have the same values", prev, name)
+			}
+			continue
+		}
+		names[key], values[key] = name, attr.Values
+	}
+
+	doc := toDoc(v)
+	for name, key := range keymap {
+		vals := values[key]
+		switch {
+		case ldapMultiValuedFields[name]:
+			doc[key] = append([]string{}, vals...)
+		case len(vals) > 1:
+			return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s is single-valued", name)
+		case ldapIntegerFields[name]:
+			n := 0
+			if len(vals) == 1 {
+				var err error
+				if n, err = strconv.Atoi(strings.TrimSpace(vals[0])); err != nil {
+					return ldapErrorf(ldap.LDAPResultInvalidAttributeSyntax, "Invalid %s: %s", name, vals[0])
+				}
+			}
+			doc[key] = n
+		case len(vals) == 1:
+			doc[key] = vals[0]
+		default:
+			doc[key] = ""
+		}
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	return bson.Unmarshal(data, v)
+}
+
+// checkObjectClasses allows the classes an entry is published with,
+// structural is required
+func checkObjectClasses(values, classes []string, structural string) error {
+	for _, v := range values {
+		if !stringInSliceFold(v, classes) {
+			return ldapErrorf(ldap.LDAPResultObjectClassViolation, "Unsupported objectClass %s", v)
+		}
+	}
+	if !stringInSliceFold(structural, values) {
+		return ldapErrorf(ldap.LDAPResultObjectClassViolation, "objectClass %s is required", structural)
+	}
+	return nil
+}
+
+// checkDerivedAttributes makes sure attributes outside the keymap equal
+// the values published for the entry, since they cannot be stored
+func checkDerivedAttributes(attrs, published []ldapAttribute, keymap map[string]string) error {
+	for _, attr := range attrs {
+		if _, _, ok := ldapAttrKey(attr.Name, keymap); ok {
+			continue
+		}
+		i := findLDAPAttribute(published, attr.Name)
+		if i < 0 {
+			return ldapErrorf(ldap.LDAPResultUndefinedAttributeType, "Unsupported attribute %s", attr.Name)
+		}
+		values := []string{}
+		for _, v := range published[i].Values {
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+		if !ldapAttrValuesEqual(attr.Name, values, attr.Values) {
+			return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s cannot be set", attr.Name)
+		}
+	}
+	return nil
+}
+
+// userFromLDAP returns u with the attributes of an entry, userPassword
+// is hashed unless it is a hash already
+func userFromLDAP(u User, attrs []ldapAttribute) (User, error) {
+	out := u
+	if err := fromLDAPAttributes(&out, attrs, userldap2bson); err != nil {
+		return u, err
+	}
+	keys, err := checkSSHKeys(out.SSHKeys, u.SSHKeys)
+	switch {
+	case err == errDuplicateSSHKey:
+		return u, ldapErrorf(ldap.LDAPResultAttributeOrValueExists, "%s", err.Error())
+	case err != nil:
+		return u, ldapErrorf(ldap.LDAPResultInvalidAttributeSyntax, "%s", err.Error())
+	}
+	out.SSHKeys = keys
+	if err := shadowFromLDAP(u, &out, attrs); err != nil {
+		return u, err
+	}
+	derived := []ldapAttribute{}
+	out.Password = ""
+	passwordChanged := false
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "userPassword":
+			if len(attr.Values) != 1 {
+				return u, ldapErrorf(ldap.LDAPResultConstraintViolation, "userPassword is single-valued")
+			}
+			v := attr.Values[0]
+			switch {
+			case v == u.Password:
+				out.Password = v
+			case isSSHAHash(v):
+				out.setPasswordHash(v)
+				passwordChanged = true
+			default:
+				out.Passwd(v)
+				passwordChanged = true
+			}
+		case "shadowExpire", "shadowInactive":
+			continue
+		case "objectClass":
+			if err := checkObjectClasses(attr.Values, userObjectClasses, "posixAccount"); err != nil {
+				return u, err
+			}
+		default:
+			derived = append(derived, attr)
+		}
+	}
+	// shadowLastChange follows the password
+	if passwordChanged {
+		derived = withoutLDAPAttribute(derived, "shadowLastChange")
+	}
+	if err := checkDerivedAttributes(derived, userAttributes(out), userldap2bson); err != nil {
+		return u, err
+	}
+	return out, nil
+}
+
+// groupFromLDAP is userFromLDAP for groups
+func groupFromLDAP(g PosixGroup, attrs []ldapAttribute) (PosixGroup, error) {
+	out := g
+	if err := fromLDAPAttributes(&out, attrs, groupldap2bson); err != nil {
+		return g, err
+	}
+	derived := []ldapAttribute{}
+	for _, attr := range attrs {
+		if attr.Name == "objectClass" {
+			if err := checkObjectClasses(attr.Values, groupObjectClasses, "posixGroup"); err != nil {
+				return g, err
+			}
+			continue
+		}
+		derived = append(derived, attr)
+	}
+	return out, checkDerivedAttributes(derived, groupAttributes(out), groupldap2bson)
+}
+
+// checkNaming makes sure the RDN of an entry is among its attributes
+func checkNaming(name, rdn string) error {
+	if !strings.EqualFold(name, rdn) {
+		return ldapErrorf(ldap.LDAPResultNamingViolation, "The RDN value %s does not match %s", rdn, name)
+	}
+	return nil
+}
+
+// checkRDNUnchanged refuses changes of naming attributes, which are
+// changed by ModifyDN
+func checkRDNUnchanged(before, after []ldapAttribute, names ...string) error {
+	for _, name := range names {
+		i, j := findLDAPAttribute(before, name), findLDAPAttribute(after, name)
+		if i < 0 || j < 0 || !ldapAttrValuesEqual(name, before[i].Values, after[j].Values) {
+			return ldapErrorf(ldap.LDAPResultNotAllowedOnRDN, "%s is changed by ModifyDN", name)
+		}
+	}
+	return nil
+}
+
+// checkMembers makes sure members added to a group are users
+func checkMembers(m Store, before, after []string) error {
+	for _, member := range after {
+		if stringInSlice(member, before) {
+			continue
+		}
+		if err := checkMember(m, member); err != nil {
+			return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s", err.Error())
+		}
+	}
+	return nil
+}
+
+// addLDAPUser creates a user from an Add request, the UID is allocated
+// unless uidNumber is given, gidNumber defaults to the default GID
+func addLDAPUser(m Store, base ldapBase, attrs []ldapAttribute, actor auditActor) error {
+	attrs = append([]ldapAttribute{}, attrs...)
+	if findLDAPAttribute(attrs, base.Attr) < 0 {
+		attrs = append(attrs, ldapAttribute{base.Attr, []string{base.Val}})
+	}
+	if findLDAPAttribute(attrs, "gidNumber") < 0 {
+		attrs = append(attrs, ldapAttribute{"gidNumber", []string{fmt.Sprint(dcfg.TUNA.DefaultGID)}})
+	}
+	if findLDAPAttribute(attrs, "objectClass") < 0 {
+		return ldapErrorf(ldap.LDAPResultObjectClassViolation, "objectClass is required")
+	}
+	explicitUID := findLDAPAttribute(attrs, "uidNumber") >= 0
+	if !explicitUID {
+		attrs = append(attrs, ldapAttribute{"uidNumber", []string{"0"}})
+	}
+
+	user, err := userFromLDAP(User{IsActive: true}, attrs)
+	if err != nil {
+		return err
+	}
+	if err := checkNaming(user.Username, base.Val); err != nil {
+		return err
+	}
+	// emails are unique, so they cannot be left empty
+	if user.Email == "" {
+		return ldapErrorf(ldap.LDAPResultConstraintViolation, "mail is required")
+	}
+	if _, found := findLDAPUser(m, user.Username); found {
+		return errDuplicateKey
+	}
+	if base.Tag != "" {
+		user.Tags = []string{base.Tag}
+	}
+	if err := checkPrimaryGroup(m, user.GID, user.Tags); err != nil {
+		return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s", err.Error())
+	}
+
+	uids, err := newUIDAllocator(dcfg.TUNA)
+	if err != nil {
+		return err
+	}
+	if explicitUID {
+		if user.UID <= 0 {
+			return ldapErrorf(ldap.LDAPResultConstraintViolation, "Invalid uidNumber %d", user.UID)
+		}
+		if issued, err := uids.issued(m, user.UID); err != nil {
+			return err
+		} else if issued {
+			return ldapErrorf(ldap.LDAPResultEntryAlreadyExists, "UID %d is in use or was issued before", user.UID)
+		}
+		if err := uids.observe(m, user.UID); err != nil {
+			return err
+		}
+	} else if user.UID, err = uids.next(m); err != nil {
+		return err
+	}
+
+	if err := m.InsertUser(user); err != nil {
+		return err
+	}
+	writeAudit(m, actor, "user.add", auditTargetUser, user.Username, nil, user)
+	logSSHKeyChanges(user.Username, nil, user.SSHKeys)
+	return nil
+}
+
+// addLDAPGroup creates a group under the tag of its DN, the GID is
+// allocated from the pool of the tag unless gidNumber is given
+func addLDAPGroup(m Store, base ldapBase, attrs []ldapAttribute, actor auditActor) error {
+	attrs = append([]ldapAttribute{}, attrs...)
+	if findLDAPAttribute(attrs, "cn") < 0 {
+		attrs = append(attrs, ldapAttribute{"cn", []string{base.Val}})
+	}
+	if findLDAPAttribute(attrs, "objectClass") < 0 {
+		return ldapErrorf(ldap.LDAPResultObjectClassViolation, "objectClass is required")
+	}
+	explicitGID := findLDAPAttribute(attrs, "gidNumber") >= 0
+	group, err := groupFromLDAP(PosixGroup{IsActive: true, Tag: base.Tag}, attrs)
+	if err != nil {
+		return err
+	}
+	if err := checkNaming(group.Name, base.Val); err != nil {
+		return err
+	}
+	if err := checkMembers(m, nil, group.Members); err != nil {
+		return err
+	}
+
+	gids, err := newGIDAllocator(dcfg.TUNA, base.Tag)
+	if err != nil {
+		return err
+	}
+	if explicitGID {
+		if group.GID <= 0 {
+			return ldapErrorf(ldap.LDAPResultConstraintViolation, "Invalid gidNumber %d", group.GID)
+		}
+		if tag, ok, err := gidPoolTag(dcfg.TUNA, group.GID); err != nil {
+			return err
+		} else if ok && tag != base.Tag {
+			return ldapErrorf(ldap.LDAPResultConstraintViolation, "GID %d is in the pool of tag %s", group.GID, tag)
+		}
+		if issued, err := gids.issued(m, group.GID); err != nil {
+			return err
+		} else if issued {
+			return ldapErrorf(ldap.LDAPResultEntryAlreadyExists, "GID %d is in use or was issued before", group.GID)
+		}
+		if err := gids.observe(m, group.GID); err != nil {
+			return err
+		}
+	} else if group.GID, err = gids.next(m); err != nil {
+		return err
+	}
+
+	if err := m.InsertGroup(group); err != nil {
+		return err
+	}
+	writeAudit(m, actor, "group.add", auditTargetGroup, groupAuditName(group), nil, group)
+	return nil
+}
+
+// An ldapChange is a change of a Modify request
+type ldapChange struct {
+	Op   int
+	Attr ldapAttribute
+}
+
+// applyLDAPChanges applies changes to a copy of attrs
+func applyLDAPChanges(attrs []ldapAttribute, changes []ldapChange) ([]ldapAttribute, error) {
+	var err error
+	attrs = append([]ldapAttribute{}, attrs...)
+	for i := range attrs {
+		attrs[i].Values = append([]string{}, attrs[i].Values...)
+	}
+	for _, c := range changes {
+		if attrs, err = applyLDAPChange(attrs, c.Op, c.Attr); err != nil {
+			return attrs, err
+		}
+	}
+	return attrs, nil
+}
+
+// modifyLDAPUser applies changes to the attributes of a user, the
+// uid is changed by ModifyDN and uidNumber never
+func modifyLDAPUser(m Store, base ldapBase, changes []ldapChange, actor auditActor) error {
+	target, err := findLDAPUserEntry(m, base)
+	if err != nil {
+		return err
+	}
+	before, user, err := modifyUser(m, bson.M{"_id": target.UID, "deleted": nil}, func(u *User) error {
+		current := entryAttributes(userAttributes(*u))
+		attrs, err := applyLDAPChanges(current, changes)
+		if err != nil {
+			return err
+		}
+		if err := checkRDNUnchanged(current, attrs, "uid", "cn"); err != nil {
+			return err
+		}
+		out, err := userFromLDAP(*u, attrs)
+		if err != nil {
+			return err
+		}
+		switch {
+		case out.UID != u.UID:
+			return ldapErrorf(ldap.LDAPResultUnwillingToPerform, "uidNumber cannot be changed")
+		case out.GID != u.GID:
+			if err := checkPrimaryGroup(m, out.GID, out.Tags); err != nil {
+				return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s", err.Error())
+			}
+		}
+		*u = out
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeAudit(m, actor, "user.modify", auditTargetUser, user.Username, before, user)
+	logSSHKeyChanges(user.Username, before.SSHKeys, user.SSHKeys)
+	return nil
+}
+
+// modifyLDAPGroup applies changes to the attributes of a group,
+// members must be existing users
+func modifyLDAPGroup(m Store, base ldapBase, changes []ldapChange, actor auditActor) error {
+	target, err := findLDAPGroup(m, base)
+	if err != nil {
+		return err
+	}
+	selector := bson.M{"tag": target.Tag, "gid": target.GID, "deleted": nil}
+	before, group, err := modifyGroup(m, selector, func(g *PosixGroup) error {
+		current := entryAttributes(groupAttributes(*g))
+		attrs, err := applyLDAPChanges(current, changes)
+		if err != nil {
+			return err
+		}
+		if err := checkRDNUnchanged(current, attrs, "cn"); err != nil {
+			return err
+		}
+		out, err := groupFromLDAP(*g, attrs)
+		if err != nil {
+			return err
+		}
+		if out.GID != g.GID {
+			return ldapErrorf(ldap.LDAPResultUnwillingToPerform, "gidNumber cannot be changed")
+		}
+		if err := checkMembers(m, g.Members, out.Members); err != nil {
+			return err
+		}
+		*g = out
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeAudit(m, actor, "group.modify", auditTargetGroup, groupAuditName(group), before, group)
+	return nil
+}
+
+// deleteLDAPEntry soft deletes a user or group, as the CLI does
+func deleteLDAPEntry(m Store, base ldapBase, actor auditActor) error {
+	if base.OU == "people" {
+		u, err := findLDAPUserEntry(m, base)
+		if err != nil {
+			return err
+		}
+		return softDeleteUser(m, u.Username, actor, "")
+	}
+	g, err := findLDAPGroup(m, base)
+	if err != nil {
+		return err
+	}
+	// groups still in use are refused by the tombstone
+	if err := softDeleteGroup(m, g.Name, g.Tag, actor, ""); err != nil {
+		return ldapErrorf(ldap.LDAPResultUnwillingToPerform, "%s", err.Error())
+	}
+	return nil
+}
+
+// An ldapModifyDN is a ModifyDN request, which goldap
+// parses without exposing its fields
+type ldapModifyDN struct {
+	Entry        string
+	NewRDN       string
+	DeleteOldRDN bool
+	NewSuperior  *string
+}
+
+const berModifyDNRequest = 0x6c
+
+func parseModifyDNRequest(po ldapMsg.ProtocolOp) (ldapModifyDN, error) {
+	req := ldapModifyDN{}
+	data, err := ldapMsg.NewLDAPMessageWithProtocolOp(po).Write()
+	if err != nil {
+		return req, err
+	}
+	// skip the messageID of the message
+	_, content, _, err := berRead(data.Bytes())
+	if err == nil {
+		_, _, content, err = berRead(content)
+	}
+	var tag byte
+	if err == nil {
+		tag, content, _, err = berRead(content)
+	}
+	if err != nil || tag != berModifyDNRequest {
+		return req, errBERSyntax
+	}
+
+	fields := [][]byte{}
+	tags := []byte{}
+	for len(content) > 0 {
+		var field []byte
+		if tag, field, content, err = berRead(content); err != nil {
+			return req, err
+		}
+		tags, fields = append(tags, tag), append(fields, field)
+	}
+	if len(fields) < 3 || tags[0] != berOctetString || tags[1] != berOctetString || tags[2] != berBoolean || len(fields[2]) != 1 {
+		return req, errBERSyntax
+	}
+	req.Entry, req.NewRDN, req.DeleteOldRDN = string(fields[0]), string(fields[1]), fields[2][0] != 0
+	if len(fields) > 3 {
+		if tags[3] != 0x80 {
+			return req, errBERSyntax
+		}
+		s := string(fields[3])
+		req.NewSuperior = &s
+	}
+	return req, nil
+}
+
+// renameLDAPEntry renames a user or group. Entries cannot be moved,
+// since their place is given by the OU and the tag, and the old RDN
+// cannot be kept.
+func renameLDAPEntry(m Store, base ldapBase, req ldapModifyDN, actor auditActor) error {
+	if req.NewSuperior != nil {
+		dn, err := parseDN(*req.NewSuperior)
+		if err != nil {
+			return ldapErrorf(ldap.LDAPResultInvalidDNSyntax, "%s", err.Error())
+		}
+		sup, err := resolveLDAPBase(dn)
+		if err != nil || sup.Attr != "" || sup.OU != base.OU || sup.Tag != base.Tag {
+			return ldapErrorf(ldap.LDAPResultUnwillingToPerform, "Entries cannot be moved")
+		}
+	}
+	rdn, err := parseDN(req.NewRDN)
+	if err != nil || len(rdn) != 1 {
+		return ldapErrorf(ldap.LDAPResultInvalidDNSyntax, "Invalid RDN %s", req.NewRDN)
+	}
+	if len(rdn[0]) != 1 {
+		return ldapErrorf(ldap.LDAPResultNamingViolation, "Multi-valued RDNs are not supported")
+	}
+	ava := rdn[0][0]
+	if ava.Type != "cn" && !(base.OU == "people" && ava.Type == "uid") {
+		return ldapErrorf(ldap.LDAPResultNamingViolation, "Entries cannot be named by %s", ava.Type)
+	}
+	// uid and cn hold a single value, the old one cannot be kept
+	if !req.DeleteOldRDN {
+		return ldapErrorf(ldap.LDAPResultConstraintViolation, "%s is single-valued, deleteoldrdn must be set", ava.Type)
+	}
+
+	if base.OU == "people" {
+		u, err := findLDAPUserEntry(m, base)
+		if err != nil {
+			return err
+		}
+		if _, found := findLDAPUser(m, ava.Value); found && !strings.EqualFold(ava.Value, u.Username) {
+			return errDuplicateKey
+		}
+		return renameUser(m, u.Username, ava.Value, actor)
+	}
+
+	g, err := findLDAPGroup(m, base)
+	if err != nil {
+		return err
+	}
+	if g.Name == ava.Value {
+		return nil
+	}
+	before, group, err := modifyGroup(m, bson.M{"tag": g.Tag, "gid": g.GID, "deleted": nil}, func(g *PosixGroup) error {
+		g.Name = ava.Value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeAudit(m, actor, "group.rename", auditTargetGroup, groupAuditName(group), before, group)
+	return nil
+}
+
+// ldapRequestAttributes converts the attributes of a request, names of
+// known attributes are published ones
+func ldapRequestAttributes(base ldapBase, list []ldapMsg.PartialAttribute) ([]ldapAttribute, error) {
+	known := userAttributes(User{})
+	if base.OU == "groups" {
+		known = groupAttributes(PosixGroup{})
+	}
+	attrs := []ldapAttribute{}
+	for _, a := range list {
+		attr, err := requestAttribute(a.Type_(), a.Vals(), known)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// addLDAPEntry creates the user or group of an Add request
+func addLDAPEntry(m Store, r ldapMsg.AddRequest, actor auditActor) error {
+	base, err := resolveLDAPLeaf(m, string(r.Entry()))
+	if err != nil {
+		return err
+	}
+	list := []ldapMsg.PartialAttribute{}
+	for _, a := range r.Attributes() {
+		list = append(list, ldapMsg.PartialAttribute(a))
+	}
+	attrs, err := ldapRequestAttributes(base, list)
+	if err != nil {
+		return err
+	}
+	for i, attr := range attrs {
+		if len(attr.Values) == 0 {
+			return ldapErrorf(ldap.LDAPResultProtocolError, "No values of %s", attr.Name)
+		} else if findLDAPAttribute(attrs[:i], attr.Name) >= 0 {
+			return ldapErrorf(ldap.LDAPResultAttributeOrValueExists, "Duplicate attribute %s", attr.Name)
+		}
+	}
+	if base.OU == "people" {
+		return addLDAPUser(m, base, attrs, actor)
+	}
+	return addLDAPGroup(m, base, attrs, actor)
+}
+
+// modifyLDAPEntry applies a Modify request to a user or group
+func modifyLDAPEntry(m Store, r ldapMsg.ModifyRequest, actor auditActor) error {
+	base, err := resolveLDAPLeaf(m, string(r.Object()))
+	if err != nil {
+		return err
+	}
+	list := []ldapMsg.PartialAttribute{}
+	for _, c := range r.Changes() {
+		list = append(list, *c.Modification())
+	}
+	attrs, err := ldapRequestAttributes(base, list)
+	if err != nil {
+		return err
+	}
+	changes := []ldapChange{}
+	for i, c := range r.Changes() {
+		changes = append(changes, ldapChange{int(c.Operation()), attrs[i]})
+	}
+	if base.OU == "people" {
+		return modifyLDAPUser(m, base, changes, actor)
+	}
+	return modifyLDAPGroup(m, base, changes, actor)
+}
+
+func handleAdd(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetAddRequest()
+	logger.Debugf("Request add: %s", string(r.Entry()))
+	conn := connOf(m)
+	mg := getStore()
+	defer mg.Close()
+	if err := checkLDAPWrite(mg, conn); err != nil {
+		w.Write(ldapMsg.AddResponse(ldapResponse(err)))
+		return
+	}
+	err := addLDAPEntry(mg, r, conn.actor())
+	w.Write(ldapMsg.AddResponse(ldapResponse(err)))
+}
+
+func handleModify(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetModifyRequest()
+	logger.Debugf("Request modify: %s", string(r.Object()))
+	conn := connOf(m)
+	mg := getStore()
+	defer mg.Close()
+	if err := checkLDAPWrite(mg, conn); err != nil {
+		w.Write(ldapMsg.ModifyResponse(ldapResponse(err)))
+		return
+	}
+	err := modifyLDAPEntry(mg, r, conn.actor())
+	w.Write(ldapMsg.ModifyResponse(ldapResponse(err)))
+}
+
+func handleDelete(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetDeleteRequest()
+	logger.Debugf("Request delete: %s", string(r))
+	conn := connOf(m)
+	mg := getStore()
+	defer mg.Close()
+	if err := checkLDAPWrite(mg, conn); err != nil {
+		w.Write(ldapMsg.DelResponse(ldapResponse(err)))
+		return
+	}
+	base, err := resolveLDAPLeaf(mg, string(r))
+	if err == nil {
+		err = deleteLDAPEntry(mg, base, conn.actor())
+	}
+	w.Write(ldapMsg.DelResponse(ldapResponse(err)))
+}
+
+func handleModifyDN(w ldap.ResponseWriter, m *ldap.Message) {
+	req, err := parseModifyDNRequest(m.ProtocolOp())
+	if err != nil {
+		err = ldapErrorf(ldap.LDAPResultProtocolError, "Invalid ModifyDN request")
+		w.Write(ldapMsg.ModifyDNResponse(ldapResponse(err)))
+		return
+	}
+	logger.Debugf("Request modify DN: %s to %s", req.Entry, req.NewRDN)
+	conn := connOf(m)
+	mg := getStore()
+	defer mg.Close()
+	if err := checkLDAPWrite(mg, conn); err != nil {
+		w.Write(ldapMsg.ModifyDNResponse(ldapResponse(err)))
+		return
+	}
+	base, err := resolveLDAPLeaf(mg, req.Entry)
+	if err == nil {
+		err = renameLDAPEntry(mg, base, req, conn.actor())
+	}
+	w.Write(ldapMsg.ModifyDNResponse(ldapResponse(err)))
+}
+
+// handleNotFound serves operations ldapserver has no routes for
+func handleNotFound(w ldap.ResponseWriter, m *ldap.Message) {
+	if _, ok := m.ProtocolOp().(ldapMsg.ModifyDNRequest); ok {
+		handleModifyDN(w, m)
+		return
+	}
+	res := ldap.NewResponse(ldap.LDAPResultUnwillingToPerform)
+	res.SetDiagnosticMessage("Operation not implemented by server")
+	w.Write(res)
+}
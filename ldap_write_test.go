@@ -0,0 +1,321 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// berAttribute encodes a PartialAttribute of a request
+func berAttribute(name string, values ...string) []byte {
+	vals := []byte{}
+	for _, v := range values {
+		vals = append(vals, berTLV(berOctetString, []byte(v))...)
+	}
+	return berTLV(berSequence, append(berTLV(berOctetString, []byte(name)), berTLV(0x31, vals)...))
+}
+
+func TestLDAPWrite(t *testing.T) {
+	setup := func() Store {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.LDAP.Suffix = "o=tuna"
+		dcfg.DB.Backend = DBEnumMemory
+		So(initStore(), ShouldBeNil)
+		m := getStore()
+		So(m.InsertUser(*(&User{UID: 1000, GID: 2000, Username: "root", Email: "root@tuna.tsinghua.edu.cn", IsActive: true, IsAdmin: true}).Passwd("root")), ShouldBeNil)
+		So(m.InsertUser(*(&User{UID: 2000, GID: 2000, Username: "lisi", Email: "lisi@tuna.tsinghua.edu.cn", IsActive: true}).Passwd("lisi")), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "tuna", IsActive: true, Members: []string{"lisi"}}), ShouldBeNil)
+		So(m.InsertTag(FilterTag{Name: "ci"}), ShouldBeNil)
+		return m
+	}
+	actor := auditActor{Kind: actorLDAP, Name: "root"}
+	code := func(err error) int {
+		c, _ := ldapResultOf(err)
+		return c
+	}
+	user := func(m Store, username string) User {
+		users, err := m.ListUsers(bson.M{"username": username})
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+		return users[0]
+	}
+	leaf := func(m Store, dn string) ldapBase {
+		base, err := resolveLDAPLeaf(m, dn)
+		So(err, ShouldBeNil)
+		return base
+	}
+
+	Convey("Modify requests change attributes", t, func() {
+		attrs := entryAttributes(groupAttributes(PosixGroup{Name: "dev", GID: 2001, Members: []string{"lisi"}}))
+		attrs, err := applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"memberUid", []string{"zhangsan"}})
+		So(err, ShouldBeNil)
+		So(attrs[findLDAPAttribute(attrs, "memberUid")].Values, ShouldResemble, []string{"lisi", "zhangsan"})
+		_, err = applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"memberUid", []string{"lisi"}})
+		So(code(err), ShouldEqual, ldap.LDAPResultAttributeOrValueExists)
+		attrs, err = applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationDelete, ldapAttribute{"memberUid", []string{"lisi"}})
+		So(err, ShouldBeNil)
+		So(attrs[findLDAPAttribute(attrs, "memberUid")].Values, ShouldResemble, []string{"zhangsan"})
+		_, err = applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationDelete, ldapAttribute{"memberUid", []string{"lisi"}})
+		So(code(err), ShouldEqual, ldap.LDAPResultNoSuchAttribute)
+		attrs, err = applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"memberUid", nil})
+		So(err, ShouldBeNil)
+		So(findLDAPAttribute(attrs, "memberUid"), ShouldEqual, -1)
+
+		g, err := groupFromLDAP(PosixGroup{Tag: "ci"}, attrs)
+		So(err, ShouldBeNil)
+		So(g, ShouldResemble, PosixGroup{Name: "dev", GID: 2001, Tag: "ci", Members: []string{}})
+		attrs = append(attrs, ldapAttribute{"description", []string{"dev"}})
+		_, err = groupFromLDAP(PosixGroup{}, attrs)
+		So(code(err), ShouldEqual, ldap.LDAPResultUndefinedAttributeType)
+	})
+
+	Convey("Entries map onto users", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		attrs := []ldapAttribute{
+			{"uid", []string{"zhangsan"}},
+			{"uidNumber", []string{"2001"}},
+			{"gidNumber", []string{"2000"}},
+			{"mail", []string{"zhangsan@tuna.tsinghua.edu.cn"}},
+			{"userPassword", []string{"secret"}},
+			{"homeDirectory", []string{"/home/zhangsan"}},
+			{"objectClass", []string{"posixAccount", "shadowAccount"}},
+		}
+		u, err := userFromLDAP(User{IsActive: true}, attrs)
+		So(err, ShouldBeNil)
+		So(u.Username, ShouldEqual, "zhangsan")
+		So(u.UID, ShouldEqual, 2001)
+		So(u.Email, ShouldEqual, "zhangsan@tuna.tsinghua.edu.cn")
+		So(u.IsActive, ShouldBeTrue)
+		So(u.Authenticate("secret"), ShouldBeTrue)
+
+		hashed, err := userFromLDAP(User{}, append(attrs[:4:4], ldapAttribute{"userPassword", []string{u.Password}}, attrs[6]))
+		So(err, ShouldBeNil)
+		So(hashed.Password, ShouldEqual, u.Password)
+
+		bad := map[int]ldapAttribute{
+			ldap.LDAPResultConstraintViolation:    {"cn", []string{"Zhang San"}},
+			ldap.LDAPResultInvalidAttributeSyntax: {"gidNumber", []string{"many"}},
+			ldap.LDAPResultObjectClassViolation:   {"objectClass", []string{"inetOrgPerson"}},
+			ldap.LDAPResultUndefinedAttributeType: {"telephoneNumber", []string{"10086"}},
+		}
+		for c, attr := range bad {
+			extra := []ldapAttribute{attrs[0], attrs[1], attr}
+			_, err := userFromLDAP(User{}, append(extra, attrs[3:]...))
+			So(code(err), ShouldEqual, c)
+		}
+		_, err = userFromLDAP(User{}, append(attrs[:5:5], ldapAttribute{"homeDirectory", []string{"/root"}}))
+		So(code(err), ShouldEqual, ldap.LDAPResultConstraintViolation)
+	})
+
+	Convey("Admins manage users and groups", t, func() {
+		m := setup()
+		defer m.Close()
+
+		Convey("Users are added with allocated IDs", func() {
+			attrs := []ldapAttribute{
+				{"objectClass", []string{"top", "posixAccount"}},
+				{"mail", []string{"zhangsan@tuna.tsinghua.edu.cn"}},
+				{"gecos", []string{"Zhang San"}},
+			}
+			So(addLDAPUser(m, leaf(m, "uid=zhangsan,ou=people,tag=ci,o=tuna"), attrs, actor), ShouldBeNil)
+			u := user(m, "zhangsan")
+			So(u.UID, ShouldEqual, 2001)
+			So(u.GID, ShouldEqual, 2000)
+			So(u.Name, ShouldEqual, "Zhang San")
+			So(u.Tags, ShouldResemble, []string{"ci"})
+
+			err := addLDAPUser(m, leaf(m, "uid=ZhangSan,ou=people,o=tuna"), attrs, actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultEntryAlreadyExists)
+			err = addLDAPUser(m, leaf(m, "uid=wangwu,ou=people,o=tuna"), attrs[:1], actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultConstraintViolation)
+			err = addLDAPUser(m, leaf(m, "uid=wangwu,ou=people,o=tuna"), append(attrs, ldapAttribute{"uidNumber", []string{"2000"}}), actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultEntryAlreadyExists)
+			err = addLDAPUser(m, leaf(m, "uid=wangwu,ou=people,o=tuna"), append(attrs[:2:2], ldapAttribute{"gidNumber", []string{"3000"}}), actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultConstraintViolation)
+
+			records, err := m.ListAudit(bson.M{"action": "user.add"}, 0)
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 1)
+		})
+
+		Convey("Groups are added under the tag of their DN", func() {
+			attrs := []ldapAttribute{
+				{"objectClass", []string{"posixGroup"}},
+				{"memberUid", []string{"lisi"}},
+			}
+			So(addLDAPGroup(m, leaf(m, "cn=dev,ou=groups,tag=ci,o=tuna"), attrs, actor), ShouldBeNil)
+			groups, err := m.ListGroups(bson.M{"name": "dev"})
+			So(err, ShouldBeNil)
+			So(len(groups), ShouldEqual, 1)
+			So(groups[0].Tag, ShouldEqual, "ci")
+			So(groups[0].GID, ShouldEqual, 2001)
+			So(groups[0].Members, ShouldResemble, []string{"lisi"})
+
+			err = addLDAPGroup(m, leaf(m, "cn=ops,ou=groups,o=tuna"), append(attrs[:1:1], ldapAttribute{"memberUid", []string{"nobody"}}), actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultConstraintViolation)
+			_, err = resolveLDAPLeaf(m, "cn=ops,ou=groups,tag=old,o=tuna")
+			So(code(err), ShouldEqual, ldap.LDAPResultNoSuchObject)
+			_, err = resolveLDAPLeaf(m, "ou=groups,o=tuna")
+			So(code(err), ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+		})
+
+		Convey("Explicit GIDs cannot clash with other groups", func() {
+			dcfg.TUNA.GIDPools = map[string]string{"lab": "3000-3999"}
+			defer func() { dcfg.TUNA.GIDPools = nil }()
+			gid := func(n string) []ldapAttribute {
+				return []ldapAttribute{
+					{"objectClass", []string{"posixGroup"}},
+					{"gidNumber", []string{n}},
+				}
+			}
+			err := addLDAPGroup(m, leaf(m, "cn=dev,ou=groups,tag=ci,o=tuna"), gid("2000"), actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultEntryAlreadyExists)
+			err = addLDAPGroup(m, leaf(m, "cn=dev,ou=groups,tag=ci,o=tuna"), gid("3000"), actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultConstraintViolation)
+			So(addLDAPGroup(m, leaf(m, "cn=dev,ou=groups,tag=ci,o=tuna"), gid("2500"), actor), ShouldBeNil)
+		})
+
+		Convey("Explicit UIDs of purged users are not issued again", func() {
+			attrs := []ldapAttribute{
+				{"objectClass", []string{"posixAccount"}},
+				{"mail", []string{"zhangsan@tuna.tsinghua.edu.cn"}},
+			}
+			So(addLDAPUser(m, leaf(m, "uid=zhangsan,ou=people,o=tuna"), attrs, actor), ShouldBeNil)
+			uid := user(m, "zhangsan").UID
+			So(softDeleteUser(m, "zhangsan", actor, ""), ShouldBeNil)
+			cnt, err := purgeTombstones(m, time.Now().Add(time.Hour), actor)
+			So(err, ShouldBeNil)
+			So(cnt, ShouldEqual, 1)
+
+			attrs[1] = ldapAttribute{"mail", []string{"wangwu@tuna.tsinghua.edu.cn"}}
+			explicit := func(id int) []ldapAttribute {
+				return append(attrs, ldapAttribute{"uidNumber", []string{strconv.Itoa(id)}})
+			}
+			err = addLDAPUser(m, leaf(m, "uid=wangwu,ou=people,o=tuna"), explicit(uid), actor)
+			So(code(err), ShouldEqual, ldap.LDAPResultEntryAlreadyExists)
+			So(addLDAPUser(m, leaf(m, "uid=wangwu,ou=people,o=tuna"), explicit(uid+1), actor), ShouldBeNil)
+			next, err := allocateUID(m)
+			So(err, ShouldBeNil)
+			So(next, ShouldEqual, uid+2)
+		})
+
+		Convey("Attributes are modified", func() {
+			base := leaf(m, "uid=lisi,ou=people,o=tuna")
+			changes := []ldapChange{
+				{ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"loginShell", []string{"/bin/zsh"}}},
+				{ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"userPassword", []string{"new"}}},
+			}
+			So(modifyLDAPUser(m, base, changes, actor), ShouldBeNil)
+			u := user(m, "lisi")
+			So(u.LoginShell, ShouldEqual, "/bin/zsh")
+			So(u.Authenticate("new"), ShouldBeTrue)
+
+			for c, change := range map[int]ldapChange{
+				ldap.LDAPResultNotAllowedOnRDN:        {ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"uid", []string{"lisi2"}}},
+				ldap.LDAPResultUnwillingToPerform:     {ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"uidNumber", []string{"3000"}}},
+				ldap.LDAPResultConstraintViolation:    {ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"gidNumber", []string{"3000"}}},
+				ldap.LDAPResultObjectClassViolation:   {ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"objectClass", []string{"inetOrgPerson"}}},
+				ldap.LDAPResultNoSuchAttribute:        {ldapMsg.ModifyRequestChangeOperationDelete, ldapAttribute{"gecos", nil}},
+				ldap.LDAPResultAttributeOrValueExists: {ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"mail", []string{"LISI@tuna.tsinghua.edu.cn"}}},
+			} {
+				So(code(modifyLDAPUser(m, base, []ldapChange{change}, actor)), ShouldEqual, c)
+			}
+			So(user(m, "lisi").Revision, ShouldEqual, u.Revision)
+
+			base = leaf(m, "cn=tuna,ou=groups,o=tuna")
+			changes = []ldapChange{{ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"memberUid", []string{"root"}}}}
+			So(modifyLDAPGroup(m, base, changes, actor), ShouldBeNil)
+			groups, _ := m.ListGroups(bson.M{"name": "tuna"})
+			So(groups[0].Members, ShouldResemble, []string{"lisi", "root"})
+			changes = []ldapChange{{ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"memberUid", []string{"nobody"}}}}
+			So(code(modifyLDAPGroup(m, base, changes, actor)), ShouldEqual, ldap.LDAPResultConstraintViolation)
+		})
+
+		Convey("Entries are renamed and deleted", func() {
+			base := leaf(m, "uid=lisi,ou=people,o=tuna")
+			So(renameLDAPEntry(m, base, ldapModifyDN{NewRDN: "uid=lisi2", DeleteOldRDN: true}, actor), ShouldBeNil)
+			So(user(m, "lisi2").UID, ShouldEqual, 2000)
+			groups, _ := m.ListGroups(bson.M{"name": "tuna"})
+			So(groups[0].Members, ShouldResemble, []string{"lisi2"})
+
+			base = leaf(m, "uid=lisi2,ou=people,o=tuna")
+			So(code(renameLDAPEntry(m, base, ldapModifyDN{NewRDN: "uid=root", DeleteOldRDN: true}, actor)), ShouldEqual, ldap.LDAPResultEntryAlreadyExists)
+			So(code(renameLDAPEntry(m, base, ldapModifyDN{NewRDN: "mail=lisi", DeleteOldRDN: true}, actor)), ShouldEqual, ldap.LDAPResultNamingViolation)
+			So(code(renameLDAPEntry(m, base, ldapModifyDN{NewRDN: "uid=lisi3"}, actor)), ShouldEqual, ldap.LDAPResultConstraintViolation)
+			So(user(m, "lisi2").UID, ShouldEqual, 2000)
+			sup := "ou=people,tag=ci,o=tuna"
+			So(code(renameLDAPEntry(m, base, ldapModifyDN{NewRDN: "uid=lisi", DeleteOldRDN: true, NewSuperior: &sup}, actor)), ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+
+			group := leaf(m, "cn=tuna,ou=groups,o=tuna")
+			So(code(renameLDAPEntry(m, group, ldapModifyDN{NewRDN: "cn=tunar"}, actor)), ShouldEqual, ldap.LDAPResultConstraintViolation)
+			So(renameLDAPEntry(m, group, ldapModifyDN{NewRDN: "cn=tunar", DeleteOldRDN: true}, actor), ShouldBeNil)
+			groups, _ = m.ListGroups(bson.M{"gid": 2000})
+			So(groups[0].Name, ShouldEqual, "tunar")
+
+			So(code(deleteLDAPEntry(m, leaf(m, "cn=tunar,ou=groups,o=tuna"), actor)), ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+			So(deleteLDAPEntry(m, base, actor), ShouldBeNil)
+			So(user(m, "lisi2").Deleted, ShouldNotBeNil)
+			So(code(deleteLDAPEntry(m, base, actor)), ShouldEqual, ldap.LDAPResultNoSuchObject)
+		})
+	})
+
+	Convey("Writes go through the LDAP server", t, func() {
+		m := setup()
+		defer m.Close()
+		conn, stop := dialTestLDAPServer()
+		defer stop()
+		messageID := 0
+		request := func(tag byte, op []byte) int {
+			messageID++
+			_, res := ldapRoundTrip(conn, messageID, tag, op)
+			return ldapResultCode(res)
+		}
+		bind := func(dn, password string) int {
+			op := append(berEncodeInteger(3), berTLV(berOctetString, []byte(dn))...)
+			return request(0x60, append(op, berTLV(0x80, []byte(password))...))
+		}
+		add := berTLV(berOctetString, []byte("cn=dev,ou=groups,o=tuna"))
+		add = append(add, berTLV(berSequence, append(berAttribute("objectClass", "posixGroup"), berAttribute("memberUid", "lisi")...))...)
+		modifyDN := berTLV(berOctetString, []byte("cn=dev,ou=groups,o=tuna"))
+		modifyDN = append(modifyDN, berTLV(berOctetString, []byte("cn=ops"))...)
+		keepOldRDN := append(append([]byte{}, modifyDN...), berTLV(berBoolean, []byte{0})...)
+		modifyDN = append(modifyDN, berTLV(berBoolean, []byte{0xff})...)
+		change := berTLV(berSequence, append(berTLV(0x0a, []byte{ldapMsg.ModifyRequestChangeOperationDelete}), berAttribute("memberUid")...))
+		modify := append(berTLV(berOctetString, []byte("cn=ops,ou=groups,o=tuna")), berTLV(berSequence, change)...)
+
+		So(request(0x68, add), ShouldEqual, ldap.LDAPResultInsufficientAccessRights)
+		So(bind("uid=lisi,ou=people,o=tuna", "lisi"), ShouldEqual, ldap.LDAPResultSuccess)
+		So(request(0x68, add), ShouldEqual, ldap.LDAPResultInsufficientAccessRights)
+
+		So(bind("uid=root,ou=people,o=tuna", "root"), ShouldEqual, ldap.LDAPResultSuccess)
+		So(request(0x68, add), ShouldEqual, ldap.LDAPResultSuccess)
+		So(request(0x68, add), ShouldEqual, ldap.LDAPResultEntryAlreadyExists)
+		So(request(0x6c, keepOldRDN), ShouldEqual, ldap.LDAPResultConstraintViolation)
+		So(request(0x6c, modifyDN), ShouldEqual, ldap.LDAPResultSuccess)
+		So(request(0x66, modify), ShouldEqual, ldap.LDAPResultSuccess)
+		groups, err := m.ListGroups(bson.M{"name": "ops"})
+		So(err, ShouldBeNil)
+		So(len(groups), ShouldEqual, 1)
+		So(groups[0].Members, ShouldBeEmpty)
+		So(request(0x4a, []byte("cn=ops,ou=groups,o=tuna")), ShouldEqual, ldap.LDAPResultSuccess)
+		So(request(0x4a, []byte("cn=ops,ou=groups,o=tuna")), ShouldEqual, ldap.LDAPResultNoSuchObject)
+
+		// privileges are read on each request, not kept from the bind
+		users, err := m.ListUsers(bson.M{"username": "root"})
+		So(err, ShouldBeNil)
+		users[0].IsAdmin = false
+		So(m.UpdateUser(users[0]), ShouldBeNil)
+		So(request(0x68, add), ShouldEqual, ldap.LDAPResultInsufficientAccessRights)
+
+		dcfg.ReadOnly = true
+		defer func() { dcfg.ReadOnly = false }()
+		So(request(0x4a, []byte("uid=lisi,ou=people,o=tuna")), ShouldEqual, ldap.LDAPResultUnwillingToPerform)
+	})
+}
@@ -82,6 +82,97 @@ func main() {
 			Action:    importFiles,
 			ArgsUsage: "[files...]",
 		},
+		{
+			Name:  "migrate",
+			Usage: "migrate data between database backends",
+			Description: "Copies all data to an empty target database, verifies it " +
+				"and upgrades the schema of the target to the latest version. " +
+				"If the migration fails, the target may be partially populated " +
+				"and must be emptied before retrying.",
+			Action: cmdMigrate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "config file of the source database (Required)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "config file of the target database (Required)",
+				},
+			},
+		},
+		{
+			Name:   "audit",
+			Usage:  "query audit logs",
+			Action: cmdAudit,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "user, u",
+					Usage: "target username",
+				},
+				cli.StringFlag{
+					Name:  "actor",
+					Usage: "who performed the action",
+				},
+				cli.StringFlag{
+					Name:  "action, a",
+					Usage: "action, e.g. user.passwd",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "start time, YYYY-MM-DD or RFC3339",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "end time, YYYY-MM-DD (inclusive) or RFC3339",
+				},
+				cli.IntFlag{
+					Name:  "limit, n",
+					Usage: "show the latest n records, 0 for all",
+					Value: 50,
+				},
+			},
+		},
+		{
+			Name:   "doctor",
+			Usage:  "check the consistency of the database",
+			Action: cmdDoctor,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "fix",
+					Usage: "apply safe repairs, which are recorded in the audit log",
+				},
+			},
+		},
+		{
+			Name:  "counter",
+			Usage: "UID and GID counter management",
+			Subcommands: []cli.Command{
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "list counters with their pools",
+					Action:  cmdCounterList,
+				},
+				{
+					Name:      "set",
+					Usage:     "raise a counter, the next ID issued is value+1",
+					ArgsUsage: "<counter> <value>",
+					Action:    cmdCounterSet,
+				},
+			},
+		},
+		{
+			Name:   "purge",
+			Usage:  "permanently remove deleted users, groups and tags after the retention period",
+			Action: cmdPurge,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "days",
+					Usage: "override retention_days of the config file",
+				},
+			},
+		},
 		{
 			Name:  "user",
 			Usage: "user management",
@@ -121,6 +212,10 @@ func main() {
 							Name:  "phone, mobile",
 							Usage: "Phone number of the new account",
 						},
+						cli.IntFlag{
+							Name:  "gid",
+							Usage: "Primary group ID of the new account, default_gid by default",
+						},
 					},
 				},
 				{
@@ -133,32 +228,57 @@ func main() {
 					Name:      "modify",
 					Usage:     "modify user infomation",
 					Aliases:   []string{"mod"},
-					Action:    cmdNotImplemented,
+					Action:    cmdUserModify,
 					ArgsUsage: "<username>",
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "shell, s",
-							Usage: "Login shell of the new account",
-							Value: "/bin/bash",
+							Usage: "Login shell of the account",
 						},
 						cli.StringFlag{
 							Name:  "name",
-							Usage: "Fullname of the new account (Required)",
+							Usage: "Fullname of the account",
 						},
 						cli.StringFlag{
 							Name:  "email, mail",
-							Usage: "Email address of the new account (Required)",
+							Usage: "Email address of the account",
 						},
 						cli.StringFlag{
 							Name:  "phone, mobile",
-							Usage: "Phone number of the new account",
+							Usage: "Phone number of the account",
+						},
+						cli.StringFlag{
+							Name:  "expires",
+							Usage: "Date the account expires on as YYYY-MM-DD, or never",
+						},
+						cli.StringFlag{
+							Name:  "inactive",
+							Usage: "Days an expired password may still be changed, -1 for ever, or default for inactive_days",
 						},
 					},
 				},
+				{
+					Name:      "rename",
+					Usage:     "rename a user, group memberships follow",
+					Action:    cmdUserRename,
+					ArgsUsage: "<username> <new-username>",
+				},
 				{
 					Name:      "del",
-					Usage:     "delete a user",
-					Action:    cmdNotImplemented,
+					Usage:     "delete a user, which can be restored until purged",
+					Action:    cmdUserdel,
+					ArgsUsage: "<username>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "reason, r",
+							Usage: "reason of the deletion",
+						},
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "restore a deleted user",
+					Action:    cmdUserRestore,
 					ArgsUsage: "<username>",
 				},
 			},
@@ -215,6 +335,34 @@ func main() {
 						},
 					},
 				},
+				{
+					Name:      "del",
+					Usage:     "delete a group, which can be restored until purged",
+					ArgsUsage: "<groupname>",
+					Action:    cmdGroupDel,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "tag, t",
+							Usage: "group tag",
+						},
+						cli.StringFlag{
+							Name:  "reason, r",
+							Usage: "reason of the deletion",
+						},
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "restore a deleted group",
+					ArgsUsage: "<groupname>",
+					Action:    cmdGroupRestore,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "tag, t",
+							Usage: "group tag",
+						},
+					},
+				},
 			},
 		},
 		{
@@ -251,6 +399,24 @@ func main() {
 						},
 					},
 				},
+				{
+					Name:      "del",
+					Usage:     "delete a tag, which can be restored until purged",
+					ArgsUsage: "<tag>",
+					Action:    cmdTagDel,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "reason, r",
+							Usage: "reason of the deletion",
+						},
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "restore a deleted tag",
+					ArgsUsage: "<tag>",
+					Action:    cmdTagRestore,
+				},
 			},
 		},
 	}
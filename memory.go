@@ -0,0 +1,468 @@
+// in-memory storage backend
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type groupKey struct {
+	tag string
+	gid int
+}
+
+// A memoryStore keeps everything in process memory,
+// it is intended for tests and demos
+type memoryStore struct {
+	mu       sync.RWMutex
+	users    map[int]User
+	groups   map[groupKey]PosixGroup
+	tags     map[string]FilterTag
+	counters map[string]int
+	audit    []AuditRecord
+	version  int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:    map[int]User{},
+		groups:   map[groupKey]PosixGroup{},
+		tags:     map[string]FilterTag{},
+		counters: map[string]int{},
+	}
+}
+
+// Copy returns the store itself, all handles share the same data
+func (s *memoryStore) Copy() Store {
+	return s
+}
+
+func (s *memoryStore) Close() {}
+
+func (s *memoryStore) FindUsers(filter bson.M, tag string) []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []User
+	for _, u := range s.sortedUsers() {
+		if userVisible(&u, tag) && matchQuery(toDoc(u), filter) {
+			results = append(results, copyUser(u))
+		}
+	}
+	return results
+}
+
+func (s *memoryStore) ListUsers(filter bson.M) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []User{}
+	for _, u := range s.sortedUsers() {
+		if matchQuery(toDoc(u), filter) {
+			results = append(results, copyUser(u))
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) EachUser(filter bson.M, fn func(User) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.sortedUsers() {
+		if matchQuery(toDoc(u), filter) {
+			if err := fn(copyUser(u)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.UID]; ok {
+		return errDuplicateKey
+	}
+	if err := s.checkUserUnique(user); err != nil {
+		return err
+	}
+	s.users[user.UID] = copyUser(user)
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.users[user.UID]
+	if !ok {
+		return errNotFound
+	} else if old.Revision != user.Revision {
+		return errConflict
+	}
+	if err := s.checkUserUnique(user); err != nil {
+		return err
+	}
+	user = copyUser(user)
+	user.Revision++
+	s.users[user.UID] = user
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(uid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[uid]; !ok {
+		return errNotFound
+	}
+	delete(s.users, uid)
+	return nil
+}
+
+func (s *memoryStore) FindGroups(filter bson.M, tag string) []PosixGroup {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []PosixGroup
+	for _, g := range s.sortedGroups() {
+		if groupVisible(&g, tag) && matchQuery(toDoc(g), filter) {
+			results = append(results, copyGroup(g))
+		}
+	}
+	return results
+}
+
+func (s *memoryStore) ListGroups(filter bson.M) ([]PosixGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []PosixGroup{}
+	for _, g := range s.sortedGroups() {
+		if matchQuery(toDoc(g), filter) {
+			results = append(results, copyGroup(g))
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) EachGroup(filter bson.M, fn func(PosixGroup) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	groups := s.sortedGroups()
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Tag < groups[j].Tag })
+	for _, g := range groups {
+		if matchQuery(toDoc(g), filter) {
+			if err := fn(copyGroup(g)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertGroup(group PosixGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := groupKey{group.Tag, group.GID}
+	if _, ok := s.groups[key]; ok {
+		return errDuplicateKey
+	}
+	if err := s.checkGroupUnique(group); err != nil {
+		return err
+	}
+	s.groups[key] = copyGroup(group)
+	return nil
+}
+
+func (s *memoryStore) UpdateGroup(group PosixGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := groupKey{group.Tag, group.GID}
+	old, ok := s.groups[key]
+	if !ok {
+		return errNotFound
+	} else if old.Revision != group.Revision {
+		return errConflict
+	}
+	if err := s.checkGroupUnique(group); err != nil {
+		return err
+	}
+	group = copyGroup(group)
+	group.Revision++
+	s.groups[key] = group
+	return nil
+}
+
+func (s *memoryStore) DeleteGroup(tag string, gid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := groupKey{tag, gid}
+	if _, ok := s.groups[key]; !ok {
+		return errNotFound
+	}
+	delete(s.groups, key)
+	return nil
+}
+
+func (s *memoryStore) EnsureTag(tagName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tags[tagName]; ok {
+		return nil
+	}
+	if err := validateTagName(tagName); err != nil {
+		return err
+	}
+	s.tags[tagName] = FilterTag{Name: tagName}
+	return nil
+}
+
+func (s *memoryStore) InsertTag(tag FilterTag) error {
+	if err := validateTagName(tag.Name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tags[tag.Name]; ok {
+		return errDuplicateKey
+	}
+	s.tags[tag.Name] = copyTag(tag)
+	return nil
+}
+
+func (s *memoryStore) UpdateTag(tag FilterTag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tags[tag.Name]; !ok {
+		return errNotFound
+	}
+	s.tags[tag.Name] = copyTag(tag)
+	return nil
+}
+
+func (s *memoryStore) DeleteTag(tagName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tags[tagName]; !ok {
+		return errNotFound
+	}
+	delete(s.tags, tagName)
+	return nil
+}
+
+func (s *memoryStore) ListTags() ([]FilterTag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []FilterTag{}
+	for _, t := range s.tags {
+		results = append(results, copyTag(t))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (s *memoryStore) InsertAudit(rec AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, copyAuditRecord(rec))
+	return nil
+}
+
+func (s *memoryStore) ListAudit(filter bson.M, limit int) ([]AuditRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []AuditRecord{}
+	for _, rec := range s.audit {
+		if matchQuery(toDoc(rec), filter) {
+			results = append(results, copyAuditRecord(rec))
+		}
+	}
+	return lastAuditRecords(results, limit), nil
+}
+
+func (s *memoryStore) SchemaVersion() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version, nil
+}
+
+func (s *memoryStore) SetSchemaVersion(version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+	return nil
+}
+
+func (s *memoryStore) ListCounters() (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := map[string]int{}
+	for k, v := range s.counters {
+		results[k] = v
+	}
+	return results, nil
+}
+
+func (s *memoryStore) nextSeq(ID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[ID]++
+	return s.counters[ID], nil
+}
+
+func (s *memoryStore) ensureCounterMin(ID string, val int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq, ok := s.counters[ID]; !ok || seq < val {
+		s.counters[ID] = val
+	}
+	return nil
+}
+
+func (s *memoryStore) sortedUsers() []User {
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UID < users[j].UID
+	})
+	return users
+}
+
+func (s *memoryStore) sortedGroups() []PosixGroup {
+	groups := make([]PosixGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].GID != groups[j].GID {
+			return groups[i].GID < groups[j].GID
+		}
+		return groups[i].Tag < groups[j].Tag
+	})
+	return groups
+}
+
+func (s *memoryStore) checkUserUnique(user User) error {
+	doc := toDoc(user)
+	for _, u := range s.users {
+		if u.UID != user.UID && violatesUnique(mgoUserColl, doc, toDoc(u)) {
+			return errDuplicateKey
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) checkGroupUnique(group PosixGroup) error {
+	doc := toDoc(group)
+	for key, g := range s.groups {
+		if key != (groupKey{group.Tag, group.GID}) && violatesUnique(mgoPosixGroupColl, doc, toDoc(g)) {
+			return errDuplicateKey
+		}
+	}
+	return nil
+}
+
+// copyUser copies the slices and pointers of u, so that callers cannot
+// change stored documents without going through UpdateUser
+func copyUser(u User) User {
+	u.SSHKeys = append([]string(nil), u.SSHKeys...)
+	u.Tags = append([]string(nil), u.Tags...)
+	u.PasswordChangedAt = copyTime(u.PasswordChangedAt)
+	u.ExpiresAt = copyTime(u.ExpiresAt)
+	if u.InactiveDays != nil {
+		days := *u.InactiveDays
+		u.InactiveDays = &days
+	}
+	u.Deleted = copyTombstone(u.Deleted)
+	return u
+}
+
+func copyGroup(g PosixGroup) PosixGroup {
+	g.Members = append([]string(nil), g.Members...)
+	g.Deleted = copyTombstone(g.Deleted)
+	return g
+}
+
+func copyTag(t FilterTag) FilterTag {
+	t.Deleted = copyTombstone(t.Deleted)
+	return t
+}
+
+func copyTombstone(t *Tombstone) *Tombstone {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Groups = append([]GroupRef(nil), t.Groups...)
+	return &c
+}
+
+// copyAuditRecord copies the changes of rec, whose values are
+// bson documents and arrays as produced by auditDiff
+func copyAuditRecord(rec AuditRecord) AuditRecord {
+	if rec.Changes == nil {
+		return rec
+	}
+	changes := make([]AuditChange, len(rec.Changes))
+	for i, c := range rec.Changes {
+		c.Before, c.After = copyAuditValue(c.Before), copyAuditValue(c.After)
+		changes[i] = c
+	}
+	rec.Changes = changes
+	return rec
+}
+
+func copyAuditValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		c := bson.M{}
+		for k, e := range v {
+			c[k] = copyAuditValue(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyAuditValue(e)
+		}
+		return c
+	case []string:
+		return append([]string(nil), v...)
+	case *time.Time:
+		return copyTime(v)
+	}
+	return v
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
@@ -0,0 +1,245 @@
+// backend to backend data migration
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A storeDigest summarizes the content of a store,
+// checksums do not depend on the order of documents
+type storeDigest struct {
+	Users     int
+	Groups    int
+	Tags      int
+	Audits    int
+	UserSum   string
+	GroupSum  string
+	TagSum    string
+	AuditSum  string
+	Counters  map[string]int
+	docHashes map[string][]string
+}
+
+// migrateStore copies all users, groups, tags, audit records and
+// counters from src to the empty store dst and verifies the result.
+// Counters of dst are raised past the copied IDs in the pools of cfg,
+// as counters of src may be behind.
+func migrateStore(src, dst Store, cfg TUNAConfig) error {
+	if err := ensureEmptyStore(dst); err != nil {
+		return err
+	}
+
+	tags, err := src.ListTags()
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := dst.InsertTag(tag); err != nil {
+			return fmt.Errorf("Failed to migrate tag %s: %s", tag.Name, err.Error())
+		}
+	}
+	logger.Noticef("Migrated %d tags", len(tags))
+
+	uids, err := newUIDAllocator(cfg)
+	if err != nil {
+		return err
+	}
+	cnt := 0
+	err = src.EachUser(bson.M{}, func(u User) error {
+		if err := dst.InsertUser(u); err != nil {
+			return fmt.Errorf("Failed to migrate user %s: %s", u.Username, err.Error())
+		}
+		if err := uids.observe(dst, u.UID); err != nil {
+			return err
+		}
+		cnt++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Noticef("Migrated %d users", cnt)
+
+	cnt = 0
+	err = src.EachGroup(bson.M{}, func(g PosixGroup) error {
+		if err := dst.InsertGroup(g); err != nil {
+			return fmt.Errorf("Failed to migrate group %s [tag: %s]: %s", g.Name, g.Tag, err.Error())
+		}
+		gids, err := newGIDAllocator(cfg, g.Tag)
+		if err != nil {
+			return err
+		}
+		if err := gids.observe(dst, g.GID); err != nil {
+			return err
+		}
+		cnt++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Noticef("Migrated %d groups", cnt)
+
+	records, err := src.ListAudit(bson.M{}, 0)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := dst.InsertAudit(rec); err != nil {
+			return fmt.Errorf("Failed to migrate audit record %s: %s", rec.ID, err.Error())
+		}
+	}
+	logger.Noticef("Migrated %d audit records", len(records))
+
+	version, err := src.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if err := dst.SetSchemaVersion(version); err != nil {
+		return err
+	}
+
+	srcDigest, err := digestStore(src)
+	if err != nil {
+		return err
+	}
+	for k, v := range srcDigest.Counters {
+		if err := dst.ensureCounterMin(k, v); err != nil {
+			return err
+		}
+	}
+
+	dstDigest, err := digestStore(dst)
+	if err != nil {
+		return err
+	}
+	return verifyDigest(srcDigest, dstDigest)
+}
+
+func ensureEmptyStore(s Store) error {
+	users, err := s.ListUsers(bson.M{})
+	if err != nil {
+		return err
+	}
+	groups, err := s.ListGroups(bson.M{})
+	if err != nil {
+		return err
+	}
+	tags, err := s.ListTags()
+	if err != nil {
+		return err
+	}
+	records, err := s.ListAudit(bson.M{}, 1)
+	if err != nil {
+		return err
+	}
+	if len(users)+len(groups)+len(tags)+len(records) > 0 {
+		return errors.New("Target database is not empty")
+	}
+	return nil
+}
+
+func digestStore(s Store) (*storeDigest, error) {
+	d := &storeDigest{docHashes: map[string][]string{}}
+
+	err := s.EachUser(bson.M{}, func(u User) error {
+		d.Users++
+		return d.addDoc(mgoUserColl, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.EachGroup(bson.M{}, func(g PosixGroup) error {
+		d.Groups++
+		return d.addDoc(mgoPosixGroupColl, g)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags, err := s.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		d.Tags++
+		if err := d.addDoc(mgoFilterTagColl, tag); err != nil {
+			return nil, err
+		}
+	}
+	records, err := s.ListAudit(bson.M{}, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		d.Audits++
+		if err := d.addDoc(mgoAuditColl, rec); err != nil {
+			return nil, err
+		}
+	}
+	if d.Counters, err = s.ListCounters(); err != nil {
+		return nil, err
+	}
+
+	d.UserSum = d.checksum(mgoUserColl)
+	d.GroupSum = d.checksum(mgoPosixGroupColl)
+	d.TagSum = d.checksum(mgoFilterTagColl)
+	d.AuditSum = d.checksum(mgoAuditColl)
+	return d, nil
+}
+
+func (d *storeDigest) addDoc(coll string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	d.docHashes[coll] = append(d.docHashes[coll], hex.EncodeToString(sum[:]))
+	return nil
+}
+
+func (d *storeDigest) checksum(coll string) string {
+	hashes := d.docHashes[coll]
+	sort.Strings(hashes)
+	sum := sha256.Sum256([]byte(strings.Join(hashes, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyDigest checks that dst holds the same documents as src,
+// and no counter of dst is behind src
+func verifyDigest(src, dst *storeDigest) error {
+	checks := []struct {
+		name     string
+		src, dst interface{}
+	}{
+		{"user count", src.Users, dst.Users},
+		{"group count", src.Groups, dst.Groups},
+		{"tag count", src.Tags, dst.Tags},
+		{"audit record count", src.Audits, dst.Audits},
+		{"user checksum", src.UserSum, dst.UserSum},
+		{"group checksum", src.GroupSum, dst.GroupSum},
+		{"tag checksum", src.TagSum, dst.TagSum},
+		{"audit record checksum", src.AuditSum, dst.AuditSum},
+	}
+	for _, c := range checks {
+		if c.src != c.dst {
+			return fmt.Errorf("Verification failed, %s mismatch: %v != %v", c.name, c.src, c.dst)
+		}
+	}
+	for k, v := range src.Counters {
+		if dst.Counters[k] < v {
+			return fmt.Errorf("Verification failed, counter %s is behind: %d < %d", k, dst.Counters[k], v)
+		}
+	}
+	logger.Noticef(
+		"Verified %d users, %d groups, %d tags and %d audit records",
+		dst.Users, dst.Groups, dst.Tags, dst.Audits,
+	)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMigrate(t *testing.T) {
+	Convey("Test migrating from memory to bolt", t, func() {
+		tmpdir, err := ioutil.TempDir("", "tunaccount")
+		So(err, ShouldBeNil)
+
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		srcCfg, dstCfg := dcfg.DB, dcfg.DB
+		srcCfg.Backend = DBEnumMemory
+		dstCfg.Backend = DBEnumBolt
+		dstCfg.Path = filepath.Join(tmpdir, "tunaccount.db")
+
+		src, err := openStore(srcCfg, false)
+		So(err, ShouldBeNil)
+		dst, err := openStore(dstCfg, false)
+		So(err, ShouldBeNil)
+
+		So(src.InsertTag(FilterTag{Name: "testing", Desc: "test servers"}), ShouldBeNil)
+		So(src.InsertUser(User{
+			UID: testUID(src), GID: 2000, Username: "zhangsan",
+			Email: "zhangsan@example.com", IsActive: true, Tags: []string{"testing"},
+		}), ShouldBeNil)
+		// imported users may be ahead of the counter
+		So(src.InsertUser(User{
+			UID: 5000, GID: 2000, Username: "lisi", Email: "lisi@example.com",
+		}), ShouldBeNil)
+		So(src.InsertGroup(PosixGroup{
+			GID: 2000, Name: "users", IsActive: true, Members: []string{"zhangsan"},
+		}), ShouldBeNil)
+		So(src.InsertGroup(PosixGroup{
+			GID: 2000, Name: "users", Tag: "testing", IsActive: true,
+		}), ShouldBeNil)
+		dcfg.TUNA.GIDPools = map[string]string{"testing": "3000-3999"}
+		So(src.InsertGroup(PosixGroup{
+			GID: 3005, Name: "dev", Tag: "testing", IsActive: true,
+		}), ShouldBeNil)
+		So(src.ensureCounterMin("gid", 2100), ShouldBeNil)
+		before := User{UID: 5000, GID: 2000, Username: "lisi", LoginShell: "/bin/bash"}
+		after := before
+		after.LoginShell = "/bin/zsh"
+		writeAudit(src, cliActor(), "user.add", auditTargetUser, "lisi", nil, before)
+		writeAudit(src, cliActor(), "user.modify", auditTargetUser, "lisi", before, after)
+
+		Convey("All data should be copied", func() {
+			So(migrateStore(src, dst, dcfg.TUNA), ShouldBeNil)
+
+			users, err := dst.ListUsers(bson.M{})
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 2)
+			So(users[0].Tags, ShouldResemble, []string{"testing"})
+
+			groups, err := dst.ListGroups(bson.M{"tag": ""})
+			So(err, ShouldBeNil)
+			So(len(groups), ShouldEqual, 1)
+			So(groups[0].Members, ShouldResemble, []string{"zhangsan"})
+
+			tags, err := dst.ListTags()
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []FilterTag{{Name: "testing", Desc: "test servers"}})
+
+			// counters are copied and raised past copied IDs,
+			// which may be ahead of the counters of src
+			So(testUID(dst), ShouldEqual, 5001)
+			So(testGID(dst), ShouldEqual, 2101)
+			gid, err := allocateGID(dst, "testing")
+			So(err, ShouldBeNil)
+			So(gid, ShouldEqual, 3006)
+		})
+
+		Convey("Audit records should be copied", func() {
+			So(migrateStore(src, dst, dcfg.TUNA), ShouldBeNil)
+
+			records, err := dst.ListAudit(bson.M{}, 0)
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 2)
+			So(records[0].Action, ShouldEqual, "user.add")
+			So(records[1].Action, ShouldEqual, "user.modify")
+			So(records[1].Changes, ShouldResemble, []AuditChange{
+				{Field: "login_shell", Before: "/bin/bash", After: "/bin/zsh"},
+			})
+
+			srcDigest, err := digestStore(src)
+			So(err, ShouldBeNil)
+			So(srcDigest.Audits, ShouldEqual, 2)
+		})
+
+		Convey("Non-empty target should be refused", func() {
+			So(dst.EnsureTag("existing"), ShouldBeNil)
+			So(migrateStore(src, dst, dcfg.TUNA), ShouldNotBeNil)
+		})
+
+		Convey("Verification should detect differences", func() {
+			srcDigest, err := digestStore(src)
+			So(err, ShouldBeNil)
+			So(dst.InsertUser(User{UID: 2001, Username: "zhangsan", Email: "other@example.com"}), ShouldBeNil)
+			dstDigest, err := digestStore(dst)
+			So(err, ShouldBeNil)
+			So(verifyDigest(srcDigest, dstDigest), ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			dcfg.TUNA.GIDPools = nil
+			src.Close()
+			dst.Close()
+			os.RemoveAll(tmpdir)
+		})
+	})
+}
@@ -1,10 +1,14 @@
 package main
 
+import "time"
+
 const (
 	mgoUserColl       = "users"
 	mgoPosixGroupColl = "posix_groups"
 	mgoFilterTagColl  = "filter_tags"
 	mgoCounterColl    = "counters"
+	mgoMetaColl       = "meta"
+	mgoAuditColl      = "audit_log"
 )
 
 // keymaps
@@ -15,15 +19,39 @@ var userldap2bson = map[string]string{
 	"uid":        "username",
 	"cn":         "username",
 	"loginShell": "login_shell",
+	"gecos":      "name",
+	// openssh-lpk
+	"sshPublicKey": "ssh_keys",
 }
 var groupldap2bson = map[string]string{
 	"gidNumber": "gid",
 	"cn":        "name",
 	"memberUid": "members",
 }
+var userObjectClasses = []string{"top", "posixAccount", "shadowAccount", "ldapPublicKey"}
+var groupObjectClasses = []string{"top", "posixGroup"}
 var ldapIntegerFields = map[string]bool{
 	"gidNumber": true,
 	"uidNumber": true,
+	// shadowAccount
+	"shadowLastChange": true,
+	"shadowMin":        true,
+	"shadowMax":        true,
+	"shadowWarning":    true,
+	"shadowInactive":   true,
+	"shadowExpire":     true,
+}
+var ldapMultiValuedFields = map[string]bool{
+	"memberUid":    true,
+	"sshPublicKey": true,
+}
+
+// attributes matched with caseIgnoreMatch, others are case-exact
+var ldapCaseIgnoreFields = map[string]bool{
+	"uid":   true,
+	"cn":    true,
+	"mail":  true,
+	"gecos": true,
 }
 
 // A User is a tuna account
@@ -41,9 +69,20 @@ type User struct {
 	IsActive bool `bson:"is_active" json:"is_active"`
 	IsAdmin  bool `bson:"is_admin" json:"is_admin"`
 
-	SSHKeys []string `bson:"ssh_keys"`
+	SSHKeys []string `bson:"ssh_keys" ldap:"sshPublicKey"`
+
+	// set by Passwd, users without it are not subject to password ageing
+	PasswordChangedAt *time.Time `bson:"password_changed_at,omitempty" json:"password_changed_at,omitempty"`
+	// the account cannot log in from this day if set
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	// days an expired password may still be changed, overrides the policy
+	InactiveDays *int `bson:"inactive_days,omitempty" json:"inactive_days,omitempty"`
 
 	Tags []string `bson:"tags" json:"tags"`
+
+	Deleted *Tombstone `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	// incremented by every update, see Store.UpdateUser
+	Revision int `bson:"revision" json:"revision"`
 }
 
 // Authenticate user with passwd
@@ -53,7 +92,15 @@ func (u *User) Authenticate(password string) bool {
 
 // Passwd set user's password
 func (u *User) Passwd(password string) *User {
-	u.Password = generateSSHA(password)
+	return u.setPasswordHash(generateSSHA(password))
+}
+
+// setPasswordHash stores an already hashed password; the change time is
+// truncated to what the stores keep, so it survives a round trip
+func (u *User) setPasswordHash(hash string) *User {
+	u.Password = hash
+	now := time.Now().Truncate(time.Millisecond)
+	u.PasswordChangedAt = &now
 	return u
 }
 
@@ -64,6 +111,9 @@ type PosixGroup struct {
 	Tag      string   `bson:"tag" json:"tag"`
 	IsActive bool     `bson:"is_active" json:"is_active"`
 	Members  []string `bson:"members" json:"members" ldap:"memberUid"`
+
+	Deleted  *Tombstone `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	Revision int        `bson:"revision" json:"revision"`
 }
 
 // A FilterTag can be used to filter users and groups
@@ -71,6 +121,24 @@ type PosixGroup struct {
 type FilterTag struct {
 	Name string `bson:"_id" json:"name"`
 	Desc string `bson:"desc" json:"desc"`
+
+	Deleted *Tombstone `bson:"deleted,omitempty" json:"deleted,omitempty"`
+}
+
+// A Tombstone marks a soft deleted document,
+// which is purged after the retention period
+type Tombstone struct {
+	DeletedAt time.Time `bson:"deleted_at" json:"deleted_at"`
+	DeletedBy string    `bson:"deleted_by" json:"deleted_by"`
+	Reason    string    `bson:"reason" json:"reason"`
+	// groups a deleted user was member of, restored with the user
+	Groups []GroupRef `bson:"groups,omitempty" json:"groups,omitempty"`
+}
+
+// A GroupRef identifies a posix group
+type GroupRef struct {
+	Tag string `bson:"tag" json:"tag"`
+	GID int    `bson:"gid" json:"gid"`
 }
 
 type mongoCounter struct {
@@ -78,6 +146,32 @@ type mongoCounter struct {
 	Seq int    `bson:"seq"`
 }
 
+// schemaMeta records the database layout version
+type schemaMeta struct {
+	ID      string `bson:"_id"`
+	Version int    `bson:"version"`
+}
+
+// An AuditRecord logs a mutation of the account database
+type AuditRecord struct {
+	ID         string        `bson:"_id" json:"id"`
+	Time       time.Time     `bson:"time" json:"time"`
+	Actor      string        `bson:"actor" json:"actor"`
+	ActorKind  string        `bson:"actor_kind" json:"actor_kind"`
+	SourceIP   string        `bson:"source_ip" json:"source_ip"`
+	Action     string        `bson:"action" json:"action"`
+	TargetType string        `bson:"target_type" json:"target_type"`
+	Target     string        `bson:"target" json:"target"`
+	Changes    []AuditChange `bson:"changes" json:"changes"`
+}
+
+// An AuditChange is the before and after value of a field
+type AuditChange struct {
+	Field  string      `bson:"field" json:"field"`
+	Before interface{} `bson:"before" json:"before"`
+	After  interface{} `bson:"after" json:"after"`
+}
+
 // A DBDump contains data exported by or
 // can be imported to tunaccount
 type DBDump struct {
@@ -2,12 +2,8 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
 
-	ldapMsg "github.com/lor00x/goldap/message"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -18,8 +14,6 @@ type mongoCtx struct {
 }
 
 var (
-	_mongo *mongoCtx
-
 	mgoIndexes = map[string]([]mgo.Index){
 		mgoUserColl: []mgo.Index{
 			mgo.Index{
@@ -34,6 +28,17 @@ var (
 				Key: []string{"tags"},
 			},
 		},
+		mgoAuditColl: []mgo.Index{
+			mgo.Index{
+				Key: []string{"time"},
+			},
+			mgo.Index{
+				Key: []string{"target_type", "target"},
+			},
+			mgo.Index{
+				Key: []string{"actor"},
+			},
+		},
 		mgoPosixGroupColl: []mgo.Index{
 			mgo.Index{
 				Key:    []string{"tag", "gid"},
@@ -47,8 +52,8 @@ var (
 	}
 )
 
-func getMongo() *mongoCtx {
-	return &mongoCtx{_mongo.session.Copy(), _mongo.dbname}
+func (m *mongoCtx) Copy() Store {
+	return &mongoCtx{m.session.Copy(), m.dbname}
 }
 
 func (m *mongoCtx) Close() {
@@ -71,11 +76,19 @@ func (m *mongoCtx) CounterColl() *mgo.Collection {
 	return m.session.DB(m.dbname).C(mgoCounterColl)
 }
 
+func (m *mongoCtx) AuditColl() *mgo.Collection {
+	return m.session.DB(m.dbname).C(mgoAuditColl)
+}
+
+func (m *mongoCtx) MetaColl() *mgo.Collection {
+	return m.session.DB(m.dbname).C(mgoMetaColl)
+}
+
 // FindUsers returns the user list that matches filter and has a specified tag
 func (m *mongoCtx) FindUsers(filter bson.M, tag string) []User {
 	var results []User
 	isAdmin := bson.M{"is_admin": true}
-	isActive := bson.M{"is_active": true}
+	isActive := bson.M{"is_active": true, "deleted": nil}
 
 	filters := []bson.M{filter, isActive}
 
@@ -100,7 +113,7 @@ func (m *mongoCtx) FindGroups(filter bson.M, tag string) []PosixGroup {
 
 	filters := []bson.M{
 		filter,
-		bson.M{"is_active": true},
+		bson.M{"is_active": true, "deleted": nil},
 		bson.M{"tag": bson.M{"$in": []string{tag, ""}}},
 	}
 
@@ -111,115 +124,200 @@ func (m *mongoCtx) FindGroups(filter bson.M, tag string) []PosixGroup {
 	return results
 }
 
+func (m *mongoCtx) ListUsers(filter bson.M) ([]User, error) {
+	results := []User{}
+	err := m.UserColl().Find(filter).Sort("_id").All(&results)
+	return results, mongoError(err)
+}
+
+func (m *mongoCtx) EachUser(filter bson.M, fn func(User) error) error {
+	var u User
+	iter := m.UserColl().Find(filter).Sort("_id").Iter()
+	for iter.Next(&u) {
+		if err := fn(u); err != nil {
+			iter.Close()
+			return err
+		}
+		u = User{}
+	}
+	return mongoError(iter.Close())
+}
+
+func (m *mongoCtx) InsertUser(user User) error {
+	return mongoError(m.UserColl().Insert(user))
+}
+
+func (m *mongoCtx) UpdateUser(user User) error {
+	rev := user.Revision
+	user.Revision++
+	err := m.UserColl().Update(bson.M{"_id": user.UID, "revision": mongoRevision(rev)}, user)
+	if err == mgo.ErrNotFound {
+		return m.updateMissed(m.UserColl(), bson.M{"_id": user.UID})
+	}
+	return mongoError(err)
+}
+
+func (m *mongoCtx) DeleteUser(uid int) error {
+	return mongoError(m.UserColl().RemoveId(uid))
+}
+
+func (m *mongoCtx) ListGroups(filter bson.M) ([]PosixGroup, error) {
+	results := []PosixGroup{}
+	err := m.PosixGroupColl().Find(filter).Sort("gid", "tag").All(&results)
+	return results, mongoError(err)
+}
+
+func (m *mongoCtx) EachGroup(filter bson.M, fn func(PosixGroup) error) error {
+	var g PosixGroup
+	iter := m.PosixGroupColl().Find(filter).Sort("tag", "gid").Iter()
+	for iter.Next(&g) {
+		if err := fn(g); err != nil {
+			iter.Close()
+			return err
+		}
+		g = PosixGroup{}
+	}
+	return mongoError(iter.Close())
+}
+
+func (m *mongoCtx) InsertGroup(group PosixGroup) error {
+	return mongoError(m.PosixGroupColl().Insert(group))
+}
+
+func (m *mongoCtx) UpdateGroup(group PosixGroup) error {
+	rev := group.Revision
+	group.Revision++
+	err := m.PosixGroupColl().
+		Update(bson.M{"tag": group.Tag, "gid": group.GID, "revision": mongoRevision(rev)}, group)
+	if err == mgo.ErrNotFound {
+		return m.updateMissed(m.PosixGroupColl(), bson.M{"tag": group.Tag, "gid": group.GID})
+	}
+	return mongoError(err)
+}
+
+// mongoRevision matches rev, documents written before
+// revisions were introduced have no such field
+func mongoRevision(rev int) interface{} {
+	if rev == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return rev
+}
+
+// updateMissed tells whether a conditional update missed
+// because of a stale revision or a missing document
+func (m *mongoCtx) updateMissed(coll *mgo.Collection, selector bson.M) error {
+	cnt, err := coll.Find(selector).Count()
+	if err != nil {
+		return mongoError(err)
+	} else if cnt > 0 {
+		return errConflict
+	}
+	return errNotFound
+}
+
+func (m *mongoCtx) DeleteGroup(tag string, gid int) error {
+	return mongoError(m.PosixGroupColl().Remove(bson.M{"tag": tag, "gid": gid}))
+}
+
 func (m *mongoCtx) EnsureTag(tagName string) error {
 	coll := m.FilterTagColl()
 	cnt, _ := coll.Find(bson.M{"_id": tagName}).Count()
 	if cnt == 0 {
-		tagRegex := regexp.MustCompile(`[\w-]+`)
-		if !tagRegex.MatchString(tagName) {
-			return errors.New("Tag must only contains '0-9', 'a-z', 'A-z' and '-'")
+		if err := validateTagName(tagName); err != nil {
+			return err
 		}
 
 		tag := FilterTag{
 			Name: tagName,
 		}
-		return coll.Insert(tag)
+		return mongoError(coll.Insert(tag))
 	}
 	return nil
 }
 
-// ldapQueryToBson convers an LDAP query to BSON filter
-// the keymap maps ldap attribute to mongo doc key, e.g. userldap2bson
-func ldapQueryToBson(filter ldapMsg.Filter, keymap map[string]string) bson.M {
-	res := bson.M{}
+func (m *mongoCtx) InsertTag(tag FilterTag) error {
+	if err := validateTagName(tag.Name); err != nil {
+		return err
+	}
+	return mongoError(m.FilterTagColl().Insert(tag))
+}
 
-	switch f := filter.(type) {
-	case ldapMsg.FilterAnd:
-		cfilters := []bson.M{}
-		for _, child := range f {
-			cf := ldapQueryToBson(child, keymap)
-			if len(cf) > 0 {
-				cfilters = append(cfilters, cf)
-			}
-		}
-		if len(cfilters) > 1 {
-			res["$and"] = cfilters
-		} else if len(cfilters) == 1 {
-			res = cfilters[0]
-		}
-	case ldapMsg.FilterOr:
-		cfilters := []bson.M{}
-		for _, child := range f {
-			cf := ldapQueryToBson(child, keymap)
-			if len(cf) > 0 {
-				cfilters = append(cfilters, cf)
-			}
-		}
-		if len(cfilters) > 1 {
-			res["$or"] = cfilters
-		} else if len(cfilters) == 1 {
-			res = cfilters[0]
-		}
-	case ldapMsg.FilterNot:
-		cf := ldapQueryToBson(f.Filter, keymap)
-		if len(cf) > 0 {
-			res["$not"] = cf
-		}
-	case ldapMsg.FilterEqualityMatch:
-		lkey := string(f.AttributeDesc())
-		lval := string(f.AssertionValue())
-		if key, ok := keymap[lkey]; ok {
-			if ldapIntegerFields[lkey] {
-				val, _ := strconv.Atoi(lval)
-				res[key] = val
-			} else {
-				res[key] = lval
-			}
-		}
-	case ldapMsg.FilterGreaterOrEqual:
-		lkey := string(f.AttributeDesc())
-		lval := string(f.AssertionValue())
-		if key, ok := keymap[lkey]; ok {
-			if ldapIntegerFields[lkey] {
-				val, _ := strconv.Atoi(lval)
-				res[key] = bson.M{"$gte": val}
-			} else {
-				res[key] = bson.M{"$gte": lval}
-			}
-		}
-	case ldapMsg.FilterLessOrEqual:
-		lkey := string(f.AttributeDesc())
-		lval := string(f.AssertionValue())
-		if key, ok := keymap[lkey]; ok {
-			if ldapIntegerFields[lkey] {
-				val, _ := strconv.Atoi(lval)
-				res[key] = bson.M{"$lte": val}
-			} else {
-				res[key] = bson.M{"$lte": lval}
-			}
-		}
+func (m *mongoCtx) UpdateTag(tag FilterTag) error {
+	return mongoError(m.FilterTagColl().UpdateId(tag.Name, tag))
+}
+
+func (m *mongoCtx) DeleteTag(tagName string) error {
+	return mongoError(m.FilterTagColl().RemoveId(tagName))
+}
+
+func (m *mongoCtx) ListTags() ([]FilterTag, error) {
+	results := []FilterTag{}
+	err := m.FilterTagColl().Find(nil).Sort("_id").All(&results)
+	return results, mongoError(err)
+}
+
+// mongoError translates mgo errors to backend neutral ones
+func mongoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	} else if mgo.IsDup(err) {
+		return errDuplicateKey
 	}
-	return res
+	return err
 }
 
-func (m *mongoCtx) getNextSeq(ID string) int {
+func (m *mongoCtx) nextSeq(ID string) (int, error) {
 	counter := mongoCounter{}
 
 	change := mgo.Change{
 		Update: bson.M{
 			"$inc": bson.M{"seq": 1},
 		},
+		Upsert:    true,
 		ReturnNew: true,
 	}
 	_, err := m.CounterColl().Find(bson.M{"_id": ID}).Apply(change, &counter)
-	if err != nil {
-		panic(err)
+	return counter.Seq, mongoError(err)
+}
+
+func (m *mongoCtx) InsertAudit(rec AuditRecord) error {
+	return mongoError(m.AuditColl().Insert(rec))
+}
+
+func (m *mongoCtx) ListAudit(filter bson.M, limit int) ([]AuditRecord, error) {
+	results := []AuditRecord{}
+	err := m.AuditColl().Find(filter).Sort("-time").Limit(limit).All(&results)
+	return lastAuditRecords(results, 0), mongoError(err)
+}
+
+func (m *mongoCtx) SchemaVersion() (int, error) {
+	var meta schemaMeta
+	err := m.MetaColl().FindId("schema").One(&meta)
+	if err == mgo.ErrNotFound {
+		return 0, nil
 	}
-	return counter.Seq
+	return meta.Version, mongoError(err)
 }
 
-func (m *mongoCtx) ensureCounterMin(ID string, val int) {
+func (m *mongoCtx) SetSchemaVersion(version int) error {
+	_, err := m.MetaColl().UpsertId("schema", schemaMeta{ID: "schema", Version: version})
+	return mongoError(err)
+}
 
+func (m *mongoCtx) ListCounters() (map[string]int, error) {
+	var counters []mongoCounter
+	if err := m.CounterColl().Find(nil).All(&counters); err != nil {
+		return nil, mongoError(err)
+	}
+	results := map[string]int{}
+	for _, c := range counters {
+		results[c.ID] = c.Seq
+	}
+	return results, nil
+}
+
+func (m *mongoCtx) ensureCounterMin(ID string, val int) error {
 	err := m.CounterColl().
 		Update(bson.M{
 			"$and": []bson.M{
@@ -230,16 +328,17 @@ func (m *mongoCtx) ensureCounterMin(ID string, val int) {
 			"$set": bson.M{"seq": val},
 		})
 
-	if err != nil {
-		if err != mgo.ErrNotFound {
-			panic(err)
+	if err == mgo.ErrNotFound {
+		// either the counter is missing or already large enough
+		err = m.CounterColl().Insert(mongoCounter{ID: ID, Seq: val})
+		if mgo.IsDup(err) {
+			err = nil
 		}
 	}
+	return mongoError(err)
 }
 
-func initMongo() error {
-
-	c := dcfg.DB
+func openMongo(c DatabaseConfig, readOnly bool) (*mongoCtx, error) {
 	var addrs []string
 
 	if len(c.Addrs) > 0 {
@@ -266,18 +365,18 @@ func initMongo() error {
 
 	session, err := mgo.DialWithInfo(dialInfo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_mongo = &mongoCtx{
+	m := &mongoCtx{
 		session: session,
 		dbname:  c.Name,
 	}
 
 	// don't need to init data in read-only mode
-	if dcfg.ReadOnly {
+	if readOnly {
 		session.SetMode(mgo.Monotonic, false)
-		return nil
+		return m, nil
 	}
 
 	// init indexes
@@ -286,22 +385,11 @@ func initMongo() error {
 		for _, index := range indexes {
 			err = db.C(cname).EnsureIndex(index)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
-	// seqStart
-	seqStart := map[string]int{
-		"uid": dcfg.TUNA.MinimumGID,
-		"gid": dcfg.TUNA.MinimumGID,
-	}
-	for k, v := range seqStart {
-		if cnt, _ := _mongo.CounterColl().FindId(k).Count(); cnt == 0 {
-			_mongo.CounterColl().Insert(mongoCounter{ID: k, Seq: v})
-		}
-	}
-
-	return nil
+	return m, nil
 
 }
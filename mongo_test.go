@@ -9,19 +9,42 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// requireMongo opens the test database as the store, and skips tests
+// when no MongoDB server is reachable
+func requireMongo(t *testing.T) {
+	setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+	dcfg.DB.Backend = DBEnumMongo
+	dcfg.DB.Name = "tunaccount_test"
+	if err := initStore(); err != nil {
+		t.Skipf("MongoDB is not available: %s", err.Error())
+	}
+}
+
+// getTestMongo returns a MongoDB handle of the store opened by requireMongo
+func getTestMongo() *mongoCtx {
+	return getStore().(*mongoCtx)
+}
+
+// dropTestMongo drops the test database
+func dropTestMongo() {
+	m := getTestMongo()
+	defer m.Close()
+	m.session.DB(m.dbname).DropDatabase()
+}
+
 func TestMongo(t *testing.T) {
-	Convey("Test MongoDB Find Users", t, func() {
-		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
-		dcfg.DB.Name = "tunaccount_test"
-		initMongo()
+	requireMongo(t)
+	testStore(t, "MongoDB", DBEnumMongo)
 
-		m := getMongo()
+	requireMongo(t)
+	Convey("Test MongoDB Find Users", t, func() {
+		m := getTestMongo()
 		defer m.Close()
 
 		m.UserColl().Insert(
 			&User{
-				UID:        m.getNextSeq("uid"),
-				GID:        m.getNextSeq("gid"),
+				UID:        testUID(m),
+				GID:        testGID(m),
 				Name:       "张三",
 				Email:      "zhangsan@example.com",
 				Phone:      "+86-010-1234-5678",
@@ -31,8 +54,8 @@ func TestMongo(t *testing.T) {
 				IsActive:   true,
 			},
 			&User{
-				UID:        m.getNextSeq("uid"),
-				GID:        m.getNextSeq("gid"),
+				UID:        testUID(m),
+				GID:        testGID(m),
 				Name:       "李四",
 				Email:      "lisi@example.com",
 				Phone:      "+86-010-1234-5678",
@@ -43,8 +66,8 @@ func TestMongo(t *testing.T) {
 				Tags:       []string{"testing"},
 			},
 			&User{
-				UID:        m.getNextSeq("uid"),
-				GID:        m.getNextSeq("gid"),
+				UID:        testUID(m),
+				GID:        testGID(m),
 				Name:       "王尼玛",
 				Email:      "nima@example.com",
 				Phone:      "+86-010-1234-5678",
@@ -57,7 +80,7 @@ func TestMongo(t *testing.T) {
 		)
 
 		Convey("When query all", func() {
-			m := getMongo()
+			m := getTestMongo()
 			defer m.Close()
 			var allUsers []User
 			m.UserColl().Find(bson.M{}).All(&allUsers)
@@ -65,7 +88,7 @@ func TestMongo(t *testing.T) {
 		})
 
 		Convey("When query with filters", func() {
-			m := getMongo()
+			m := getTestMongo()
 			defer m.Close()
 			activeUsers := m.FindUsers(bson.M{}, "")
 			So(len(activeUsers), ShouldEqual, 2)
@@ -76,9 +99,7 @@ func TestMongo(t *testing.T) {
 		})
 
 		Reset(func() {
-			m := getMongo()
-			defer m.Close()
-			m.session.DB(m.dbname).DropDatabase()
+			dropTestMongo()
 		})
 	})
 
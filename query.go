@@ -0,0 +1,346 @@
+// MongoDB style query evaluation for backends without a query engine
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// toDoc converts a model to its bson document representation
+func toDoc(v interface{}) bson.M {
+	doc := bson.M{}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		logger.Errorf("Failed to marshal document: %s", err.Error())
+		return doc
+	}
+	bson.Unmarshal(data, &doc)
+	return doc
+}
+
+// matchQuery reports whether doc satisfies the query q.
+// Only the subset of query operators tunaccount generates is
+// supported, unknown operators never match.
+func matchQuery(doc bson.M, q bson.M) bool {
+	for key, cond := range q {
+		if !matchQueryKey(doc, key, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchQueryKey(doc bson.M, key string, cond interface{}) bool {
+	switch key {
+	case "$and", "$or", "$nor":
+		subs, ok := queryList(cond)
+		if !ok {
+			return false
+		}
+		for _, sub := range subs {
+			matched := matchQuery(doc, sub)
+			switch {
+			case key == "$and" && !matched:
+				return false
+			case key == "$or" && matched:
+				return true
+			case key == "$nor" && matched:
+				return false
+			}
+		}
+		return key != "$or"
+	}
+	if strings.HasPrefix(key, "$") {
+		logger.Warningf("Unsupported query operator: %s", key)
+		return false
+	}
+
+	val, exists := doc[key]
+	if ops, ok := cond.(bson.M); ok && isOperatorDoc(ops) {
+		for op, arg := range ops {
+			if op == "$options" {
+				continue
+			}
+			if !matchOperator(val, exists, op, arg, ops) {
+				return false
+			}
+		}
+		return true
+	}
+	return matchEqual(val, cond)
+}
+
+func matchOperator(val interface{}, exists bool, op string, arg interface{}, ops bson.M) bool {
+	switch op {
+	case "$eq":
+		return matchEqual(val, arg)
+	case "$ne":
+		return !matchEqual(val, arg)
+	case "$gt", "$gte", "$lt", "$lte":
+		return matchAny(val, func(v interface{}) bool {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		})
+	case "$in", "$nin":
+		in := false
+		for _, a := range toList(arg) {
+			if matchEqual(val, a) {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in")
+	case "$exists":
+		want, _ := arg.(bool)
+		return exists == want
+	case "$regex":
+		re, ok := queryRegex(arg, ops["$options"])
+		if !ok {
+			return false
+		}
+		return matchAny(val, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		})
+	case "$not":
+		switch a := arg.(type) {
+		case bson.M:
+			for subop, subarg := range a {
+				if subop == "$options" {
+					continue
+				}
+				if !matchOperator(val, exists, subop, subarg, a) {
+					return true
+				}
+			}
+			return false
+		case bson.RegEx:
+			return !matchOperator(val, exists, "$regex", a, bson.M{})
+		}
+	}
+	logger.Warningf("Unsupported query operator: %s", op)
+	return false
+}
+
+// matchEqual follows MongoDB equality semantics, an array
+// field matches if any of its elements matches
+func matchEqual(val interface{}, want interface{}) bool {
+	if re, ok := want.(bson.RegEx); ok {
+		return matchOperator(val, true, "$regex", re, bson.M{})
+	}
+	if want == nil {
+		return val == nil
+	}
+	if valuesEqual(val, want) {
+		return true
+	}
+	if list, ok := val.([]interface{}); ok {
+		for _, v := range list {
+			if valuesEqual(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchAny(val interface{}, pred func(interface{}) bool) bool {
+	if list, ok := val.([]interface{}); ok {
+		for _, v := range list {
+			if pred(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return pred(val)
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(toList(a), toList(b)) && isList(a) && isList(b)
+}
+
+// compareValues compares numbers, strings and booleans,
+// ok is false if the values are not comparable
+func compareValues(a, b interface{}) (c int, ok bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch va := a.(type) {
+	case time.Time:
+		vb, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case va.Before(vb):
+			return -1, true
+		case va.After(vb):
+			return 1, true
+		}
+		return 0, true
+	case string:
+		vb, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(va, vb), true
+	case bool:
+		vb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if va == vb {
+			return 0, true
+		} else if vb {
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func isList(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	k := reflect.TypeOf(v).Kind()
+	return k == reflect.Slice || k == reflect.Array
+}
+
+// toList converts any slice to []interface{}
+func toList(v interface{}) []interface{} {
+	if !isList(v) {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list
+}
+
+func queryList(v interface{}) ([]bson.M, bool) {
+	if qs, ok := v.([]bson.M); ok {
+		return qs, true
+	}
+	var qs []bson.M
+	for _, item := range toList(v) {
+		q, ok := item.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		qs = append(qs, q)
+	}
+	return qs, qs != nil
+}
+
+func isOperatorDoc(m bson.M) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func queryRegex(arg interface{}, options interface{}) (*regexp.Regexp, bool) {
+	var pattern, flags string
+	switch a := arg.(type) {
+	case bson.RegEx:
+		pattern, flags = a.Pattern, a.Options
+	case string:
+		pattern = a
+		flags, _ = options.(string)
+	default:
+		return nil, false
+	}
+	prefix := ""
+	for _, f := range flags {
+		if strings.ContainsRune("ims", f) {
+			prefix += string(f)
+		}
+	}
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+	re := queryRegexps.compile(pattern)
+	return re, re != nil
+}
+
+// queryRegexCacheSize bounds the compiled patterns kept, patterns come
+// from client filters, so the cache is emptied once it is full
+const queryRegexCacheSize = 256
+
+// regexpCache holds compiled query patterns, as a query is evaluated
+// against every document scanned; invalid patterns are kept as nil
+type regexpCache struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+var queryRegexps = &regexpCache{patterns: map[string]*regexp.Regexp{}}
+
+func (c *regexpCache) compile(pattern string) *regexp.Regexp {
+	c.Lock()
+	defer c.Unlock()
+	if re, ok := c.patterns[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		re = nil
+	}
+	if len(c.patterns) >= queryRegexCacheSize {
+		c.patterns = map[string]*regexp.Regexp{}
+	}
+	c.patterns[pattern] = re
+	return re
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 
@@ -24,6 +26,10 @@ type passwdForm struct {
 	Password string `form:"password" json:"password" binding:"required"`
 }
 
+type counterForm struct {
+	Value int `form:"value" json:"value" binding:"required"`
+}
+
 type userProfileForm struct {
 	UID   int    `json:"uid"`
 	GID   int    `json:"gid"`
@@ -38,6 +44,11 @@ type userProfileForm struct {
 	IsAdmin  bool `json:"is_admin"`
 
 	Tags []string `json:"tags"`
+
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	InactiveDays *int       `json:"inactive_days,omitempty"`
+
+	Revision int `json:"revision"`
 }
 
 func apiUpdatePassowrd(c *gin.Context) {
@@ -68,31 +79,73 @@ func apiUpdatePassowrd(c *gin.Context) {
 		}
 	}
 
-	user.Passwd(form.Password)
-
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
 
-	err := m.UserColl().
-		Update(
-			bson.M{"username": form.Username},
-			bson.M{"$set": bson.M{"password": user.Password}},
-		)
-	if err != nil {
+	// without If-Match the password is set on whatever revision is current
+	ifMatch := c.GetHeader("If-Match")
+	selector := bson.M{"username": form.Username, "deleted": nil}
+	before, target, err := modifyUser(m, selector, func(u *User) error {
+		if ifMatch != "" && !etagMatch(ifMatch, u.Revision) {
+			return errPreconditionFailed
+		}
+		u.Passwd(form.Password)
+		return nil
+	})
+	switch err {
+	case nil:
+	case errNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"msg": "No such user"})
+		return
+	case errPreconditionFailed:
+		c.Header("ETag", revisionETag(before.Revision))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"msg": "User has been modified, reload and retry"})
+		return
+	default:
 		err = fmt.Errorf("Failed to update password: %s", err.Error())
 		logger.Error(err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"msg": err.Error()})
 		return
 	}
+	writeAudit(m, httpActor(c), "user.passwd", auditTargetUser, target.Username, before, target)
+	c.Header("ETag", revisionETag(target.Revision))
 	c.JSON(http.StatusOK, gin.H{"msg": "Password updated"})
 }
 
+func apiGetUser(c *gin.Context) {
+	iuser, _ := c.Get("user")
+	user, ok := iuser.(User)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "Login Required"})
+		return
+	}
+	username := c.Param("username")
+	if user.Username != username && !user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "Permission Denied"})
+		return
+	}
+
+	m := getStore()
+	defer m.Close()
+	users, err := m.ListUsers(bson.M{"username": username, "deleted": nil})
+	if err != nil {
+		err = fmt.Errorf("Failed to get user: %s", err.Error())
+		logger.Error(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": err.Error()})
+		return
+	} else if len(users) != 1 {
+		c.JSON(http.StatusNotFound, gin.H{"msg": "No such user"})
+		return
+	}
+	c.Header("ETag", revisionETag(users[0].Revision))
+	c.JSON(http.StatusOK, newUserProfile(users[0]))
+}
+
 func apiListUsers(c *gin.Context) {
 
-	m := getMongo()
+	m := getStore()
 	defer m.Close()
-	users := []userProfileForm{}
-	err := m.UserColl().Find(bson.M{}).All(&users)
+	users, err := m.ListUsers(bson.M{"deleted": nil})
 	if err != nil {
 		err = fmt.Errorf("Failed to list users: %s", err.Error())
 		logger.Error(err.Error())
@@ -100,5 +153,110 @@ func apiListUsers(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"users": users})
+	profiles := []userProfileForm{}
+	for _, u := range users {
+		profiles = append(profiles, newUserProfile(u))
+	}
+	c.JSON(http.StatusOK, gin.H{"users": profiles})
+}
+
+func newUserProfile(u User) userProfileForm {
+	return userProfileForm{
+		UID:        u.UID,
+		GID:        u.GID,
+		Name:       u.Name,
+		Email:      u.Email,
+		Phone:      u.Phone,
+		Username:   u.Username,
+		LoginShell: u.LoginShell,
+		IsActive:   u.IsActive,
+		IsAdmin:    u.IsAdmin,
+		Tags:       u.Tags,
+
+		ExpiresAt:    u.ExpiresAt,
+		InactiveDays: u.InactiveDays,
+
+		Revision: u.Revision,
+	}
+}
+
+func apiListAudit(c *gin.Context) {
+	iuser, _ := c.Get("user")
+	if user, ok := iuser.(User); !ok || !user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "Permission Denied"})
+		return
+	}
+
+	since, err := parseAuditTime(c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+		return
+	}
+	until, untilExclusive, err := parseAuditUntil(c.Query("until"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "Invalid limit"})
+		return
+	}
+
+	m := getStore()
+	defer m.Close()
+
+	filter := auditQuery(c.Query("user"), c.Query("actor"), c.Query("action"), since, until, untilExclusive)
+	records, err := m.ListAudit(filter, limit)
+	if err != nil {
+		err = fmt.Errorf("Failed to list audit logs: %s", err.Error())
+		logger.Error(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
+
+func apiListCounters(c *gin.Context) {
+	iuser, _ := c.Get("user")
+	if user, ok := iuser.(User); !ok || !user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "Permission Denied"})
+		return
+	}
+
+	m := getStore()
+	defer m.Close()
+
+	counters, err := listCounterInfo(m, dcfg.TUNA)
+	if err != nil {
+		err = fmt.Errorf("Failed to list counters: %s", err.Error())
+		logger.Error(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"counters": counters})
+}
+
+func apiSetCounter(c *gin.Context) {
+	iuser, _ := c.Get("user")
+	if user, ok := iuser.(User); !ok || !user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"msg": "Permission Denied"})
+		return
+	}
+
+	var form counterForm
+	if c.BindJSON(&form) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": "Invalid Request"})
+		return
+	}
+
+	m := getStore()
+	defer m.Close()
+
+	err := raiseCounter(m, dcfg.TUNA, c.Param("name"), form.Value, httpActor(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"msg": "Counter updated"})
 }
@@ -0,0 +1,93 @@
+// optimistic concurrency control of users and groups
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxConflictRetries bounds read-modify-write attempts
+const maxConflictRetries = 3
+
+var (
+	// returned by modify functions to skip the update
+	errNoChange = errors.New("No change")
+	// returned by modify functions when If-Match does not hold
+	errPreconditionFailed = errors.New("Precondition failed")
+)
+
+// modifyUser applies fn to the only user matching selector and writes
+// it back, the whole read-modify-write is retried on revision conflicts
+func modifyUser(m Store, selector bson.M, fn func(u *User) error) (before, after User, err error) {
+	for i := 0; i < maxConflictRetries; i++ {
+		users, err := m.ListUsers(selector)
+		if err != nil {
+			return before, after, err
+		} else if len(users) == 0 {
+			return before, after, errNotFound
+		} else if len(users) > 1 {
+			return before, after, fmt.Errorf("Not an exactly-one match for users: %v", selector)
+		}
+		before, after = users[0], copyUser(users[0])
+		if err := fn(&after); err != nil {
+			return before, after, err
+		}
+		err = m.UpdateUser(after)
+		if err == nil {
+			after.Revision++
+		}
+		if err != errConflict {
+			return before, after, err
+		}
+		logger.Warningf("User %s was modified concurrently, retrying", before.Username)
+	}
+	return before, after, errConflict
+}
+
+// modifyGroup is modifyUser for groups
+func modifyGroup(m Store, selector bson.M, fn func(g *PosixGroup) error) (before, after PosixGroup, err error) {
+	for i := 0; i < maxConflictRetries; i++ {
+		groups, err := m.ListGroups(selector)
+		if err != nil {
+			return before, after, err
+		} else if len(groups) == 0 {
+			return before, after, errNotFound
+		} else if len(groups) > 1 {
+			return before, after, fmt.Errorf("Not an exactly-one match for groups: %v", selector)
+		}
+		before, after = groups[0], copyGroup(groups[0])
+		if err := fn(&after); err != nil {
+			return before, after, err
+		}
+		err = m.UpdateGroup(after)
+		if err == nil {
+			after.Revision++
+		}
+		if err != errConflict {
+			return before, after, err
+		}
+		logger.Warningf("Group %s was modified concurrently, retrying", groupAuditName(before))
+	}
+	return before, after, errConflict
+}
+
+// revisionETag formats a revision as a strong entity tag
+func revisionETag(rev int) string {
+	return `"` + strconv.Itoa(rev) + `"`
+}
+
+// etagMatch evaluates an If-Match header against a revision
+func etagMatch(ifMatch string, rev int) bool {
+	etag := revisionETag(rev)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
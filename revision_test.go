@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRevision(t *testing.T) {
+	Convey("Test optimistic concurrency", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+		So(m.InsertUser(User{UID: 2001, Username: "zhangsan", Email: "zhangsan@example.com"}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 3001, Name: "dev", Tag: "testing"}), ShouldBeNil)
+
+		Convey("Concurrent modifications should be retried", func() {
+			calls := 0
+			_, group, err := modifyGroup(m, bson.M{"gid": 3001}, func(g *PosixGroup) error {
+				calls++
+				if calls == 1 {
+					// another writer sneaks in
+					_, _, err := modifyGroup(m, bson.M{"gid": 3001}, func(g *PosixGroup) error {
+						g.Members = append(g.Members, "lisi")
+						return nil
+					})
+					So(err, ShouldBeNil)
+				}
+				g.Members = append(g.Members, "zhangsan")
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(calls, ShouldEqual, 2)
+			So(group.Members, ShouldResemble, []string{"lisi", "zhangsan"})
+			So(group.Revision, ShouldEqual, 2)
+
+			groups, _ := m.ListGroups(bson.M{"gid": 3001})
+			So(groups[0], ShouldResemble, group)
+		})
+
+		Convey("Modifications should give up after retries", func() {
+			_, _, err := modifyUser(m, bson.M{"username": "zhangsan"}, func(u *User) error {
+				other, _ := m.ListUsers(bson.M{"username": "zhangsan"})
+				So(m.UpdateUser(other[0]), ShouldBeNil)
+				u.LoginShell = "/bin/zsh"
+				return nil
+			})
+			So(err, ShouldEqual, errConflict)
+
+			_, _, err = modifyUser(m, bson.M{"username": "zhangsan"}, func(u *User) error {
+				return errNoChange
+			})
+			So(err, ShouldEqual, errNoChange)
+			_, _, err = modifyUser(m, bson.M{"username": "nobody"}, func(u *User) error { return nil })
+			So(err, ShouldEqual, errNotFound)
+		})
+
+		Convey("Failed updates should keep the revision", func() {
+			So(m.InsertUser(User{UID: 2002, Username: "lisi", Email: "lisi@example.com"}), ShouldBeNil)
+			_, user, err := modifyUser(m, bson.M{"username": "lisi"}, func(u *User) error {
+				u.Username = "zhangsan"
+				return nil
+			})
+			So(err, ShouldNotBeNil)
+			So(user.Revision, ShouldEqual, 0)
+		})
+
+		Convey("If-Match should be evaluated against revisions", func() {
+			So(revisionETag(3), ShouldEqual, `"3"`)
+			So(etagMatch(`"3"`, 3), ShouldBeTrue)
+			So(etagMatch(`"1", "3"`, 3), ShouldBeTrue)
+			So(etagMatch(`*`, 3), ShouldBeTrue)
+			So(etagMatch(`"2"`, 3), ShouldBeFalse)
+		})
+	})
+}
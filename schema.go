@@ -0,0 +1,106 @@
+// database layout versioning
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A schemaMigration upgrades the database layout to Version.
+// Up must be idempotent, it is re-run if the upgrade was interrupted.
+type schemaMigration struct {
+	Version int
+	Desc    string
+	Up      func(s Store) error
+}
+
+// schemaMigrations must be ordered by version,
+// append new steps when changing User or PosixGroup
+var schemaMigrations = []schemaMigration{
+	{
+		Version: 1,
+		Desc:    "rewrite users and groups with complete fields",
+		Up:      resaveDocuments,
+	},
+	{
+		// old documents lack the revision field that updates match on
+		Version: 2,
+		Desc:    "add revisions to users and groups",
+		Up:      resaveDocuments,
+	},
+}
+
+func latestSchemaVersion(migrations []schemaMigration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// upgradeSchema runs pending migrations in order
+func upgradeSchema(s Store, migrations []schemaMigration) error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := latestSchemaVersion(migrations); version > latest {
+		return fmt.Errorf("Database schema version %d is newer than supported version %d", version, latest)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		logger.Noticef("Upgrading database schema to version %d: %s", m.Version, m.Desc)
+		if err := m.Up(s); err != nil {
+			return fmt.Errorf("Failed to upgrade schema to version %d: %s", m.Version, err.Error())
+		}
+		if err := s.SetSchemaVersion(m.Version); err != nil {
+			return err
+		}
+		version = m.Version
+	}
+	return nil
+}
+
+// checkSchema refuses databases that are not on the latest version,
+// used by commands besides the daemon and migrate, and in read-only mode
+func checkSchema(s Store, migrations []schemaMigration) error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := latestSchemaVersion(migrations); version != latest {
+		return fmt.Errorf(
+			"Database schema version is %d, but %d is required, "+
+				"please start a writable daemon to upgrade it first",
+			version, latest,
+		)
+	}
+	return nil
+}
+
+// resaveDocuments writes back every user and group,
+// so that fields missing in old documents are filled with defaults
+func resaveDocuments(s Store) error {
+	users, err := s.ListUsers(bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := s.UpdateUser(u); err != nil {
+			return err
+		}
+	}
+	groups, err := s.ListGroups(bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if err := s.UpdateGroup(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
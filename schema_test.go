@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchema(t *testing.T) {
+	Convey("Test schema migrations", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		s := newMemoryStore()
+		So(s.InsertUser(User{UID: 2001, Username: "zhangsan"}), ShouldBeNil)
+
+		runs := 0
+		migrations := []schemaMigration{
+			{Version: 1, Desc: "noop", Up: func(s Store) error { return nil }},
+			{Version: 2, Desc: "activate users", Up: func(s Store) error {
+				runs++
+				users, _ := s.ListUsers(bson.M{})
+				for _, u := range users {
+					u.IsActive = true
+					s.UpdateUser(u)
+				}
+				return nil
+			}},
+		}
+
+		Convey("Fresh database should be upgraded to the latest", func() {
+			So(checkSchema(s, migrations), ShouldNotBeNil)
+			So(upgradeSchema(s, migrations), ShouldBeNil)
+			version, _ := s.SchemaVersion()
+			So(version, ShouldEqual, 2)
+			So(len(s.FindUsers(bson.M{}, "")), ShouldEqual, 1)
+			So(checkSchema(s, migrations), ShouldBeNil)
+
+			So(upgradeSchema(s, migrations), ShouldBeNil)
+			So(runs, ShouldEqual, 1)
+		})
+
+		Convey("Only pending migrations should run", func() {
+			s.SetSchemaVersion(2)
+			So(upgradeSchema(s, migrations), ShouldBeNil)
+			So(runs, ShouldEqual, 0)
+		})
+
+		Convey("Failed migration should keep the version", func() {
+			migrations = append(migrations, schemaMigration{
+				Version: 3, Desc: "broken",
+				Up: func(s Store) error { return errors.New("broken") },
+			})
+			So(upgradeSchema(s, migrations), ShouldNotBeNil)
+			version, _ := s.SchemaVersion()
+			So(version, ShouldEqual, 2)
+		})
+
+		Convey("Newer database should be refused", func() {
+			s.SetSchemaVersion(3)
+			So(upgradeSchema(s, migrations), ShouldNotBeNil)
+		})
+
+		Convey("Builtin migrations should be idempotent", func() {
+			So(upgradeSchema(s, schemaMigrations), ShouldBeNil)
+			for _, m := range schemaMigrations {
+				So(m.Up(s), ShouldBeNil)
+			}
+			So(checkSchema(s, schemaMigrations), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,133 @@
+// password ageing and account expiry of shadowAccount
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+// validateShadowConfig checks the password ageing policy
+func validateShadowConfig(cfg TUNAConfig) error {
+	switch {
+	case cfg.PasswordMaxDays <= 0:
+		return errors.New("password_max_days must be positive")
+	case cfg.PasswordMinDays < 0 || cfg.PasswordWarnDays < 0:
+		return errors.New("password_min_days and password_warn_days cannot be negative")
+	case cfg.InactiveDays < -1:
+		return errors.New("inactive_days must be -1 or more")
+	}
+	return nil
+}
+
+// shadowDays is the number of days since the epoch, as shadowLastChange
+// and shadowExpire count dates. It is empty if t is nil.
+func shadowDays(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return strconv.FormatInt(t.Unix()/secondsPerDay, 10)
+}
+
+// shadowInactive is the days an expired password may still be changed,
+// empty for ever
+func shadowInactive(u User, cfg TUNAConfig) string {
+	days := cfg.InactiveDays
+	if u.InactiveDays != nil {
+		days = *u.InactiveDays
+	}
+	if days < 0 {
+		return ""
+	}
+	return strconv.Itoa(days)
+}
+
+// shadowAttributes are the shadowAccount attributes of a user under the
+// password ageing policy. Users without a password change are not aged.
+func shadowAttributes(u User, cfg TUNAConfig) []ldapAttribute {
+	return []ldapAttribute{
+		{"shadowLastChange", []string{shadowDays(u.PasswordChangedAt)}},
+		{"shadowMin", []string{strconv.Itoa(cfg.PasswordMinDays)}},
+		{"shadowMax", []string{strconv.Itoa(cfg.PasswordMaxDays)}},
+		{"shadowWarning", []string{strconv.Itoa(cfg.PasswordWarnDays)}},
+		{"shadowInactive", []string{shadowInactive(u, cfg)}},
+		{"shadowExpire", []string{shadowDays(u.ExpiresAt)}},
+	}
+}
+
+// shadowValue is the integer of a single-valued shadow attribute
+func shadowValue(attr ldapAttribute) (int, error) {
+	if len(attr.Values) != 1 {
+		return 0, ldapErrorf(ldap.LDAPResultConstraintViolation, "%s is single-valued", attr.Name)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(attr.Values[0]))
+	if err != nil {
+		return 0, ldapErrorf(ldap.LDAPResultInvalidAttributeSyntax, "Invalid %s: %s", attr.Name, attr.Values[0])
+	}
+	return n, nil
+}
+
+// shadowFromLDAP sets the account expiry and inactivity of out from
+// shadowExpire and shadowInactive, which are kept as in u if unchanged
+func shadowFromLDAP(u User, out *User, attrs []ldapAttribute) error {
+	out.ExpiresAt, out.InactiveDays = nil, nil
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "shadowExpire":
+			n, err := shadowValue(attr)
+			if err != nil {
+				return err
+			}
+			switch {
+			case strconv.Itoa(n) == shadowDays(u.ExpiresAt):
+				out.ExpiresAt = u.ExpiresAt
+			case n >= 0:
+				t := time.Unix(int64(n)*secondsPerDay, 0).UTC()
+				out.ExpiresAt = &t
+			}
+		case "shadowInactive":
+			n, err := shadowValue(attr)
+			if err != nil {
+				return err
+			}
+			if strconv.Itoa(n) == shadowInactive(u, dcfg.TUNA) {
+				out.InactiveDays = u.InactiveDays
+			} else if n >= 0 {
+				out.InactiveDays = &n
+			}
+		}
+	}
+	return nil
+}
+
+// parseExpiry parses the date an account expires on, as given to
+// `user modify --expires`. "never" removes the expiry.
+func parseExpiry(s string) (*time.Time, error) {
+	if s == "never" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expiry date %q, use YYYY-MM-DD or never", s)
+	}
+	return &t, nil
+}
+
+// parseInactiveDays parses the inactivity of a user, as given to
+// `user modify --inactive`. "default" follows inactive_days.
+func parseInactiveDays(s string) (*int, error) {
+	if s == "default" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 {
+		return nil, fmt.Errorf("Invalid inactive days %q, use -1 or more, or default", s)
+	}
+	return &n, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShadow(t *testing.T) {
+	Convey("Shadow attributes follow the policy", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		So(validateShadowConfig(dcfg.TUNA), ShouldBeNil)
+		for _, bad := range []TUNAConfig{{}, {PasswordMaxDays: 90, PasswordWarnDays: -1}, {PasswordMaxDays: 90, InactiveDays: -2}} {
+			So(validateShadowConfig(bad), ShouldNotBeNil)
+		}
+
+		value := func(u User, name string) string {
+			attrs := entryAttributes(userAttributes(u))
+			if i := findLDAPAttribute(attrs, name); i >= 0 {
+				return attrs[i].Values[0]
+			}
+			return ""
+		}
+		u := User{UID: 2000, GID: 2000, Username: "lisi"}
+		So(value(u, "shadowMax"), ShouldEqual, "99999")
+		So(value(u, "shadowLastChange"), ShouldEqual, "")
+		So(value(u, "shadowInactive"), ShouldEqual, "")
+		So(value(u, "shadowExpire"), ShouldEqual, "")
+
+		u.Passwd("pass")
+		So(value(u, "shadowLastChange"), ShouldEqual, strconv.FormatInt(time.Now().Unix()/secondsPerDay, 10))
+
+		dcfg.TUNA.PasswordMaxDays, dcfg.TUNA.InactiveDays = 90, 14
+		expire := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+		never := -1
+		u.ExpiresAt = &expire
+		So(value(u, "shadowMax"), ShouldEqual, "90")
+		So(value(u, "shadowInactive"), ShouldEqual, "14")
+		So(value(u, "shadowExpire"), ShouldEqual, "20819")
+		u.InactiveDays = &never
+		So(value(u, "shadowInactive"), ShouldEqual, "")
+	})
+
+	Convey("Expiry and inactivity are written over LDAP", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		u := User{UID: 2000, GID: 2000, Username: "lisi"}
+		u.Passwd("pass")
+		lastChange := time.Unix(0, 0)
+		u.PasswordChangedAt = &lastChange
+
+		modify := func(u User, op int, attr ldapAttribute) (User, int) {
+			attrs := entryAttributes(userAttributes(u))
+			attrs, err := applyLDAPChange(attrs, op, attr)
+			So(err, ShouldBeNil)
+			out, err := userFromLDAP(u, attrs)
+			c, _ := ldapResultOf(err)
+			return out, c
+		}
+		add := ldapMsg.ModifyRequestChangeOperationAdd
+
+		out, c := modify(u, add, ldapAttribute{"shadowExpire", []string{"20819"}})
+		So(c, ShouldEqual, ldap.LDAPResultSuccess)
+		So(out.ExpiresAt.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+		out, c = modify(out, ldapMsg.ModifyRequestChangeOperationDelete, ldapAttribute{"shadowExpire", nil})
+		So(c, ShouldEqual, ldap.LDAPResultSuccess)
+		So(out.ExpiresAt, ShouldBeNil)
+
+		out, c = modify(u, add, ldapAttribute{"shadowInactive", []string{"7"}})
+		So(c, ShouldEqual, ldap.LDAPResultSuccess)
+		So(*out.InactiveDays, ShouldEqual, 7)
+		_, c = modify(u, add, ldapAttribute{"shadowInactive", []string{"never"}})
+		So(c, ShouldEqual, ldap.LDAPResultInvalidAttributeSyntax)
+		_, c = modify(u, ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"shadowMax", []string{"30"}})
+		So(c, ShouldEqual, ldap.LDAPResultConstraintViolation)
+		_, c = modify(u, ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"shadowLastChange", []string{"1"}})
+		So(c, ShouldEqual, ldap.LDAPResultConstraintViolation)
+
+		// a new password restarts its ageing
+		out, c = modify(u, ldapMsg.ModifyRequestChangeOperationReplace, ldapAttribute{"userPassword", []string{"new"}})
+		So(c, ShouldEqual, ldap.LDAPResultSuccess)
+		So(out.Authenticate("new"), ShouldBeTrue)
+		So(out.PasswordChangedAt.After(lastChange), ShouldBeTrue)
+	})
+
+	Convey("Expiry and inactivity are set by administrators", t, func() {
+		expires, err := parseExpiry("2027-01-01")
+		So(err, ShouldBeNil)
+		So(shadowDays(expires), ShouldEqual, "20819")
+		expires, err = parseExpiry("never")
+		So(err, ShouldBeNil)
+		So(expires, ShouldBeNil)
+		_, err = parseExpiry("2027/01/01")
+		So(err, ShouldNotBeNil)
+
+		days, err := parseInactiveDays("-1")
+		So(err, ShouldBeNil)
+		So(*days, ShouldEqual, -1)
+		days, err = parseInactiveDays("default")
+		So(err, ShouldBeNil)
+		So(days, ShouldBeNil)
+		for _, bad := range []string{"-2", "never"} {
+			_, err := parseInactiveDays(bad)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Password changes survive bson", t, func() {
+		u := (&User{UID: 2000, Username: "lisi"}).Passwd("pass")
+		data, err := bson.Marshal(u)
+		So(err, ShouldBeNil)
+		var out User
+		So(bson.Unmarshal(data, &out), ShouldBeNil)
+		So(out.PasswordChangedAt.Equal(*u.PasswordChangedAt), ShouldBeTrue)
+	})
+}
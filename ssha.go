@@ -36,6 +36,15 @@ func validateSSHA(password string, hash string) bool {
 	return false
 }
 
+// isSSHAHash reports whether hash is in the format of generateSSHA
+func isSSHAHash(hash string) bool {
+	if len(hash) < 7 || hash[:6] != "{SSHA}" {
+		return false
+	}
+	data, err := base64.StdEncoding.DecodeString(hash[6:])
+	return err == nil && len(data) >= 21
+}
+
 func createSSHAHash(password string, salt []byte) []byte {
 	pass := []byte(password)
 	str := append(pass, salt...)
@@ -0,0 +1,84 @@
+// SSH public keys of users
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errSSHKeyOptions   = errors.New("SSH key options are not supported")
+	errDuplicateSSHKey = errors.New("Duplicate SSH key")
+)
+
+// parseSSHKey validates a key in the authorized_keys format, and returns
+// it as "type base64 [comment]" with its SHA256 fingerprint
+func parseSSHKey(key string) (normalized, fingerprint string, err error) {
+	pub, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid SSH key: %s", err.Error())
+	}
+	if len(options) > 0 {
+		return "", "", errSSHKeyOptions
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return "", "", errors.New("Invalid SSH key: only one key is allowed")
+	}
+	normalized = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		normalized += " " + comment
+	}
+	return normalized, ssh.FingerprintSHA256(pub), nil
+}
+
+// checkSSHKeys normalizes the keys of a user and refuses the same key
+// twice. Keys in known are kept as they are.
+func checkSSHKeys(keys, known []string) ([]string, error) {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		normalized, fingerprint, err := parseSSHKey(key)
+		if err != nil {
+			if !stringInSlice(key, known) {
+				return nil, err
+			}
+			normalized, fingerprint = key, key
+		}
+		if seen[fingerprint] {
+			return nil, errDuplicateSSHKey
+		}
+		seen[fingerprint] = true
+		res = append(res, normalized)
+	}
+	return res, nil
+}
+
+// sshKeyFingerprints returns the fingerprints of valid keys
+func sshKeyFingerprints(keys []string) []string {
+	res := []string{}
+	for _, key := range keys {
+		if _, fingerprint, err := parseSSHKey(key); err == nil {
+			res = append(res, fingerprint)
+		}
+	}
+	return res
+}
+
+// logSSHKeyChanges logs the fingerprints of keys added to and removed
+// from a user
+func logSSHKeyChanges(username string, before, after []string) {
+	old, cur := sshKeyFingerprints(before), sshKeyFingerprints(after)
+	for _, fingerprint := range cur {
+		if !stringInSlice(fingerprint, old) {
+			logger.Noticef("Added SSH key %s for %s", fingerprint, username)
+		}
+	}
+	for _, fingerprint := range old {
+		if !stringInSlice(fingerprint, cur) {
+			logger.Noticef("Removed SSH key %s of %s", fingerprint, username)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ldapMsg "github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testSSHKey      = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEsBFZgCujm1d1lD1p5ur5j2KIcnLYw3ZCwxS0CRVylk lisi@laptop"
+	testSSHKeyPrint = "SHA256:DPrjPkdKG7/cvTnER2vOBIj6enWUkL8R7RHeGBMG+q8"
+	testSSHKey2     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIF2f8YQa/n7IXdrCdGCqY+HM+HWNuaxCZT460MUXEOsZ"
+)
+
+func TestSSHKeys(t *testing.T) {
+	Convey("SSH keys are validated and fingerprinted", t, func() {
+		key, fingerprint, err := parseSSHKey("  ssh-ed25519   AAAAC3NzaC1lZDI1NTE5AAAAIEsBFZgCujm1d1lD1p5ur5j2KIcnLYw3ZCwxS0CRVylk   lisi@laptop\n")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, testSSHKey)
+		So(fingerprint, ShouldEqual, testSSHKeyPrint)
+
+		for _, bad := range []string{"", "ssh-rsa AAAA", "lisi@laptop", testSSHKey + "\n" + testSSHKey2} {
+			_, _, err := parseSSHKey(bad)
+			So(err, ShouldNotBeNil)
+		}
+		_, _, err = parseSSHKey(`from="10.0.0.1" ` + testSSHKey)
+		So(err, ShouldEqual, errSSHKeyOptions)
+
+		keys, err := checkSSHKeys([]string{testSSHKey, testSSHKey2 + " "}, nil)
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{testSSHKey, testSSHKey2})
+		_, err = checkSSHKeys([]string{testSSHKey, testSSHKey[:len(testSSHKey)-len(" lisi@laptop")]}, nil)
+		So(err, ShouldEqual, errDuplicateSSHKey)
+
+		// keys stored before validation are kept
+		keys, err = checkSSHKeys([]string{"ssh-rsa AAAA", testSSHKey}, []string{"ssh-rsa AAAA"})
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"ssh-rsa AAAA", testSSHKey})
+		So(sshKeyFingerprints(keys), ShouldResemble, []string{testSSHKeyPrint})
+	})
+
+	Convey("SSH keys are published and written over LDAP", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		u := User{UID: 2000, GID: 2000, Username: "lisi", SSHKeys: []string{testSSHKey}}
+		e := userEntry(u)
+		So(e.Attrs[findLDAPAttribute(e.Attrs, "sshPublicKey")].Values, ShouldResemble, []string{testSSHKey})
+		So(e.Attrs[findLDAPAttribute(e.Attrs, "objectClass")].Values, ShouldContain, "ldapPublicKey")
+
+		f, err := parseLDAPFilter("(&(objectClass=ldapPublicKey)(sshPublicKey=" + testSSHKey + "))")
+		So(err, ShouldBeNil)
+		So(evalLDAPFilter(f, userAttributes(u), userldap2bson), ShouldEqual, evalTrue)
+
+		attrs := entryAttributes(userAttributes(u))
+		attrs, err = applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"sshPublicKey", []string{testSSHKey2}})
+		So(err, ShouldBeNil)
+		out, err := userFromLDAP(u, attrs)
+		So(err, ShouldBeNil)
+		So(out.SSHKeys, ShouldResemble, []string{testSSHKey, testSSHKey2})
+
+		code := func(key string) int {
+			attrs := entryAttributes(userAttributes(u))
+			attrs, err := applyLDAPChange(attrs, ldapMsg.ModifyRequestChangeOperationAdd, ldapAttribute{"sshPublicKey", []string{key}})
+			So(err, ShouldBeNil)
+			_, err = userFromLDAP(u, attrs)
+			c, _ := ldapResultOf(err)
+			return c
+		}
+		So(code("ssh-rsa AAAA"), ShouldEqual, ldap.LDAPResultInvalidAttributeSyntax)
+		So(code(testSSHKey[:len(testSSHKey)-len(" lisi@laptop")]), ShouldEqual, ldap.LDAPResultAttributeOrValueExists)
+	})
+}
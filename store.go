@@ -0,0 +1,201 @@
+// storage backend abstraction
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	errNotFound     = errors.New("Not found")
+	errDuplicateKey = errors.New("Duplicate key")
+	errConflict     = errors.New("Revision conflict")
+)
+
+// A Store is a tunaccount database backend.
+// Filters passed to a Store are MongoDB style query documents,
+// e.g. the ones generated by ldapFilterToBson, so that every
+// backend shares the same filtering semantics.
+type Store interface {
+	// Copy returns a store handle for a single unit of work,
+	// which must be released with Close
+	Copy() Store
+	Close()
+
+	// FindUsers returns the active users that match filter and have
+	// a specified tag, admins are visible under all tags
+	FindUsers(filter bson.M, tag string) []User
+	// ListUsers returns all users that match filter ordered by UID
+	ListUsers(filter bson.M) ([]User, error)
+	// EachUser calls fn on every user that matches filter in UID order,
+	// and stops at the first error. fn must not write to the same store.
+	EachUser(filter bson.M, fn func(User) error) error
+	InsertUser(user User) error
+	// UpdateUser replaces the user identified by UID if its stored
+	// revision equals user.Revision, and stores it with the next
+	// revision. errConflict is returned if someone else updated it.
+	UpdateUser(user User) error
+	// DeleteUser removes the user permanently, see softDeleteUser
+	DeleteUser(uid int) error
+
+	// FindGroups returns the active groups that match filter
+	// and are either universal or have a specified tag
+	FindGroups(filter bson.M, tag string) []PosixGroup
+	// ListGroups returns all groups that match filter ordered by GID and tag
+	ListGroups(filter bson.M) ([]PosixGroup, error)
+	// EachGroup is the ListGroups counterpart of EachUser, but ordered
+	// by tag and GID like the unique keys of groups, so that backends
+	// stream groups without sorting them
+	EachGroup(filter bson.M, fn func(PosixGroup) error) error
+	InsertGroup(group PosixGroup) error
+	// UpdateGroup replaces the group identified by tag and GID,
+	// with the same revision check as UpdateUser
+	UpdateGroup(group PosixGroup) error
+	DeleteGroup(tag string, gid int) error
+
+	// EnsureTag creates the filter tag if it does not exist
+	EnsureTag(tagName string) error
+	InsertTag(tag FilterTag) error
+	UpdateTag(tag FilterTag) error
+	DeleteTag(tagName string) error
+	// ListTags returns all tags including deleted ones
+	ListTags() ([]FilterTag, error)
+
+	InsertAudit(rec AuditRecord) error
+	// ListAudit returns the latest limit audit records that match
+	// filter in chronological order, 0 means no limit
+	ListAudit(filter bson.M, limit int) ([]AuditRecord, error)
+
+	// SchemaVersion returns the version of database layout, 0 if unset
+	SchemaVersion() (int, error)
+	SetSchemaVersion(version int) error
+
+	// ListCounters returns current values of all ID counters
+	ListCounters() (map[string]int, error)
+	// nextSeq increments a counter and returns the new value,
+	// missing counters start from 0, see idAllocator for issuing IDs
+	nextSeq(ID string) (int, error)
+	// ensureCounterMin raises a counter to val, creating it if missing
+	ensureCounterMin(ID string, val int) error
+}
+
+var _store Store
+
+// initStore opens the backend specified in daemon config
+func initStore() error {
+	s, err := openStore(dcfg.DB, dcfg.ReadOnly)
+	if err != nil {
+		return err
+	}
+	_store = s
+	return nil
+}
+
+// openStore opens a backend, which is not initialized if readOnly
+func openStore(c DatabaseConfig, readOnly bool) (Store, error) {
+	switch c.Backend {
+	case DBEnumMongo:
+		m, err := openMongo(c, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case DBEnumMemory:
+		return newMemoryStore(), nil
+	case DBEnumBolt:
+		b, err := openBolt(c, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("Unsupported database backend: %d", c.Backend)
+}
+
+func getStore() Store {
+	return _store.Copy()
+}
+
+func validateTagName(tagName string) error {
+	tagRegex := regexp.MustCompile(`[\w-]+`)
+	if !tagRegex.MatchString(tagName) {
+		return errors.New("Tag must only contains '0-9', 'a-z', 'A-z' and '-'")
+	}
+	return nil
+}
+
+// userVisible is the non-filter part of FindUsers
+func userVisible(u *User, tag string) bool {
+	if !u.IsActive || u.Deleted != nil {
+		return false
+	}
+	if tag == "" || u.IsAdmin {
+		return true
+	}
+	return stringInSlice(tag, u.Tags)
+}
+
+// groupVisible is the non-filter part of FindGroups
+func groupVisible(g *PosixGroup, tag string) bool {
+	return g.IsActive && g.Deleted == nil && (g.Tag == "" || g.Tag == tag)
+}
+
+// visibleUsers is the query form of userVisible, for EachUser
+func visibleUsers(tag string) bson.M {
+	q := bson.M{"is_active": true, "deleted": nil}
+	if tag != "" {
+		q["$or"] = []bson.M{{"is_admin": true}, {"tags": tag}}
+	}
+	return q
+}
+
+// visibleGroups is the query form of groupVisible, for EachGroup
+func visibleGroups(tag string) bson.M {
+	return bson.M{"is_active": true, "deleted": nil, "tag": bson.M{"$in": []string{tag, ""}}}
+}
+
+func tagInList(name string, tags []FilterTag) bool {
+	return findTag(name, tags) != nil
+}
+
+func findTag(name string, tags []FilterTag) *FilterTag {
+	for i := range tags {
+		if tags[i].Name == name {
+			return &tags[i]
+		}
+	}
+	return nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// violatesUnique reports whether two documents of a collection collide
+// on any of the unique indexes declared in mgoIndexes
+func violatesUnique(coll string, a, b bson.M) bool {
+	for _, index := range mgoIndexes[coll] {
+		if !index.Unique {
+			continue
+		}
+		same := true
+		for _, key := range index.Key {
+			if !valuesEqual(a[key], b[key]) && !(a[key] == nil && b[key] == nil) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
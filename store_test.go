@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, "in-memory", DBEnumMemory)
+
+	Convey("In-memory store returns copies of documents", t, func() {
+		m := newMemoryStore()
+		days := 7
+		now := time.Now()
+		tombstone := &Tombstone{Reason: "left", Groups: []GroupRef{{GID: 2000}}}
+		So(m.InsertUser(User{UID: 2000, Username: "zhangsan", PasswordChangedAt: &now, ExpiresAt: &now, InactiveDays: &days, Deleted: tombstone}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "users", Deleted: tombstone}), ShouldBeNil)
+		So(m.InsertTag(FilterTag{Name: "testing", Deleted: tombstone}), ShouldBeNil)
+		tombstone.Reason = "changed"
+		tombstone.Groups[0].GID = 3000
+
+		users, _ := m.ListUsers(bson.M{})
+		u := users[0]
+		*u.PasswordChangedAt = now.Add(time.Hour)
+		*u.ExpiresAt = now.Add(time.Hour)
+		*u.InactiveDays = 0
+		u.Deleted.Groups[0].GID = 3000
+		groups, _ := m.ListGroups(bson.M{})
+		groups[0].Deleted.Reason = "changed"
+		tags, _ := m.ListTags()
+		tags[0].Deleted.Reason = "changed"
+
+		users, _ = m.ListUsers(bson.M{})
+		So(*users[0].PasswordChangedAt, ShouldEqual, now)
+		So(*users[0].ExpiresAt, ShouldEqual, now)
+		So(*users[0].InactiveDays, ShouldEqual, 7)
+		So(users[0].Deleted.Reason, ShouldEqual, "left")
+		So(users[0].Deleted.Groups[0].GID, ShouldEqual, 2000)
+		groups, _ = m.ListGroups(bson.M{})
+		So(groups[0].Deleted.Reason, ShouldEqual, "left")
+		tags, _ = m.ListTags()
+		So(tags[0].Deleted.Reason, ShouldEqual, "left")
+
+		rec := AuditRecord{Action: "user.tag", Changes: []AuditChange{
+			{Field: "tags", Before: []interface{}{"testing"}, After: []interface{}{"testing", "dev"}},
+		}}
+		So(m.InsertAudit(rec), ShouldBeNil)
+		rec.Changes[0].Field = "changed"
+		records, _ := m.ListAudit(bson.M{}, 0)
+		records[0].Changes[0].After.([]interface{})[1] = "changed"
+		records, _ = m.ListAudit(bson.M{}, 0)
+		So(records[0].Changes, ShouldResemble, []AuditChange{
+			{Field: "tags", Before: []interface{}{"testing"}, After: []interface{}{"testing", "dev"}},
+		})
+	})
+
+	Convey("Query patterns are compiled once", t, func() {
+		m := newMemoryStore()
+		So(m.InsertUser(User{UID: 2000, Username: "zhangsan", Email: "zhangsan@example.com"}), ShouldBeNil)
+		So(m.InsertUser(User{UID: 2001, Username: "Zhaoliu", Email: "zhaoliu@example.com"}), ShouldBeNil)
+
+		q := bson.M{"username": bson.RegEx{Pattern: "^zha", Options: "i"}}
+		users, _ := m.ListUsers(q)
+		So(len(users), ShouldEqual, 2)
+		re, ok := queryRegex(q["username"], nil)
+		So(ok, ShouldBeTrue)
+		again, _ := queryRegex("^zha", "i")
+		So(again, ShouldEqual, re)
+
+		_, ok = queryRegex("(", nil)
+		So(ok, ShouldBeFalse)
+		users, _ = m.ListUsers(bson.M{"username": bson.M{"$regex": "("}})
+		So(len(users), ShouldEqual, 0)
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, "bolt", DBEnumBolt)
+
+	Convey("Bolt store persists data", t, func() {
+		tmpdir, err := ioutil.TempDir("", "tunaccount")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		c := dcfg.DB
+		c.Backend = DBEnumBolt
+		c.Path = filepath.Join(tmpdir, "tunaccount.db")
+
+		s, err := openStore(c, false)
+		So(err, ShouldBeNil)
+		So(s.InsertUser(User{UID: testUID(s), Username: "zhangsan", IsActive: true}), ShouldBeNil)
+		So(s.EnsureTag("testing"), ShouldBeNil)
+		s.Close()
+
+		s, err = openStore(c, false)
+		So(err, ShouldBeNil)
+		defer s.Close()
+		So(len(s.FindUsers(bson.M{"username": "zhangsan"}, "")), ShouldEqual, 1)
+		tags, err := s.ListTags()
+		So(err, ShouldBeNil)
+		So(len(tags), ShouldEqual, 1)
+		So(testUID(s), ShouldEqual, 2001)
+	})
+
+	Convey("Bolt store locks the file only while it is used", t, func() {
+		tmpdir, err := ioutil.TempDir("", "tunaccount")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+
+		timeout := boltLockTimeout
+		boltLockTimeout = 100 * time.Millisecond
+		defer func() { boltLockTimeout = timeout }()
+
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		c := dcfg.DB
+		c.Backend = DBEnumBolt
+		c.Path = filepath.Join(tmpdir, "tunaccount.db")
+
+		// e.g. the daemon and a command
+		daemon, err := openStore(c, false)
+		So(err, ShouldBeNil)
+		defer daemon.Close()
+		cmd, err := openStore(c, false)
+		So(err, ShouldBeNil)
+		defer cmd.Close()
+
+		So(cmd.InsertUser(User{UID: 2000, Username: "zhangsan", Email: "zhangsan@example.com", IsActive: true}), ShouldBeNil)
+		So(len(daemon.FindUsers(bson.M{"username": "zhangsan"}, "")), ShouldEqual, 1)
+
+		m := daemon.Copy()
+		So(len(m.FindUsers(bson.M{}, "")), ShouldEqual, 1)
+		err = cmd.InsertUser(User{UID: 2001, Username: "lisi", Email: "lisi@example.com", IsActive: true})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "locked by another process")
+		m.Close()
+
+		So(cmd.InsertUser(User{UID: 2001, Username: "lisi", Email: "lisi@example.com", IsActive: true}), ShouldBeNil)
+		So(len(daemon.FindUsers(bson.M{}, "")), ShouldEqual, 2)
+	})
+}
+
+func TestBoltEach(t *testing.T) {
+	Convey("Bolt iterates over pages outside of transactions", t, func() {
+		tmpdir, err := ioutil.TempDir("", "tunaccount")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		c := dcfg.DB
+		c.Backend = DBEnumBolt
+		c.Path = filepath.Join(tmpdir, "tunaccount.db")
+		s, err := openStore(c, false)
+		So(err, ShouldBeNil)
+		defer s.Close()
+
+		n := 2*boltPageSize + 10
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("user%d", i)
+			So(s.InsertUser(User{UID: 2000 + i, Username: name, Email: name + "@example.com", IsActive: i%2 == 0}), ShouldBeNil)
+		}
+
+		uids := []int{}
+		err = s.EachUser(bson.M{"is_active": true}, func(u User) error {
+			uids = append(uids, u.UID)
+			// writers are not blocked while fn runs
+			u.LoginShell = "/bin/zsh"
+			return s.UpdateUser(u)
+		})
+		So(err, ShouldBeNil)
+		So(len(uids), ShouldEqual, (n+1)/2)
+		So(sort.IntsAreSorted(uids), ShouldBeTrue)
+		So(len(s.FindUsers(bson.M{"login_shell": "/bin/zsh"}, "")), ShouldEqual, (n+1)/2)
+
+		stop := errors.New("stop")
+		cnt := 0
+		err = s.EachUser(bson.M{}, func(u User) error {
+			if cnt++; cnt == boltPageSize+1 {
+				return stop
+			}
+			return nil
+		})
+		So(err, ShouldEqual, stop)
+		So(cnt, ShouldEqual, boltPageSize+1)
+	})
+}
+
+// testUID allocates a UID for fixtures
+func testUID(m Store) int {
+	uid, err := allocateUID(m)
+	if err != nil {
+		panic(err)
+	}
+	return uid
+}
+
+// testGID allocates a GID of universal groups for fixtures
+func testGID(m Store) int {
+	gid, err := allocateGID(m, "")
+	if err != nil {
+		panic(err)
+	}
+	return gid
+}
+
+// testStore checks that a backend follows the semantics of mongoCtx,
+// MongoDB runs it in TestMongo
+func testStore(t *testing.T, name string, backend dbBackendEnum) {
+	Convey("Test "+name+" store", t, func() {
+		tmpdir, err := ioutil.TempDir("", "tunaccount")
+		So(err, ShouldBeNil)
+
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		dcfg.DB.Backend = backend
+		dcfg.DB.Name = "tunaccount_test"
+		dcfg.DB.Path = filepath.Join(tmpdir, "tunaccount.db")
+		So(initStore(), ShouldBeNil)
+
+		m := getStore()
+		defer m.Close()
+
+		for _, u := range []User{
+			{
+				UID:        testUID(m),
+				GID:        2000,
+				Name:       "张三",
+				Email:      "zhangsan@example.com",
+				Username:   "zhangsan",
+				LoginShell: "/bin/bash",
+				IsActive:   true,
+			},
+			{
+				UID:        testUID(m),
+				GID:        2000,
+				Name:       "李四",
+				Email:      "lisi@example.com",
+				Username:   "lisi",
+				LoginShell: "/bin/bash",
+				IsActive:   false,
+				Tags:       []string{"testing"},
+			},
+			{
+				UID:        testUID(m),
+				GID:        2000,
+				Name:       "王尼玛",
+				Email:      "nima@example.com",
+				Username:   "wangnima",
+				LoginShell: "/bin/zsh",
+				IsActive:   true,
+				Tags:       []string{"testing"},
+			},
+		} {
+			So(m.InsertUser(u), ShouldBeNil)
+		}
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "users", IsActive: true}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2001, Name: "dev", Tag: "testing", IsActive: true}), ShouldBeNil)
+
+		Convey("When query all", func() {
+			allUsers, err := m.ListUsers(bson.M{})
+			So(err, ShouldBeNil)
+			So(len(allUsers), ShouldEqual, 3)
+			So(allUsers[0].UID, ShouldEqual, 2000)
+		})
+
+		Convey("When query with filters", func() {
+			So(len(m.FindUsers(bson.M{}, "")), ShouldEqual, 2)
+			So(len(m.FindUsers(bson.M{}, "testing")), ShouldEqual, 1)
+			So(len(m.FindUsers(bson.M{}, "ooxx")), ShouldEqual, 0)
+
+			users := m.FindUsers(bson.M{"$or": []bson.M{
+				{"username": "zhangsan"},
+				{"_id": bson.M{"$gte": 2002}},
+			}}, "")
+			So(len(users), ShouldEqual, 2)
+
+			users = m.FindUsers(bson.M{"login_shell": "/bin/zsh"}, "")
+			So(len(users), ShouldEqual, 1)
+			So(users[0].Username, ShouldEqual, "wangnima")
+
+			So(len(m.FindGroups(bson.M{}, "")), ShouldEqual, 1)
+			So(len(m.FindGroups(bson.M{}, "testing")), ShouldEqual, 2)
+			So(len(m.FindGroups(bson.M{"members": "zhangsan"}, "testing")), ShouldEqual, 0)
+		})
+
+		Convey("When violating unique indexes", func() {
+			err := m.InsertUser(User{UID: 3000, Username: "zhangsan", Email: "zs@example.com"})
+			So(err, ShouldEqual, errDuplicateKey)
+			err = m.InsertUser(User{UID: 3000, Username: "zs", Email: "zhangsan@example.com"})
+			So(err, ShouldEqual, errDuplicateKey)
+			err = m.InsertGroup(PosixGroup{GID: 2002, Name: "dev", Tag: "testing"})
+			So(err, ShouldEqual, errDuplicateKey)
+			err = m.InsertGroup(PosixGroup{GID: 2002, Name: "dev", Tag: "other"})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When updating records", func() {
+			users, _ := m.ListUsers(bson.M{"username": "lisi"})
+			So(len(users), ShouldEqual, 1)
+			user := users[0]
+			user.IsActive = true
+			So(m.UpdateUser(user), ShouldBeNil)
+			So(len(m.FindUsers(bson.M{}, "testing")), ShouldEqual, 2)
+
+			groups, _ := m.ListGroups(bson.M{"name": "users"})
+			So(len(groups), ShouldEqual, 1)
+			group := groups[0]
+			group.Members = append(group.Members, "lisi")
+			So(m.UpdateGroup(group), ShouldBeNil)
+			So(len(m.FindGroups(bson.M{"members": "lisi"}, "")), ShouldEqual, 1)
+
+			So(m.UpdateUser(User{UID: 9999}), ShouldEqual, errNotFound)
+
+			// both were read before the updates above
+			So(m.UpdateUser(users[0]), ShouldEqual, errConflict)
+			So(m.UpdateGroup(groups[0]), ShouldEqual, errConflict)
+			users, _ = m.ListUsers(bson.M{"username": "lisi"})
+			So(users[0].Revision, ShouldEqual, user.Revision+1)
+		})
+
+		Reset(func() {
+			if backend == DBEnumMongo {
+				dropTestMongo()
+			}
+			_store.Close()
+			os.RemoveAll(tmpdir)
+			dcfg.DB.Backend = DBEnumMongo
+		})
+	})
+}
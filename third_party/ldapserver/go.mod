@@ -0,0 +1,5 @@
+module github.com/vjeantet/ldapserver
+
+go 1.14
+
+require github.com/lor00x/goldap v0.0.0-20180618054307-a546dffdd1a3
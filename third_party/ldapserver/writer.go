@@ -0,0 +1,19 @@
+package ldapserver
+
+import (
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// MessageWriter is a ResponseWriter which can also write whole
+// messages, e.g. responses with controls or extended response values
+type MessageWriter interface {
+	ResponseWriter
+	WriteMessage(m *ldap.LDAPMessage)
+}
+
+// WriteMessage writes m as the response to the request,
+// its message ID is replaced by the one of the request
+func (w responseWriterImpl) WriteMessage(m *ldap.LDAPMessage) {
+	m.SetMessageID(w.messageID)
+	w.chanOut <- m
+}
@@ -0,0 +1,314 @@
+// soft deletion, restoration and purging of users, groups and tags
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errNotDeleted = errors.New("Not deleted")
+
+func newTombstone(actor auditActor, reason string) *Tombstone {
+	return &Tombstone{
+		DeletedAt: time.Now().Truncate(time.Millisecond),
+		DeletedBy: actor.Name,
+		Reason:    reason,
+	}
+}
+
+// softDeleteUser tombstones the user and removes it from all groups,
+// the memberships are kept in the tombstone for restoreUser.
+// The user document stays in place so that its UID remains reserved.
+func softDeleteUser(m Store, username string, actor auditActor, reason string) error {
+	refs, err := groupsOfMember(m, username)
+	if err != nil {
+		return err
+	}
+	selector := bson.M{"username": username, "deleted": nil}
+	before, user, err := modifyUser(m, selector, func(u *User) error {
+		u.Deleted = newTombstone(actor, reason)
+		u.Deleted.Groups = refs
+		return nil
+	})
+	if err == errNotFound {
+		return fmt.Errorf("No such user: %s", username)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := replaceMemberships(m, refs, username, "", actor); err != nil {
+		compensateTombstone(m, user.UID, before.Deleted)
+		return err
+	}
+	writeAudit(m, actor, "user.delete", auditTargetUser, username, before, user)
+	return nil
+}
+
+// restoreUser brings a deleted user back with its group memberships,
+// memberships of groups purged in the meantime are dropped
+func restoreUser(m Store, username string, actor auditActor) error {
+	users, err := m.ListUsers(bson.M{"username": username})
+	if err != nil {
+		return err
+	} else if len(users) == 0 {
+		return fmt.Errorf("No such user: %s", username)
+	} else if users[0].Deleted == nil {
+		return errNotDeleted
+	}
+	if err := checkPrimaryGroup(m, users[0].GID, users[0].Tags); err != nil {
+		return fmt.Errorf("%s, restore or create it first", err.Error())
+	}
+
+	refs := []GroupRef{}
+	for _, ref := range users[0].Deleted.Groups {
+		groups, err := m.ListGroups(bson.M{"tag": ref.Tag, "gid": ref.GID})
+		if err != nil {
+			return err
+		} else if len(groups) == 0 {
+			logger.Warningf("Group %d [tag: %s] of %s no longer exists", ref.GID, ref.Tag, username)
+			continue
+		}
+		refs = append(refs, ref)
+	}
+
+	before, user, err := setUserTombstone(m, users[0].UID, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := replaceMemberships(m, refs, "", username, actor); err != nil {
+		compensateTombstone(m, user.UID, before.Deleted)
+		return err
+	}
+	writeAudit(m, actor, "user.restore", auditTargetUser, username, before, user)
+	return nil
+}
+
+func setUserTombstone(m Store, uid int, tombstone *Tombstone) (before, after User, err error) {
+	return modifyUser(m, bson.M{"_id": uid}, func(u *User) error {
+		u.Deleted = tombstone
+		return nil
+	})
+}
+
+// compensateTombstone reverts a user deletion or restoration
+// whose cascade into groups failed
+func compensateTombstone(m Store, uid int, tombstone *Tombstone) {
+	if _, _, err := setUserTombstone(m, uid, tombstone); err != nil {
+		logger.Errorf("Failed to roll back tombstone of user %d: %s", uid, err.Error())
+	}
+}
+
+// setGroupTombstone deletes the group with a tombstone or restores it with nil
+func setGroupTombstone(m Store, name, tag string, tombstone *Tombstone) (before, after PosixGroup, err error) {
+	before, after, err = modifyGroup(m, bson.M{"name": name, "tag": tag}, func(g *PosixGroup) error {
+		if tombstone != nil && g.Deleted != nil {
+			return fmt.Errorf("Group %s [tag: %s] is already deleted", name, tag)
+		} else if tombstone == nil && g.Deleted == nil {
+			return errNotDeleted
+		}
+		if tombstone != nil {
+			if err := checkGroupUnused(m, *g); err != nil {
+				return err
+			}
+		} else {
+			// members may have been deleted meanwhile
+			members := []string{}
+			for _, member := range g.Members {
+				if checkMember(m, member) == nil {
+					members = append(members, member)
+				}
+			}
+			g.Members = members
+		}
+		g.Deleted = tombstone
+		return nil
+	})
+	if err == errNotFound {
+		err = fmt.Errorf("No such group: %s [tag: %s]", name, tag)
+	}
+	return
+}
+
+// softDeleteGroup tombstones the group, members are kept for restoreGroup
+func softDeleteGroup(m Store, name, tag string, actor auditActor, reason string) error {
+	before, group, err := setGroupTombstone(m, name, tag, newTombstone(actor, reason))
+	if err != nil {
+		return err
+	}
+	writeAudit(m, actor, "group.delete", auditTargetGroup, groupAuditName(group), before, group)
+	return nil
+}
+
+func restoreGroup(m Store, name, tag string, actor auditActor) error {
+	before, group, err := setGroupTombstone(m, name, tag, nil)
+	if err != nil {
+		return err
+	}
+	writeAudit(m, actor, "group.restore", auditTargetGroup, groupAuditName(group), before, group)
+	return nil
+}
+
+// softDeleteTag tombstones the tag, LDAP searches under a
+// deleted tag return nothing while user tags are kept
+func softDeleteTag(m Store, name string, actor auditActor, reason string) error {
+	tags, err := m.ListTags()
+	if err != nil {
+		return err
+	}
+	t := findTag(name, tags)
+	if t == nil {
+		return fmt.Errorf("No such tag: %s", name)
+	}
+	if t.Deleted != nil {
+		return fmt.Errorf("Tag %s is already deleted", name)
+	}
+	tag := *t
+	tag.Deleted = newTombstone(actor, reason)
+	if err := m.UpdateTag(tag); err != nil {
+		return err
+	}
+	writeAudit(m, actor, "tag.delete", auditTargetTag, name, *t, tag)
+	return nil
+}
+
+func restoreTag(m Store, name string, actor auditActor) error {
+	tags, err := m.ListTags()
+	if err != nil {
+		return err
+	}
+	t := findTag(name, tags)
+	if t == nil {
+		return fmt.Errorf("No such tag: %s", name)
+	}
+	if t.Deleted == nil {
+		return errNotDeleted
+	}
+	tag := *t
+	tag.Deleted = nil
+	if err := m.UpdateTag(tag); err != nil {
+		return err
+	}
+	writeAudit(m, actor, "tag.restore", auditTargetTag, name, *t, tag)
+	return nil
+}
+
+// tagDeleted reports whether tag has been soft deleted
+func tagDeleted(m Store, name string) bool {
+	if name == "" {
+		return false
+	}
+	tags, err := m.ListTags()
+	if err != nil {
+		logger.Errorf("Failed to list tags: %s", err.Error())
+		return false
+	}
+	t := findTag(name, tags)
+	return t != nil && t.Deleted != nil
+}
+
+// purgeTombstones permanently removes everything deleted before cutoff,
+// and returns the number of purged documents. Tags are kept as long as
+// users or groups still refer to them.
+func purgeTombstones(m Store, cutoff time.Time, actor auditActor) (int, error) {
+	expired := func(t *Tombstone) bool {
+		return t != nil && t.DeletedAt.Before(cutoff)
+	}
+	deleted := bson.M{"deleted": bson.M{"$ne": nil}}
+	cnt := 0
+
+	users, err := m.ListUsers(deleted)
+	if err != nil {
+		return cnt, err
+	}
+	for _, u := range users {
+		if !expired(u.Deleted) {
+			continue
+		}
+		if err := m.DeleteUser(u.UID); err != nil {
+			return cnt, err
+		}
+		writeAudit(m, actor, "user.purge", auditTargetUser, u.Username, u, nil)
+		cnt++
+	}
+
+	groups, err := m.ListGroups(deleted)
+	if err != nil {
+		return cnt, err
+	}
+	for _, g := range groups {
+		if !expired(g.Deleted) {
+			continue
+		}
+		if err := m.DeleteGroup(g.Tag, g.GID); err != nil {
+			return cnt, err
+		}
+		writeAudit(m, actor, "group.purge", auditTargetGroup, groupAuditName(g), g, nil)
+		cnt++
+	}
+
+	tags, err := m.ListTags()
+	if err != nil {
+		return cnt, err
+	}
+	for _, t := range tags {
+		if !expired(t.Deleted) {
+			continue
+		}
+		if used, err := tagReferenced(m, t.Name); err != nil {
+			return cnt, err
+		} else if used {
+			logger.Warningf("Tag %s is still used by users or groups, not purged", t.Name)
+			continue
+		}
+		if err := m.DeleteTag(t.Name); err != nil {
+			return cnt, err
+		}
+		writeAudit(m, actor, "tag.purge", auditTargetTag, t.Name, t, nil)
+		cnt++
+	}
+	return cnt, nil
+}
+
+// tagReferenced reports whether any user or group, including deleted
+// ones, has tag
+func tagReferenced(m Store, tag string) (bool, error) {
+	users, err := m.ListUsers(bson.M{"tags": tag})
+	if err != nil || len(users) > 0 {
+		return len(users) > 0, err
+	}
+	groups, err := m.ListGroups(bson.M{"tag": tag})
+	return len(groups) > 0, err
+}
+
+// runPurgeJob purges expired tombstones once a day
+func runPurgeJob(retentionDays int) {
+	purge := func() {
+		m := getStore()
+		defer m.Close()
+		cutoff := time.Now().AddDate(0, 0, -retentionDays)
+		actor := auditActor{Name: "retention", Kind: actorSystem}
+		cnt, err := purgeTombstones(m, cutoff, actor)
+		if err != nil {
+			logger.Errorf("Failed to purge deleted accounts: %s", err.Error())
+		} else if cnt > 0 {
+			logger.Noticef("Purged %d deleted documents", cnt)
+		}
+	}
+	purge()
+	for range time.Tick(24 * time.Hour) {
+		purge()
+	}
+}
+
+func removeString(list []string, s string) []string {
+	result := []string{}
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTombstone(t *testing.T) {
+	Convey("Test soft deletion", t, func() {
+		setDefaultValues(reflect.ValueOf(&dcfg).Elem())
+		m := newMemoryStore()
+		actor := auditActor{Name: "admin", Kind: actorCLI}
+
+		So(m.InsertUser(User{UID: 2001, GID: 2000, Username: "zhangsan", Email: "zhangsan@example.com", IsActive: true, Tags: []string{"testing"}}), ShouldBeNil)
+		So(m.InsertUser(User{UID: 2002, GID: 2000, Username: "lisi", Email: "lisi@example.com", IsActive: true}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 2000, Name: "users", IsActive: true}), ShouldBeNil)
+		So(m.InsertGroup(PosixGroup{GID: 3001, Name: "dev", Tag: "testing", IsActive: true, Members: []string{"zhangsan", "lisi"}}), ShouldBeNil)
+		So(m.InsertTag(FilterTag{Name: "testing"}), ShouldBeNil)
+
+		Convey("Deleted users should be hidden and removed from groups", func() {
+			So(softDeleteUser(m, "zhangsan", actor, "left"), ShouldBeNil)
+			So(len(m.FindUsers(bson.M{"username": "zhangsan"}, "testing")), ShouldEqual, 0)
+			groups := m.FindGroups(bson.M{"name": "dev"}, "testing")
+			So(groups[0].Members, ShouldResemble, []string{"lisi"})
+
+			users, _ := m.ListUsers(bson.M{"username": "zhangsan"})
+			So(users[0].Deleted.Reason, ShouldEqual, "left")
+			So(users[0].Deleted.DeletedBy, ShouldEqual, "admin")
+
+			// UID is still reserved
+			So(m.InsertUser(User{UID: 2001, Username: "wangwu", Email: "wangwu@example.com"}), ShouldEqual, errDuplicateKey)
+			So(softDeleteUser(m, "zhangsan", actor, ""), ShouldNotBeNil)
+
+			Convey("Restored users should get memberships back", func() {
+				So(restoreUser(m, "zhangsan", actor), ShouldBeNil)
+				So(len(m.FindUsers(bson.M{"username": "zhangsan"}, "testing")), ShouldEqual, 1)
+				groups := m.FindGroups(bson.M{"name": "dev"}, "testing")
+				So(groups[0].Members, ShouldResemble, []string{"lisi", "zhangsan"})
+				So(restoreUser(m, "zhangsan", actor), ShouldEqual, errNotDeleted)
+			})
+
+			Convey("Expired tombstones should be purged", func() {
+				cnt, err := purgeTombstones(m, time.Now().Add(-time.Hour), actor)
+				So(err, ShouldBeNil)
+				So(cnt, ShouldEqual, 0)
+				cnt, err = purgeTombstones(m, time.Now().Add(time.Hour), actor)
+				So(err, ShouldBeNil)
+				So(cnt, ShouldEqual, 1)
+				users, _ := m.ListUsers(bson.M{})
+				So(len(users), ShouldEqual, 1)
+
+				records, _ := m.ListAudit(bson.M{"action": "user.purge"}, 0)
+				So(len(records), ShouldEqual, 1)
+			})
+		})
+
+		Convey("Deleted groups should be hidden until restored", func() {
+			So(softDeleteGroup(m, "dev", "testing", actor, ""), ShouldBeNil)
+			So(len(m.FindGroups(bson.M{"name": "dev"}, "testing")), ShouldEqual, 0)
+			So(restoreGroup(m, "dev", "testing", actor), ShouldBeNil)
+			groups := m.FindGroups(bson.M{"name": "dev"}, "testing")
+			So(len(groups), ShouldEqual, 1)
+			So(len(groups[0].Members), ShouldEqual, 2)
+		})
+
+		Convey("Deleted tags should be marked", func() {
+			So(tagDeleted(m, "testing"), ShouldBeFalse)
+			So(softDeleteTag(m, "testing", actor, ""), ShouldBeNil)
+			So(tagDeleted(m, "testing"), ShouldBeTrue)
+			So(restoreTag(m, "testing", actor), ShouldBeNil)
+			So(tagDeleted(m, "testing"), ShouldBeFalse)
+		})
+
+		Convey("Deleted tags should only be purged when unused", func() {
+			So(softDeleteTag(m, "testing", actor, ""), ShouldBeNil)
+			purge := func() int {
+				cnt, err := purgeTombstones(m, time.Now().Add(time.Hour), actor)
+				So(err, ShouldBeNil)
+				return cnt
+			}
+			So(purge(), ShouldEqual, 0)
+
+			users, _ := m.ListUsers(bson.M{"username": "zhangsan"})
+			users[0].Tags = nil
+			So(m.UpdateUser(users[0]), ShouldBeNil)
+			So(purge(), ShouldEqual, 0)
+
+			// the group goes in the same run as the tag
+			So(softDeleteGroup(m, "dev", "testing", actor, ""), ShouldBeNil)
+			So(purge(), ShouldEqual, 2)
+			tags, _ := m.ListTags()
+			So(len(tags), ShouldEqual, 0)
+		})
+	})
+}